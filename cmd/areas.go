@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// area is a named region whose boundary is a GeoJSON Polygon or MultiPolygon
+type area struct {
+	ID       int             `json:"id"`
+	Name     string          `json:"name"`
+	Boundary json.RawMessage `json:"boundary"`
+}
+
+// ring is a closed sequence of [longitude, latitude] positions
+type ring [][2]float64
+
+// polygon is an outer ring followed by zero or more holes
+type polygon []ring
+
+// geometry is the subset of a GeoJSON geometry object areas accept
+type geometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// parseBoundary decodes and validates a GeoJSON Polygon or MultiPolygon
+func parseBoundary(raw json.RawMessage) ([]polygon, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("boundary is required")
+	}
+
+	var g geometry
+	if err := json.Unmarshal(raw, &g); err != nil {
+		return nil, fmt.Errorf("invalid boundary: %v", err)
+	}
+
+	var polygons []polygon
+	switch g.Type {
+	case "Polygon":
+		var p polygon
+		if err := json.Unmarshal(g.Coordinates, &p); err != nil {
+			return nil, fmt.Errorf("invalid polygon coordinates: %v", err)
+		}
+		polygons = []polygon{p}
+	case "MultiPolygon":
+		if err := json.Unmarshal(g.Coordinates, &polygons); err != nil {
+			return nil, fmt.Errorf("invalid multipolygon coordinates: %v", err)
+		}
+	default:
+		return nil, errors.New("boundary must be a GeoJSON Polygon or MultiPolygon")
+	}
+
+	if len(polygons) == 0 {
+		return nil, errors.New("boundary has no polygons")
+	}
+	for _, p := range polygons {
+		if len(p) == 0 {
+			return nil, errors.New("polygon has no rings")
+		}
+		for _, r := range p {
+			if len(r) < 4 {
+				return nil, errors.New("polygon rings need at least four positions")
+			}
+			if r[0] != r[len(r)-1] {
+				return nil, errors.New("polygon rings must be closed")
+			}
+			for _, pos := range r {
+				if err := validLatLon(pos[1], pos[0]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return polygons, nil
+}
+
+// contains reports whether the point lies inside the ring using ray casting
+func (r ring) contains(lat, lon float64) bool {
+	inside := false
+	for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+		xi, yi := r[i][0], r[i][1]
+		xj, yj := r[j][0], r[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// contains reports whether the point lies inside the outer ring and outside every hole
+func (p polygon) contains(lat, lon float64) bool {
+	if !p[0].contains(lat, lon) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if hole.contains(lat, lon) {
+			return false
+		}
+	}
+	return true
+}
+
+// boundaryContains reports whether any polygon of the boundary contains the point
+func boundaryContains(polygons []polygon, lat, lon float64) bool {
+	for _, p := range polygons {
+		if p.contains(lat, lon) {
+			return true
+		}
+	}
+	return false
+}
+
+// areaBoundary is an area's ID with its boundary already parsed
+type areaBoundary struct {
+	id       int
+	polygons []polygon
+}
+
+// loadAreaBoundaries lists every area and parses its boundary
+func loadAreaBoundaries(ctx context.Context) ([]areaBoundary, error) {
+	areas, err := areaRepo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	boundaries := make([]areaBoundary, 0, len(areas))
+	for _, a := range areas {
+		polygons, err := parseBoundary(a.Boundary)
+		if err != nil {
+			// Boundaries are validated on write, so skip anything malformed
+			continue
+		}
+		boundaries = append(boundaries, areaBoundary{id: a.ID, polygons: polygons})
+	}
+	return boundaries, nil
+}
+
+// boundaryContaining returns the ID of the first area whose boundary contains the point
+func boundaryContaining(boundaries []areaBoundary, lat, lon float64) (int, bool) {
+	for _, b := range boundaries {
+		if boundaryContains(b.polygons, lat, lon) {
+			return b.id, true
+		}
+	}
+	return 0, false
+}
+
+// validateArea checks every field of an area payload. Invalid payloads
+// return a validationError.
+func validateArea(a area) error {
+	var errs validationError
+	if a.ID < 0 || a.ID > maxID {
+		errs = append(errs, fieldError{Field: "id", Code: codeOutOfRange, Message: "id must be between 0 and " + strconv.Itoa(maxID)})
+	}
+	if strings.TrimSpace(a.Name) == "" {
+		errs = append(errs, fieldError{Field: "name", Code: codeRequired, Message: "name is required"})
+	}
+	if len(a.Boundary) == 0 {
+		errs = append(errs, fieldError{Field: "boundary", Code: codeRequired, Message: "boundary is required"})
+	} else if _, err := parseBoundary(a.Boundary); err != nil {
+		errs = append(errs, fieldError{Field: "boundary", Code: codeInvalidGeometry, Message: err.Error()})
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func getAreas(c *gin.Context) {
+	areas, err := areaRepo.List(c.Request.Context())
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, areas)
+}
+
+func getAreaByID(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Error(badRequest("invalid area ID"))
+		return
+	}
+
+	a, err := areaRepo.Get(c.Request.Context(), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, a)
+}
+
+func postArea(c *gin.Context) {
+	var a area
+	if err := c.ShouldBindJSON(&a); err != nil {
+		c.Error(decodeError(err))
+		return
+	}
+	if err := validateArea(a); err != nil {
+		c.Error(invalidFields("area is invalid", fieldErrors(err)))
+		return
+	}
+	// Creation is conditional, so of two concurrent posts one gets 409
+	if err := areaRepo.Create(c.Request.Context(), a); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, a)
+}
+
+func updateArea(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Error(badRequest("invalid area ID"))
+		return
+	}
+
+	var a area
+	if err := c.ShouldBindJSON(&a); err != nil {
+		c.Error(decodeError(err))
+		return
+	}
+	a.ID = id
+	if err := validateArea(a); err != nil {
+		c.Error(invalidFields("area is invalid", fieldErrors(err)))
+		return
+	}
+
+	if _, err := areaRepo.Get(c.Request.Context(), id); err != nil {
+		c.Error(err)
+		return
+	}
+	if err := areaRepo.Save(c.Request.Context(), a); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, a)
+}
+
+func deleteArea(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Error(badRequest("invalid area ID"))
+		return
+	}
+
+	if _, err := areaRepo.Get(c.Request.Context(), id); err != nil {
+		c.Error(err)
+		return
+	}
+
+	// Stores would be left pointing at a missing area. Cassandra cannot make
+	// the check and the delete atomic, so a store created in between survives.
+	stores, _, err := storeRepo.ListByArea(c.Request.Context(), id, 1, pageCursor{})
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if len(stores) > 0 {
+		c.Error(errAreaInUse)
+		return
+	}
+
+	if err := areaRepo.Delete(c.Request.Context(), id); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "area deleted"})
+}
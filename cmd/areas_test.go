@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseBoundary(t *testing.T) {
+	tests := []struct {
+		name     string
+		boundary string
+		polygons int
+		err      string
+	}{
+		{"polygon", `{"type":"Polygon","coordinates":[[[0,0],[10,0],[10,10],[0,0]]]}`, 1, ""},
+		{"multipolygon", `{"type":"MultiPolygon","coordinates":[[[[0,0],[1,0],[1,1],[0,0]]],[[[5,5],[6,5],[6,6],[5,5]]]]}`, 2, ""},
+		{"missing", ``, 0, "boundary is required"},
+		{"not json", `{`, 0, "invalid boundary"},
+		{"point", `{"type":"Point","coordinates":[0,0]}`, 0, "must be a GeoJSON Polygon or MultiPolygon"},
+		{"no rings", `{"type":"Polygon","coordinates":[]}`, 0, "polygon has no rings"},
+		{"empty multipolygon", `{"type":"MultiPolygon","coordinates":[]}`, 0, "boundary has no polygons"},
+		{"too few positions", `{"type":"Polygon","coordinates":[[[0,0],[1,0],[0,0]]]}`, 0, "at least four positions"},
+		{"open ring", `{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1]]]}`, 0, "must be closed"},
+		{"latitude out of range", `{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,91],[0,0]]]}`, 0, "latitude must be between"},
+		{"coordinates of the wrong shape", `{"type":"Polygon","coordinates":[[0,0]]}`, 0, "invalid polygon coordinates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			polygons, err := parseBoundary(json.RawMessage(tt.boundary))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(polygons) != tt.polygons {
+				t.Errorf("got %d polygons, want %d", len(polygons), tt.polygons)
+			}
+		})
+	}
+}
+
+func TestBoundaryContains(t *testing.T) {
+	// A 10 by 10 square with a 2 by 2 hole in the middle, and a separate unit square
+	polygons, err := parseBoundary(json.RawMessage(`{"type":"MultiPolygon","coordinates":[
+		[[[0,0],[10,0],[10,10],[0,10],[0,0]],[[4,4],[6,4],[6,6],[4,6],[4,4]]],
+		[[[20,20],[21,20],[21,21],[20,21],[20,20]]]
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		lat, lon float64
+		want     bool
+	}{
+		{"inside the square", 2, 2, true},
+		{"inside the hole", 5, 5, false},
+		{"inside the second polygon", 20.5, 20.5, true},
+		{"outside both", 15, 15, false},
+		{"latitude and longitude are not swapped", 2, 12, false},
+	}
+	for _, tt := range tests {
+		if got := boundaryContains(polygons, tt.lat, tt.lon); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateArea(t *testing.T) {
+	square := json.RawMessage(`{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1],[0,0]]]}`)
+	tests := []struct {
+		name string
+		a    area
+		want []fieldError
+	}{
+		{"valid", area{ID: 1, Name: "A", Boundary: square}, nil},
+		{"negative id", area{ID: -1, Name: "A", Boundary: square}, []fieldError{{Field: "id", Code: codeOutOfRange}}},
+		{"id beyond a CQL int", area{ID: maxID + 1, Name: "A", Boundary: square}, []fieldError{{Field: "id", Code: codeOutOfRange}}},
+		{"blank name", area{ID: 1, Name: " ", Boundary: square}, []fieldError{{Field: "name", Code: codeRequired}}},
+		{"no boundary", area{ID: 1, Name: "A"}, []fieldError{{Field: "boundary", Code: codeRequired}}},
+		{"point boundary", area{ID: 1, Name: "A", Boundary: json.RawMessage(`{"type":"Point","coordinates":[0,0]}`)},
+			[]fieldError{{Field: "boundary", Code: codeInvalidGeometry}}},
+		{"every field", area{ID: -1}, []fieldError{
+			{Field: "id", Code: codeOutOfRange}, {Field: "name", Code: codeRequired}, {Field: "boundary", Code: codeRequired},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fieldErrors(validateArea(tt.a))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+			for i, f := range got {
+				if f.Field != tt.want[i].Field || f.Code != tt.want[i].Code || f.Message == "" {
+					t.Errorf("error %d is %+v, want %s %s", i, f, tt.want[i].Field, tt.want[i].Code)
+				}
+			}
+		})
+	}
+}
+
+func TestAreaHandlers(t *testing.T) {
+	useMemoryRepositories(t)
+	ctx := context.Background()
+	if err := areaRepo.Create(ctx, testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := areaRepo.Create(ctx, area{ID: 2, Name: "Empty", Boundary: testArea(2).Boundary}); err != nil {
+		t.Fatal(err)
+	}
+	mustCreateStores(t, store{ID: 1, AreaID: 1, Name: "In area 1"})
+	r := newTestRouter()
+
+	square := `{"type":"Polygon","coordinates":[[[20,20],[21,20],[21,21],[20,21],[20,20]]]}`
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"create", http.MethodPost, "/v1/areas", `{"id":3,"name":"New","boundary":` + square + `}`, http.StatusCreated, ""},
+		{"create a taken id", http.MethodPost, "/v1/areas", `{"id":1,"name":"Again","boundary":` + square + `}`, http.StatusConflict, errCodeConflict},
+		{"create a negative id", http.MethodPost, "/v1/areas", `{"id":-1,"name":"Negative","boundary":` + square + `}`, http.StatusBadRequest, errCodeValidation},
+		{"create without a name", http.MethodPost, "/v1/areas", `{"id":4,"boundary":` + square + `}`, http.StatusBadRequest, errCodeValidation},
+		{"create with an open ring", http.MethodPost, "/v1/areas", `{"id":4,"name":"Open","boundary":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1]]]}}`, http.StatusBadRequest, errCodeValidation},
+		{"get", http.MethodGet, "/v1/areas/3", "", http.StatusOK, ""},
+		{"get a missing area", http.MethodGet, "/v1/areas/9", "", http.StatusNotFound, errCodeNotFound},
+		{"update", http.MethodPut, "/v1/areas/3", `{"name":"Renamed","boundary":` + square + `}`, http.StatusOK, ""},
+		{"update without a boundary", http.MethodPut, "/v1/areas/3", `{"name":"Renamed"}`, http.StatusBadRequest, errCodeValidation},
+		{"update a missing area", http.MethodPut, "/v1/areas/9", `{"name":"Missing","boundary":` + square + `}`, http.StatusNotFound, errCodeNotFound},
+		{"delete an area with stores", http.MethodDelete, "/v1/areas/1", "", http.StatusConflict, errCodeConflict},
+		{"delete an empty area", http.MethodDelete, "/v1/areas/2", "", http.StatusOK, ""},
+		{"delete a missing area", http.MethodDelete, "/v1/areas/2", "", http.StatusNotFound, errCodeNotFound},
+		{"invalid id", http.MethodGet, "/v1/areas/x", "", http.StatusBadRequest, errCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, tt.method, tt.path, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.code == "" {
+				return
+			}
+			var p problem
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			if p.Code != tt.code {
+				t.Errorf("code %q, want %q", p.Code, tt.code)
+			}
+		})
+	}
+
+	if a, err := areaRepo.Get(ctx, 1); err != nil || a.Name != "Area A" {
+		t.Errorf("area in use is %+v, %v after the refused delete", a, err)
+	}
+}
+
+func TestStoreAreaAssignment(t *testing.T) {
+	useMemoryRepositories(t)
+	ctx := context.Background()
+	if err := areaRepo.Create(ctx, testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := areaRepo.Create(ctx, area{ID: 2, Name: "North", Boundary: json.RawMessage(`{"type":"Polygon","coordinates":[[[0,20],[10,20],[10,30],[0,30],[0,20]]]}`)}); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRouter()
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		area   int
+	}{
+		{"coordinates in the first area", `{"name":"A","latitude":5,"longitude":5}`, http.StatusCreated, 1},
+		{"coordinates in the second area", `{"name":"B","latitude":25,"longitude":5}`, http.StatusCreated, 2},
+		{"areaId wins over the coordinates", `{"name":"C","areaId":2,"latitude":5,"longitude":5}`, http.StatusCreated, 2},
+		{"coordinates outside every area", `{"name":"D","latitude":50,"longitude":50}`, http.StatusBadRequest, 0},
+		{"neither areaId nor coordinates", `{"name":"E"}`, http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodPost, "/v1/stores", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusCreated {
+				return
+			}
+			var resp bulkResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Results[0].Store.AreaID; got != tt.area {
+				t.Errorf("assigned area %d, want %d", got, tt.area)
+			}
+		})
+	}
+}
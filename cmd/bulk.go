@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// bulkParallelism is how many stores are written at once
+	bulkParallelism = 4
+	// maxStoresBodySize caps the body of POST /stores, which is decoded whole
+	maxStoresBodySize = 10 << 20
+	// maxCreateAttempts bounds how often a store is given a fresh ID after
+	// a client took the allocated one for a store of its own
+	maxCreateAttempts = 3
+)
+
+// Outcomes of one item of a bulk request
+const (
+	bulkCreated  = "created"
+	bulkInvalid  = "invalid"
+	bulkConflict = "conflict"
+	bulkFailed   = "failed"
+)
+
+// bulkResult reports what happened to one item of a bulk request
+type bulkResult struct {
+	Index  int          `json:"index"`
+	ID     int          `json:"id,omitempty"`
+	Status string       `json:"status"`
+	Error  string       `json:"error,omitempty"`
+	Errors []fieldError `json:"errors,omitempty"`
+	Store  *store       `json:"store,omitempty"`
+	// err is why a failed item failed, which the client sees as Error
+	err error
+}
+
+// bulkResponse is the body of POST /stores
+type bulkResponse struct {
+	Created  int          `json:"created"`
+	Invalid  int          `json:"invalid"`
+	Conflict int          `json:"conflict"`
+	Failed   int          `json:"failed"`
+	Results  []bulkResult `json:"results"`
+}
+
+// bulkItem is a validated store waiting to be written
+type bulkItem struct {
+	index int
+	store store
+}
+
+// validateBulk resolves every input, recording invalid ones in results and
+// returning the stores to write
+func validateBulk(ctx context.Context, inputs []storeInput, results []bulkResult) []bulkItem {
+	items := make([]bulkItem, 0, len(inputs))
+	seen := make(map[int]int, len(inputs))
+	validator := newStoreValidator()
+	for i, in := range inputs {
+		results[i] = bulkResult{Index: i, ID: in.ID}
+
+		if first, ok := seen[in.ID]; ok && in.ID != 0 {
+			msg := "id duplicates item " + strconv.Itoa(first)
+			results[i].Status = bulkInvalid
+			results[i].Error = msg
+			results[i].Errors = []fieldError{{Field: "id", Code: codeDuplicate, Message: msg}}
+			continue
+		}
+		seen[in.ID] = i
+
+		s, err := validator.storeFromInput(ctx, in)
+		if err != nil {
+			if !isInvalidInput(err) {
+				results[i].Status = bulkFailed
+				results[i].Error = failureDetail(err)
+				results[i].err = err
+				continue
+			}
+			results[i].Status = bulkInvalid
+			results[i].Error = err.Error()
+			results[i].Errors = fieldErrors(err)
+			continue
+		}
+		items = append(items, bulkItem{index: i, store: s})
+	}
+	return items
+}
+
+// createStore writes a new store, allocating its ID when it has none, and
+// returns it with the ID last tried. An allocated ID that a client took for
+// its own store in the meantime is replaced rather than reported as a
+// conflict.
+func createStore(ctx context.Context, s store) (store, error) {
+	if s.ID != 0 {
+		return s, storeRepo.Create(ctx, s)
+	}
+	for attempt := 1; ; attempt++ {
+		id, err := storeRepo.NextID(ctx)
+		if err != nil {
+			return store{}, err
+		}
+		s.ID = id
+		err = storeRepo.Create(ctx, s)
+		if errors.Is(err, errStoreExists) && attempt < maxCreateAttempts {
+			continue
+		}
+		return s, err
+	}
+}
+
+// createBulk creates the stores, at most bulkParallelism at a time, and
+// records each item's outcome. Creation is conditional on the ID being free,
+// which Cassandra cannot check across partitions in one batch, so every store
+// is written on its own.
+func createBulk(ctx context.Context, items []bulkItem, results []bulkResult) {
+	sem := make(chan struct{}, bulkParallelism)
+	var wg sync.WaitGroup
+
+	for _, item := range items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(item bulkItem) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// Each goroutine owns a distinct index of results
+			result := &results[item.index]
+			s, err := createStore(ctx, item.store)
+			switch {
+			case errors.Is(err, errStoreExists):
+				result.Status = bulkConflict
+				result.Error = "store " + strconv.Itoa(s.ID) + " already exists"
+			case err != nil:
+				result.Status = bulkFailed
+				result.Error = failureDetail(err)
+				result.err = err
+			default:
+				result.ID = s.ID
+				result.Status = bulkCreated
+				result.Store = &s
+			}
+		}(item)
+	}
+	wg.Wait()
+}
+
+// summary is the response without the stored fields and field errors of
+// each item, replayed to retries when the response is too large to store
+func (resp bulkResponse) summary() bulkResponse {
+	results := make([]bulkResult, len(resp.Results))
+	for i, r := range resp.Results {
+		results[i] = bulkResult{Index: r.Index, ID: r.ID, Status: r.Status}
+	}
+	resp.Results = results
+	return resp
+}
+
+// sharedFailure returns the error a request failed with as a whole: the
+// failure of its only item, or the failure every item had for the same
+// reason. It returns nil when any item got further or items failed for
+// different reasons.
+func sharedFailure(results []bulkResult) error {
+	var first *apiError
+	var firstErr error
+	for _, r := range results {
+		if r.Status != bulkFailed {
+			return nil
+		}
+		e := toAPIError(r.err)
+		if firstErr == nil {
+			first, firstErr = e, r.err
+			continue
+		}
+		if e.Status != first.Status || e.Code != first.Code {
+			return nil
+		}
+	}
+	return firstErr
+}
+
+// bulkStatus is 201 when everything was created, 207 when outcomes are mixed,
+// 400 when every item was invalid and 500 when every item failed for
+// different reasons
+func bulkStatus(resp bulkResponse) int {
+	switch len(resp.Results) {
+	case resp.Created:
+		return http.StatusCreated
+	case resp.Invalid:
+		return http.StatusBadRequest
+	case resp.Failed:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusMultiStatus
+	}
+}
+
+func postStores(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.Error(decodeError(err))
+		return
+	}
+
+	// Accept a store, a JSON array of stores or a GeoJSON Feature/FeatureCollection
+	inputs, err := decodeStoreInputs(body)
+	if err != nil {
+		c.Error(decodeError(err))
+		return
+	}
+	if len(inputs) == 0 {
+		c.Error(badRequest("no stores to create"))
+		return
+	}
+
+	results := make([]bulkResult, len(inputs))
+	items := validateBulk(c.Request.Context(), inputs, results)
+	createBulk(c.Request.Context(), items, results)
+
+	resp := bulkResponse{Results: results}
+	for _, r := range results {
+		switch r.Status {
+		case bulkCreated:
+			resp.Created++
+		case bulkInvalid:
+			resp.Invalid++
+		case bulkConflict:
+			resp.Conflict++
+		case bulkFailed:
+			resp.Failed++
+		}
+	}
+
+	// When nothing was valid the problem lists every invalid field, prefixed
+	// with the item index when there were several
+	if resp.Invalid == len(results) {
+		var errs []fieldError
+		for _, r := range results {
+			prefix := ""
+			if len(results) > 1 {
+				prefix = "[" + strconv.Itoa(r.Index) + "]."
+			}
+			errs = append(errs, validationError(r.Errors).prefixed(prefix)...)
+		}
+		c.Error(invalidFields("no store is valid", errs))
+		return
+	}
+	// A failure the whole request shares, such as the database being down, is
+	// reported as a problem with the status of its cause
+	if err := sharedFailure(results); err != nil {
+		c.Error(err)
+		return
+	}
+	if resp.Conflict == len(results) {
+		detail := "every store already exists"
+		if len(results) == 1 {
+			detail = results[0].Error
+		}
+		c.Error(conflict(detail))
+		return
+	}
+
+	setReplaySummary(c, resp.summary())
+
+	// A single store created has a URL of its own
+	if len(results) == 1 && results[0].Status == bulkCreated {
+		c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+strconv.Itoa(results[0].ID))
+	}
+	c.IndentedJSON(bulkStatus(resp), resp)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestBulkStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		resp bulkResponse
+		want int
+	}{
+		{"all created", bulkResponse{Created: 2}, http.StatusCreated},
+		{"all invalid", bulkResponse{Invalid: 2}, http.StatusBadRequest},
+		{"all failed", bulkResponse{Failed: 2}, http.StatusInternalServerError},
+		{"mixed", bulkResponse{Created: 1, Invalid: 1}, http.StatusMultiStatus},
+		{"created and conflicting", bulkResponse{Created: 1, Conflict: 1}, http.StatusMultiStatus},
+	}
+	for _, tt := range tests {
+		tt.resp.Results = make([]bulkResult, tt.resp.Created+tt.resp.Invalid+tt.resp.Conflict+tt.resp.Failed)
+		if got := bulkStatus(tt.resp); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPostStoresResults(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	mustCreateStores(t, store{ID: 1, AreaID: 1, Name: "Taken"})
+	r := newTestRouter()
+
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		statuses []string
+	}{
+		{"single store", `{"id":2,"name":"A","areaId":1}`, http.StatusCreated, []string{bulkCreated}},
+		{"mixed outcomes", `[
+			{"id":3,"name":"B","areaId":1},
+			{"id":4,"name":"","areaId":1},
+			{"id":1,"name":"Again","areaId":1},
+			{"id":3,"name":"Duplicate","areaId":1},
+			{"id":5,"name":"C","areaId":9}
+		]`, http.StatusMultiStatus, []string{bulkCreated, bulkInvalid, bulkConflict, bulkInvalid, bulkInvalid}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodPost, "/v1/stores", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var resp bulkResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Results) != len(tt.statuses) {
+				t.Fatalf("got %d results, want %d", len(resp.Results), len(tt.statuses))
+			}
+			counts := make(map[string]int)
+			for i, result := range resp.Results {
+				counts[result.Status]++
+				if result.Index != i || result.Status != tt.statuses[i] {
+					t.Errorf("result %d is %+v, want status %s", i, result, tt.statuses[i])
+				}
+				if result.Status == bulkInvalid && len(result.Errors) == 0 {
+					t.Errorf("invalid result %d lists no field errors", i)
+				}
+				if result.Status == bulkCreated && result.Store == nil {
+					t.Errorf("created result %d has no store", i)
+				}
+			}
+			if resp.Created != counts[bulkCreated] || resp.Invalid != counts[bulkInvalid] || resp.Conflict != counts[bulkConflict] {
+				t.Errorf("totals %+v do not match the results", resp)
+			}
+		})
+	}
+
+	if _, err := storeRepo.Get(context.Background(), 4); err == nil {
+		t.Error("the invalid store was written")
+	}
+	if s, _ := storeRepo.Get(context.Background(), 1); s.Name != "Taken" {
+		t.Errorf("the conflicting store overwrote store 1: %+v", s)
+	}
+}
+
+func TestPostStoresProblems(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	mustCreateStores(t, store{ID: 1, AreaID: 1, Name: "Taken"}, store{ID: 2, AreaID: 1, Name: "Taken too"})
+	r := newTestRouter()
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+		fields []string
+	}{
+		{"every store invalid", `[{"id":3,"areaId":1},{"id":4,"name":"B"}]`, http.StatusBadRequest, errCodeValidation, []string{"[0].name", "[1].areaId"}},
+		{"single invalid store", `{"id":3,"areaId":1}`, http.StatusBadRequest, errCodeValidation, []string{"name"}},
+		{"every store exists", `[{"id":1,"name":"A","areaId":1},{"id":2,"name":"B","areaId":1}]`, http.StatusConflict, errCodeConflict, nil},
+		{"empty array", `[]`, http.StatusBadRequest, errCodeBadRequest, nil},
+		{"wrong type", `{"id":"3","name":"A","areaId":1}`, http.StatusBadRequest, errCodeValidation, []string{"id"}},
+		{"not json", `{`, http.StatusBadRequest, errCodeBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodPost, "/v1/stores", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var p problem
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			if p.Code != tt.code {
+				t.Errorf("code %q, want %q", p.Code, tt.code)
+			}
+			var fields []string
+			for _, f := range p.Errors {
+				fields = append(fields, f.Field)
+			}
+			if len(fields) != len(tt.fields) {
+				t.Fatalf("fields %q, want %q", fields, tt.fields)
+			}
+			for i := range fields {
+				if fields[i] != tt.fields[i] {
+					t.Errorf("fields %q, want %q", fields, tt.fields)
+				}
+			}
+		})
+	}
+}
+
+func TestBulkResponseSummary(t *testing.T) {
+	resp := bulkResponse{Created: 1, Invalid: 1, Results: []bulkResult{
+		{Index: 0, ID: 1, Status: bulkCreated, Store: &store{ID: 1, Name: "A"}},
+		{Index: 1, ID: 2, Status: bulkInvalid, Error: "name is required", Errors: []fieldError{{Field: "name"}}},
+	}}
+	summary := resp.summary()
+	if summary.Created != 1 || summary.Invalid != 1 || len(summary.Results) != 2 {
+		t.Fatalf("got %+v", summary)
+	}
+	for i, r := range summary.Results {
+		if r.Store != nil || r.Errors != nil || r.Error != "" {
+			t.Errorf("summary result %d keeps details: %+v", i, r)
+		}
+		if r.Index != i || r.ID != i+1 || r.Status != resp.Results[i].Status {
+			t.Errorf("summary result %d is %+v", i, r)
+		}
+	}
+	if resp.Results[0].Store == nil {
+		t.Error("summary changed the response it was taken from")
+	}
+}
+
+func TestPostStoresMany(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRouter()
+
+	body := "["
+	n := 3*bulkParallelism + 1
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			body += ","
+		}
+		body += `{"name":"Store ` + strconv.Itoa(i) + `","areaId":1}`
+	}
+	body += "]"
+
+	w := serve(r, http.MethodPost, "/v1/stores", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp bulkResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int]bool)
+	for _, result := range resp.Results {
+		if result.ID == 0 || seen[result.ID] {
+			t.Errorf("result %d was given id %d", result.Index, result.ID)
+		}
+		seen[result.ID] = true
+	}
+	if resp.Created != n {
+		t.Errorf("created %d of %d", resp.Created, n)
+	}
+}
@@ -0,0 +1,769 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// cassandraStoreRepository stores stores in the stores table and maintains
+// the area, geohash and search index tables alongside every write
+type cassandraStoreRepository struct {
+	session consistencySession
+	// areaReads is set once area listings may be served from stores_by_area
+	areaReads bool
+	// searchReads is set once searches may look stores up in store_search_index
+	searchReads bool
+}
+
+func newCassandraStoreRepository(session *gocql.Session, policy consistencyPolicy) *cassandraStoreRepository {
+	return &cassandraStoreRepository{
+		session:     consistencySession{Session: session, policy: policy},
+		areaReads:   migrationApplied(context.Background(), session, migrationAreaReads),
+		searchReads: migrationApplied(context.Background(), session, migrationSearchReads),
+	}
+}
+
+func (r *cassandraStoreRepository) Get(ctx context.Context, id int) (store, error) {
+	ctx = withOperation(ctx, opGet)
+	var s store
+	err := r.session.query(ctx, "SELECT "+storeColumns+", version FROM stores WHERE id = ?", id).
+		Scan(append(s.scanTargets(), &s.Version)...)
+	if err == gocql.ErrNotFound {
+		return store{}, errStoreNotFound
+	}
+	return s, err
+}
+
+func (r *cassandraStoreRepository) List(ctx context.Context, pageSize int, cursor pageCursor) ([]store, pageCursor, error) {
+	ctx = withOperation(ctx, opList)
+	return r.queryStorePage(ctx, "SELECT "+storeColumns+" FROM stores", nil, pageSize, cursor)
+}
+
+func (r *cassandraStoreRepository) ListByArea(ctx context.Context, areaID, pageSize int, cursor pageCursor) ([]store, pageCursor, error) {
+	ctx = withOperation(ctx, opList)
+	return r.queryStorePage(ctx, r.areaQuery(), []interface{}{areaID}, pageSize, cursor)
+}
+
+// areaQuery selects the stores of one area, from the area-partitioned table
+// once reads have been cut over to it
+func (r *cassandraStoreRepository) areaQuery() string {
+	if r.areaReads {
+		return "SELECT " + storeColumns + " FROM stores_by_area WHERE area_id = ?"
+	}
+	return "SELECT " + storeColumns + " FROM stores WHERE area_id = ? ALLOW FILTERING"
+}
+
+func (r *cassandraStoreRepository) Search(ctx context.Context, criteria searchCriteria) ([]searchResult, error) {
+	ctx = withOperation(ctx, opSearch)
+	queries := searchQueries(criteria)
+
+	var candidates map[int]bool
+	if len(queries) > 0 && r.searchReads {
+		var err error
+		candidates, err = searchCandidates(queries, criteria.Fuzzy, func(term, field string) (map[int]bool, error) {
+			return r.lookupTerm(ctx, term, field)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Without text criteria, before the index is complete, or with fuzzy
+	// tokens too short for the index to narrow, the search scores a plain
+	// area listing
+	if candidates == nil {
+		stores, err := r.storesInArea(ctx, criteria.AreaID)
+		if err != nil {
+			return nil, err
+		}
+		return scoreStores(stores, criteria), nil
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]int, 0, len(candidates))
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	stores, err := r.fetchStores(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// Score against the stored text, which also discards trigram false positives
+	return scoreStores(stores, criteria), nil
+}
+
+func (r *cassandraStoreRepository) Within(ctx context.Context, box boundingBox) ([]store, error) {
+	ctx = withOperation(ctx, opWithin)
+	cells, err := coveringCells(box)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := r.storesInCells(ctx, cells)
+	if err != nil {
+		return nil, err
+	}
+
+	stores := candidates[:0]
+	for _, s := range candidates {
+		if s.hasCoordinates() && box.contains(*s.Latitude, *s.Longitude) {
+			stores = append(stores, s)
+		}
+	}
+	return stores, nil
+}
+
+// storeIDCounter is the id_counters row store IDs are allocated from
+const storeIDCounter = "stores"
+
+// maxAllocateAttempts bounds how often NextID retries after other servers
+// claimed the ID it read
+const maxAllocateAttempts = 10
+
+var errIDContention = errors.New("store ID allocation kept losing to concurrent writers")
+
+// NextID claims the next value of the store ID counter with a lightweight
+// transaction, so servers never hand out the same ID twice
+func (r *cassandraStoreRepository) NextID(ctx context.Context) (int, error) {
+	ctx = withOperation(ctx, opCreate)
+	var next int
+	err := r.session.query(ctx, "SELECT next_id FROM id_counters WHERE name = ?", storeIDCounter).Scan(&next)
+	if err == gocql.ErrNotFound {
+		return 0, errors.New("the store ID counter is missing; run the migrations")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for attempt := 0; attempt < maxAllocateAttempts; attempt++ {
+		// next_id is a CQL int and cannot move past maxID
+		if next >= maxID {
+			return 0, errIDsExhausted
+		}
+		current := map[string]interface{}{}
+		applied, err := r.session.query(ctx, "UPDATE id_counters SET next_id = ? WHERE name = ? IF next_id = ?",
+			next+1, storeIDCounter, next).MapScanCAS(current)
+		if err != nil {
+			return 0, err
+		}
+		if applied {
+			return next, nil
+		}
+		// A lost race reports the value the winner left
+		next, _ = current["next_id"].(int)
+	}
+	return 0, errIDContention
+}
+
+// raiseIDCounter moves the store ID counter past an ID written by a client,
+// so NextID does not hand it out again. The counter only ever moves forward,
+// and stops at maxID once a client takes the last ID.
+func (r *cassandraStoreRepository) raiseIDCounter(ctx context.Context, id int) error {
+	target := min(id+1, maxID)
+	var next int
+	err := r.session.query(ctx, "SELECT next_id FROM id_counters WHERE name = ?", storeIDCounter).Scan(&next)
+	if err == gocql.ErrNotFound {
+		// Without the counter nothing is allocated, as NextID reports
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; next < target; attempt++ {
+		if attempt == maxAllocateAttempts {
+			return errIDContention
+		}
+		current := map[string]interface{}{}
+		applied, err := r.session.query(ctx, "UPDATE id_counters SET next_id = ? WHERE name = ? IF next_id = ?",
+			target, storeIDCounter, next).MapScanCAS(current)
+		if err != nil {
+			return err
+		}
+		if applied {
+			return nil
+		}
+		next, _ = current["next_id"].(int)
+	}
+	return nil
+}
+
+// Create inserts the stores row only if the ID is free. The condition covers
+// the stores table alone, as in Update; the area and index rows follow.
+func (r *cassandraStoreRepository) Create(ctx context.Context, s store) error {
+	ctx = withOperation(ctx, opCreate)
+	applied, err := r.session.query(ctx, `INSERT INTO stores (id, area_id, name, location, latitude, longitude, version)
+		VALUES (?, ?, ?, ?, ?, ?, ?) IF NOT EXISTS`,
+		s.ID, s.AreaID, s.Name, s.Location, s.Latitude, s.Longitude, nextVersion(0)).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return errStoreExists
+	}
+
+	batch := r.session.newBatch(ctx, gocql.LoggedBatch)
+	addAreaQueries(batch, nil, s)
+	addGeohashIndexQueries(batch, nil, s)
+	addSearchIndexQueries(batch, nil, s)
+	if err := r.session.ExecuteBatch(batch); err != nil {
+		return err
+	}
+	return r.raiseIDCounter(ctx, s.ID)
+}
+
+func (r *cassandraStoreRepository) BatchCreate(ctx context.Context, stores []store) error {
+	ctx = withOperation(ctx, opCreate)
+	if err := r.batchStoreInsert(ctx, stores); err != nil {
+		return err
+	}
+
+	highest := 0
+	for _, s := range stores {
+		highest = max(highest, s.ID)
+	}
+	return r.raiseIDCounter(ctx, highest)
+}
+
+// maxUpdateAttempts bounds the retries of an update or delete without a
+// required version that keeps losing to concurrent writers. The version guard
+// is a lightweight transaction on the stores table alone, since a conditional
+// batch cannot span tables; the area and index tables follow once it applied.
+const maxUpdateAttempts = 3
+
+func (r *cassandraStoreRepository) Update(ctx context.Context, s store, ifVersion int64) (store, store, error) {
+	return r.UpdateColumns(ctx, s, writableStoreColumns, ifVersion)
+}
+
+func (r *cassandraStoreRepository) UpdateColumns(ctx context.Context, s store, columns []string, ifVersion int64) (store, store, error) {
+	ctx = withOperation(ctx, opUpdate)
+	for attempt := 1; ; attempt++ {
+		previous, err := r.Get(ctx, s.ID)
+		if err != nil {
+			return store{}, store{}, err
+		}
+		if ifVersion != anyVersion && previous.Version != ifVersion {
+			return store{}, store{}, errVersionConflict
+		}
+
+		updated := previous.withColumns(s, columns)
+		updated.Version = nextVersion(previous.Version)
+		assignments := make([]string, 0, len(columns)+1)
+		args := make([]interface{}, 0, len(columns)+3)
+		for _, column := range columns {
+			assignments = append(assignments, column+" = ?")
+			args = append(args, updated.columnValue(column))
+		}
+		assignments = append(assignments, "version = ?")
+		cond, condArgs := versionCondition(previous.Version)
+		args = append(append(args, updated.Version, s.ID), condArgs...)
+		applied, err := r.session.query(ctx, "UPDATE stores SET "+strings.Join(assignments, ", ")+" WHERE id = ?"+cond,
+			args...).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			return store{}, store{}, err
+		}
+		if !applied {
+			err := r.lostVersionRace(ctx, s.ID)
+			if err == errVersionConflict && ifVersion == anyVersion && attempt < maxUpdateAttempts {
+				continue
+			}
+			return store{}, store{}, err
+		}
+
+		// The version guard applied, so previous is the row it replaced
+		batch := r.session.newBatch(ctx, gocql.LoggedBatch)
+		addAreaQueries(batch, &previous, updated)
+		addGeohashIndexQueries(batch, &previous, updated)
+		addSearchIndexQueries(batch, &previous, updated)
+		return updated, previous, r.session.ExecuteBatch(batch)
+	}
+}
+
+func (r *cassandraStoreRepository) Delete(ctx context.Context, id int, ifVersion int64) (store, error) {
+	ctx = withOperation(ctx, opDelete)
+	var old store
+	for attempt := 1; ; attempt++ {
+		var err error
+		old, err = r.Get(ctx, id)
+		if err != nil {
+			return store{}, err
+		}
+		if ifVersion != anyVersion && old.Version != ifVersion {
+			return store{}, errVersionConflict
+		}
+
+		cond, condArgs := versionCondition(old.Version)
+		applied, err := r.session.query(ctx, "DELETE FROM stores WHERE id = ?"+cond, append([]interface{}{id}, condArgs...)...).
+			MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			return store{}, err
+		}
+		if applied {
+			break
+		}
+		err = r.lostVersionRace(ctx, id)
+		if err == errVersionConflict && ifVersion == anyVersion && attempt < maxUpdateAttempts {
+			continue
+		}
+		return store{}, err
+	}
+
+	batch := r.session.newBatch(ctx, gocql.LoggedBatch)
+	batch.Query("DELETE FROM stores_by_area WHERE area_id = ? AND id = ?", old.AreaID, id)
+
+	// Index maintenance against an empty store removes every old entry
+	addGeohashIndexQueries(batch, &old, store{ID: id})
+	addSearchIndexQueries(batch, &old, store{ID: id})
+
+	return old, r.session.ExecuteBatch(batch)
+}
+
+// versionCondition is the lightweight transaction condition matching a stored
+// version. Rows written before stores were versioned have none, read as 0.
+func versionCondition(version int64) (string, []interface{}) {
+	if version == 0 {
+		return " IF version = null", nil
+	}
+	return " IF version = ?", []interface{}{version}
+}
+
+// lostVersionRace explains a lightweight transaction that did not apply: the
+// store was either deleted or written by someone else since it was read
+func (r *cassandraStoreRepository) lostVersionRace(ctx context.Context, id int) error {
+	if _, err := r.Get(ctx, id); err != nil {
+		return err
+	}
+	return errVersionConflict
+}
+
+// Implement batch processing for writes
+func (r *cassandraStoreRepository) batchStoreInsert(ctx context.Context, stores []store) error {
+	// Load the rows being overwritten so stale index entries can be removed
+	previous, err := r.existingStores(ctx, stores)
+	if err != nil {
+		return err
+	}
+
+	batch := r.session.newBatch(ctx, gocql.LoggedBatch)
+
+	for _, s := range stores {
+		batch.Query(`INSERT INTO stores (id, area_id, name, location, latitude, longitude, version)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			s.ID, s.AreaID, s.Name, s.Location, s.Latitude, s.Longitude, nextVersion(0))
+
+		var old *store
+		if p, ok := previous[s.ID]; ok {
+			old = &p
+		}
+		addAreaQueries(batch, old, s)
+		addGeohashIndexQueries(batch, old, s)
+		addSearchIndexQueries(batch, old, s)
+	}
+
+	// Execute batch with consistency level
+	return r.session.ExecuteBatch(batch)
+}
+
+// addAreaQueries mirrors a store write into stores_by_area, removing the row
+// under its previous area when the store moved
+func addAreaQueries(batch *gocql.Batch, previous *store, s store) {
+	if previous != nil && previous.AreaID != s.AreaID {
+		batch.Query("DELETE FROM stores_by_area WHERE area_id = ? AND id = ?", previous.AreaID, s.ID)
+	}
+	batch.Query(`INSERT INTO stores_by_area (area_id, id, name, location, latitude, longitude)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		s.AreaID, s.ID, s.Name, s.Location, s.Latitude, s.Longitude)
+}
+
+// existingStores returns the currently stored rows for the given stores, keyed by ID
+func (r *cassandraStoreRepository) existingStores(ctx context.Context, stores []store) (map[int]store, error) {
+	ids := make([]int, 0, len(stores))
+	for _, s := range stores {
+		ids = append(ids, s.ID)
+	}
+
+	existing := make(map[int]store, len(ids))
+	found, err := r.fetchStores(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range found {
+		existing[s.ID] = s
+	}
+	return existing, nil
+}
+
+// fetchStores loads the stores with the given IDs
+func (r *cassandraStoreRepository) fetchStores(ctx context.Context, ids []int) ([]store, error) {
+	var stores []store
+	for start := 0; start < len(ids); start += fetchChunkSize {
+		end := min(start+fetchChunkSize, len(ids))
+
+		iter := r.session.query(ctx, "SELECT "+storeColumns+" FROM stores WHERE id IN ?", ids[start:end]).Iter()
+		var s store
+		for iter.Scan(s.scanTargets()...) {
+			stores = append(stores, s)
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return stores, nil
+}
+
+// storesInArea returns every store in an area, or every store when areaID is negative
+func (r *cassandraStoreRepository) storesInArea(ctx context.Context, areaID int) ([]store, error) {
+	var stores []store
+
+	query := "SELECT " + storeColumns + " FROM stores"
+	var args []interface{}
+	if areaID >= 0 {
+		query = r.areaQuery()
+		args = append(args, areaID)
+	}
+
+	iter := r.session.query(ctx, query, args...).Iter()
+	var s store
+	for iter.Scan(s.scanTargets()...) {
+		stores = append(stores, s)
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return stores, nil
+}
+
+// queryStorePage runs a stores query and reads a single page of rows starting
+// at the cursor's paging state
+func (r *cassandraStoreRepository) queryStorePage(ctx context.Context, query string, args []interface{}, pageSize int, cursor pageCursor) ([]store, pageCursor, error) {
+	iter := r.session.query(ctx, query, args...).PageSize(pageSize).PageState(cursor.State).Iter()
+	next := pageCursor{State: iter.PageState()}
+
+	stores := make([]store, 0, pageSize)
+	var s store
+	for iter.Scan(s.scanTargets()...) {
+		stores = append(stores, s)
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, pageCursor{}, err
+	}
+	return stores, next, nil
+}
+
+// lookupTerm returns the IDs of stores whose field has the given index term
+func (r *cassandraStoreRepository) lookupTerm(ctx context.Context, term, field string) (map[int]bool, error) {
+	ids := make(map[int]bool)
+	iter := r.session.query(ctx, "SELECT store_id FROM store_search_index WHERE term = ? AND field = ?",
+		term, field).Iter()
+
+	var id int
+	for iter.Scan(&id) {
+		ids[id] = true
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// storesInCells reads the geohash partitions concurrently and returns the
+// stores found in them, deduplicated by ID
+func (r *cassandraStoreRepository) storesInCells(ctx context.Context, cells []string) ([]store, error) {
+	found := make(map[int]store)
+	var firstErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, cell := range cells {
+		wg.Add(1)
+		go func(hash string) {
+			defer wg.Done()
+
+			var cellStores []store
+			iter := r.session.query(ctx, `SELECT store_id, area_id, name, location, latitude, longitude
+				FROM stores_by_geohash WHERE geohash = ?`, hash).Iter()
+			var s store
+			for iter.Scan(s.scanTargets()...) {
+				cellStores = append(cellStores, s)
+			}
+			err := iter.Close()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			for _, s := range cellStores {
+				found[s.ID] = s
+			}
+		}(cell)
+	}
+
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	stores := make([]store, 0, len(found))
+	for _, s := range found {
+		stores = append(stores, s)
+	}
+	sort.Slice(stores, func(i, j int) bool { return stores[i].ID < stores[j].ID })
+	return stores, nil
+}
+
+// cassandraAreaRepository stores areas in the areas table with their boundary as GeoJSON text
+type cassandraAreaRepository struct {
+	session consistencySession
+}
+
+func newCassandraAreaRepository(session *gocql.Session, policy consistencyPolicy) *cassandraAreaRepository {
+	return &cassandraAreaRepository{session: consistencySession{Session: session, policy: policy}}
+}
+
+func (r *cassandraAreaRepository) List(ctx context.Context) ([]area, error) {
+	ctx = withOperation(ctx, opList)
+	var areas []area
+	iter := r.session.query(ctx, "SELECT id, name, boundary FROM areas").Iter()
+
+	var id int
+	var name, boundary string
+	for iter.Scan(&id, &name, &boundary) {
+		areas = append(areas, area{ID: id, Name: name, Boundary: json.RawMessage(boundary)})
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return areas, nil
+}
+
+func (r *cassandraAreaRepository) Get(ctx context.Context, id int) (area, error) {
+	ctx = withOperation(ctx, opGet)
+	var a area
+	var boundary string
+	err := r.session.query(ctx, "SELECT id, name, boundary FROM areas WHERE id = ?", id).Scan(&a.ID, &a.Name, &boundary)
+	if err == gocql.ErrNotFound {
+		return area{}, errAreaNotFound
+	}
+	if err != nil {
+		return area{}, err
+	}
+	a.Boundary = json.RawMessage(boundary)
+	return a, nil
+}
+
+func (r *cassandraAreaRepository) Create(ctx context.Context, a area) error {
+	ctx = withOperation(ctx, opCreate)
+	applied, err := r.session.query(ctx, "INSERT INTO areas (id, name, boundary) VALUES (?, ?, ?) IF NOT EXISTS",
+		a.ID, a.Name, string(a.Boundary)).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return errAreaExists
+	}
+	return nil
+}
+
+func (r *cassandraAreaRepository) Save(ctx context.Context, a area) error {
+	ctx = withOperation(ctx, opUpdate)
+	return r.session.query(ctx, "INSERT INTO areas (id, name, boundary) VALUES (?, ?, ?)",
+		a.ID, a.Name, string(a.Boundary)).Exec()
+}
+
+func (r *cassandraAreaRepository) Delete(ctx context.Context, id int) error {
+	ctx = withOperation(ctx, opDelete)
+	return r.session.query(ctx, "DELETE FROM areas WHERE id = ?", id).Exec()
+}
+
+// cassandraSeedRepository stores seed records in the seed_keys table
+type cassandraSeedRepository struct {
+	session consistencySession
+}
+
+func newCassandraSeedRepository(session *gocql.Session, policy consistencyPolicy) *cassandraSeedRepository {
+	return &cassandraSeedRepository{session: consistencySession{Session: session, policy: policy}}
+}
+
+func (r *cassandraSeedRepository) Get(ctx context.Context, key string) (seedRecord, error) {
+	ctx = withOperation(ctx, opGet)
+	var rec seedRecord
+	err := r.session.query(ctx, "SELECT key, store_id, fixture, checksum, seeded_at FROM seed_keys WHERE key = ?", key).
+		Scan(&rec.Key, &rec.StoreID, &rec.Fixture, &rec.Checksum, &rec.SeededAt)
+	if err == gocql.ErrNotFound {
+		return seedRecord{}, errSeedNotFound
+	}
+	return rec, err
+}
+
+func (r *cassandraSeedRepository) Claim(ctx context.Context, key string, id int) (int, error) {
+	ctx = withOperation(ctx, opCreate)
+	existing := map[string]interface{}{}
+	applied, err := r.session.query(ctx, "INSERT INTO seed_keys (key, store_id) VALUES (?, ?) IF NOT EXISTS",
+		key, id).MapScanCAS(existing)
+	if err != nil {
+		return 0, err
+	}
+	if !applied {
+		held, _ := existing["store_id"].(int)
+		return held, nil
+	}
+	return id, nil
+}
+
+func (r *cassandraSeedRepository) Save(ctx context.Context, rec seedRecord) error {
+	ctx = withOperation(ctx, opUpdate)
+	return r.session.query(ctx, "UPDATE seed_keys SET fixture = ?, checksum = ?, seeded_at = ? WHERE key = ?",
+		rec.Fixture, rec.Checksum, rec.SeededAt, rec.Key).Exec()
+}
+
+// cassandraIdempotencyRepository stores idempotency records in the
+// idempotency_keys table, letting Cassandra expire them. Every write is a
+// lightweight transaction, so concurrent retries cannot both claim a key.
+type cassandraIdempotencyRepository struct {
+	session consistencySession
+	ttl     time.Duration
+}
+
+func newCassandraIdempotencyRepository(session *gocql.Session, policy consistencyPolicy, ttl time.Duration) *cassandraIdempotencyRepository {
+	return &cassandraIdempotencyRepository{session: consistencySession{Session: session, policy: policy}, ttl: ttl}
+}
+
+func (r *cassandraIdempotencyRepository) Claim(ctx context.Context, rec idempotencyRecord) (idempotencyRecord, bool, error) {
+	ctx = withOperation(ctx, opCreate)
+	existing := map[string]interface{}{}
+	applied, err := r.session.query(ctx, `INSERT INTO idempotency_keys (key, claim, status)
+		VALUES (?, ?, 0) IF NOT EXISTS USING TTL ?`,
+		rec.Key, rec.Claim, int(idempotencyClaimTTL.Seconds())).MapScanCAS(existing)
+	if err != nil || applied {
+		return rec, applied, err
+	}
+
+	held := idempotencyRecord{Key: rec.Key}
+	held.Claim, _ = existing["claim"].(string)
+	held.RequestHash, _ = existing["request_hash"].(string)
+	held.Status, _ = existing["status"].(int)
+	held.ContentType, _ = existing["content_type"].(string)
+	held.Location, _ = existing["location"].(string)
+	held.Body, _ = existing["body"].([]byte)
+	return held, false, nil
+}
+
+// Renew rewrites the claim's columns, which restarts their TTL
+func (r *cassandraIdempotencyRepository) Renew(ctx context.Context, rec idempotencyRecord) (bool, error) {
+	ctx = withOperation(ctx, opUpdate)
+	return r.session.query(ctx, `UPDATE idempotency_keys USING TTL ?
+		SET claim = ?, status = 0 WHERE key = ? IF claim = ?`,
+		int(idempotencyClaimTTL.Seconds()), rec.Claim, rec.Key, rec.Claim).MapScanCAS(map[string]interface{}{})
+}
+
+// Complete rewrites every column, since the claim's columns expire sooner
+func (r *cassandraIdempotencyRepository) Complete(ctx context.Context, rec idempotencyRecord) error {
+	ctx = withOperation(ctx, opUpdate)
+	applied, err := r.session.query(ctx, `UPDATE idempotency_keys USING TTL ?
+		SET claim = ?, request_hash = ?, status = ?, content_type = ?, location = ?, body = ?
+		WHERE key = ? IF claim = ?`,
+		int(r.ttl.Seconds()), rec.Claim, rec.RequestHash, rec.Status, rec.ContentType, rec.Location, rec.Body,
+		rec.Key, rec.Claim).MapScanCAS(map[string]interface{}{})
+	if err == nil && !applied {
+		return errClaimLost
+	}
+	return err
+}
+
+func (r *cassandraIdempotencyRepository) Release(ctx context.Context, rec idempotencyRecord) error {
+	ctx = withOperation(ctx, opDelete)
+	_, err := r.session.query(ctx, "DELETE FROM idempotency_keys WHERE key = ? IF claim = ?",
+		rec.Key, rec.Claim).MapScanCAS(map[string]interface{}{})
+	return err
+}
+
+// cassandraLegacyIDRepository stores the UUID mappings in legacy_store_ids,
+// claimed with a lightweight transaction, and their reverse in
+// legacy_store_uuids
+type cassandraLegacyIDRepository struct {
+	session consistencySession
+}
+
+func newCassandraLegacyIDRepository(session *gocql.Session, policy consistencyPolicy) *cassandraLegacyIDRepository {
+	return &cassandraLegacyIDRepository{session: consistencySession{Session: session, policy: policy}}
+}
+
+func (r *cassandraLegacyIDRepository) Get(ctx context.Context, uuid string) (int, error) {
+	ctx = withOperation(ctx, opGet)
+	var id int
+	err := r.session.query(ctx, "SELECT store_id FROM legacy_store_ids WHERE uuid = ?", uuid).Scan(&id)
+	if err == gocql.ErrNotFound {
+		return 0, errUUIDNotFound
+	}
+	return id, err
+}
+
+func (r *cassandraLegacyIDRepository) UUIDs(ctx context.Context, ids []int) (map[int]string, error) {
+	ctx = withOperation(ctx, opList)
+	uuids := make(map[int]string)
+	for start := 0; start < len(ids); start += fetchChunkSize {
+		end := min(start+fetchChunkSize, len(ids))
+
+		iter := r.session.query(ctx, "SELECT store_id, uuid FROM legacy_store_uuids WHERE store_id IN ?", ids[start:end]).Iter()
+		var id int
+		var uuid string
+		for iter.Scan(&id, &uuid) {
+			uuids[id] = uuid
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return uuids, nil
+}
+
+func (r *cassandraLegacyIDRepository) Claim(ctx context.Context, uuid string, id int) (int, error) {
+	ctx = withOperation(ctx, opCreate)
+	existing := map[string]interface{}{}
+	applied, err := r.session.query(ctx, "INSERT INTO legacy_store_ids (uuid, store_id) VALUES (?, ?) IF NOT EXISTS",
+		uuid, id).MapScanCAS(existing)
+	if err != nil {
+		return 0, err
+	}
+	if !applied {
+		held, _ := existing["store_id"].(int)
+		return held, nil
+	}
+	return id, r.session.query(ctx, "INSERT INTO legacy_store_uuids (store_id, uuid) VALUES (?, ?)", id, uuid).Exec()
+}
+
+func (r *cassandraLegacyIDRepository) Delete(ctx context.Context, uuid string) error {
+	id, err := r.Get(ctx, uuid)
+	if errors.Is(err, errUUIDNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx = withOperation(ctx, opDelete)
+	batch := r.session.newBatch(ctx, gocql.LoggedBatch)
+	batch.Query("DELETE FROM legacy_store_uuids WHERE store_id = ?", id)
+	batch.Query("DELETE FROM legacy_store_ids WHERE uuid = ?", uuid)
+	return r.session.ExecuteBatch(batch)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// command is a subcommand of the binary
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "", "run the HTTP API (the default)", runServe},
+		{"migrate", "up [version] | down [steps] | status", "manage the schema", runMigrate},
+		{"seed", "", "upsert the fixture stores of an environment", runSeed},
+		{"import", "FILE|-", "import stores from CSV or NDJSON", runImport},
+		{"export", "", "export every store as CSV or NDJSON", runExport},
+		{"get", "ID", "print a store", runGet},
+		{"search", "", "search stores by area, name and location", runSearch},
+		{"delete", "ID...", "delete stores", runDelete},
+		{"help", "", "show this help", func([]string) error { printUsage(os.Stdout); return nil }},
+	}
+}
+
+// runCommand dispatches to the subcommand named by the first argument. Without
+// one, or when the first argument is a flag, the server is started.
+func runCommand(args []string) error {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(args)
+		}
+	}
+	printUsage(os.Stderr)
+	return fmt.Errorf("unknown command %q", name)
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags] [args]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "\nEvery command accepts the configuration flags; run \"<command> -h\" to list them.")
+}
+
+// newFlagSet returns the flag set of a subcommand with its usage line
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] %s\n", filepath.Base(os.Args[0]), name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// withRepositories loads the configuration, opens the storage backend and
+// runs fn with the arguments left after the flags. Only the server and the
+// migrate command change the schema, so a schema that is not up to date is
+// refused rather than migrated.
+func withRepositories(fs *flag.FlagSet, args []string, fn func(ctx context.Context, args []string) error) error {
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	closeRepositories, err := openRepositories(cfg, false)
+	if err != nil {
+		return err
+	}
+	defer closeRepositories()
+
+	return fn(context.Background(), fs.Args())
+}
+
+func runMigrate(args []string) error {
+	fs := newFlagSet("migrate", "up [version] | down [steps] | status")
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	return runMigrateCommand(cfg.Cassandra, fs.Args())
+}
+
+func runSeed(args []string) error {
+	fs := newFlagSet("seed", "")
+	env := fs.String("env", "development", "environment whose embedded fixture is seeded")
+	file := fs.String("file", "", "seed this fixture file instead of the environment's")
+	dryRun := fs.Bool("dry-run", false, "report what would change without writing")
+	force := fs.Bool("force", false, "overwrite stores edited since they were seeded")
+	return withRepositories(fs, args, func(ctx context.Context, _ []string) error {
+		name, f, err := loadFixture(*env, *file)
+		if err != nil {
+			return err
+		}
+		summary, err := seedStores(ctx, name, f, *dryRun, *force)
+		if printErr := printJSON(summary); printErr != nil {
+			return printErr
+		}
+		return err
+	})
+}
+
+func runImport(args []string) error {
+	fs := newFlagSet("import", "FILE|-")
+	format := fs.String("format", "", "csv or ndjson; defaults to the file extension")
+	mapping := fs.String("map", "", "CSV header mapping as header:field pairs")
+	dryRun := fs.Bool("dry-run", false, "report what would change without writing")
+	return withRepositories(fs, args, func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			fs.Usage()
+			return errors.New("import needs one file, or - for standard input")
+		}
+
+		in := io.Reader(os.Stdin)
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+			if *format == "" {
+				*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(args[0])), ".")
+			}
+		}
+
+		var records recordReader
+		switch *format {
+		case "csv":
+			r, err := newCSVRecordReader(in, *mapping)
+			if err != nil {
+				return err
+			}
+			records = r
+		case "ndjson", "jsonl":
+			records = newNDJSONRecordReader(in)
+		default:
+			return errors.New("set -format to csv or ndjson")
+		}
+
+		summary, err := importStores(ctx, records, *dryRun)
+		if printErr := printJSON(summary); printErr != nil {
+			return printErr
+		}
+		if err != nil {
+			return err
+		}
+		if summary.Invalid+summary.Failed > 0 {
+			return fmt.Errorf("%d records were not imported", summary.Invalid+summary.Failed)
+		}
+		return nil
+	})
+}
+
+func runExport(args []string) error {
+	fs := newFlagSet("export", "")
+	format := fs.String("format", "ndjson", "csv or ndjson")
+	output := fs.String("o", "-", "output file, - for standard output")
+	return withRepositories(fs, args, func(ctx context.Context, _ []string) error {
+		// Checked before the output file is created, so a typo keeps it intact
+		if _, ok := exportContentTypes[*format]; !ok {
+			return errors.New("format must be csv or ndjson")
+		}
+		stores, next, err := storeRepo.List(ctx, maxPageSize, pageCursor{})
+		if err != nil {
+			return err
+		}
+
+		w := io.Writer(os.Stdout)
+		if *output != "-" {
+			f, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+
+		out, err := newStoreWriter(*format, w)
+		if err != nil {
+			return err
+		}
+		return copyStores(ctx, out, stores, next, nil)
+	})
+}
+
+func runGet(args []string) error {
+	fs := newFlagSet("get", "ID")
+	return withRepositories(fs, args, func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			fs.Usage()
+			return errors.New("get needs one store ID")
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid store ID %q", args[0])
+		}
+
+		s, err := storeRepo.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		return printJSON(s)
+	})
+}
+
+func runSearch(args []string) error {
+	fs := newFlagSet("search", "")
+	areaID := fs.Int("area", -1, "only stores in this area")
+	name := fs.String("name", "", "words of the store name")
+	location := fs.String("location", "", "words of the store location")
+	fuzzy := fs.Int("fuzzy", 0, "typos tolerated per word, up to "+strconv.Itoa(maxFuzzyDistance))
+	return withRepositories(fs, args, func(ctx context.Context, _ []string) error {
+		if *fuzzy < 0 || *fuzzy > maxFuzzyDistance {
+			return fmt.Errorf("fuzzy must be between 0 and %d", maxFuzzyDistance)
+		}
+
+		results, err := storeRepo.Search(ctx, searchCriteria{AreaID: *areaID, Name: *name, Location: *location, Fuzzy: *fuzzy})
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tAREA\tNAME\tLOCATION\tRELEVANCE")
+		for _, r := range results {
+			fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%.2f\n", r.ID, r.AreaID, r.Name, r.Location, r.Relevance)
+		}
+		return tw.Flush()
+	})
+}
+
+func runDelete(args []string) error {
+	fs := newFlagSet("delete", "ID...")
+	return withRepositories(fs, args, func(ctx context.Context, args []string) error {
+		if len(args) == 0 {
+			fs.Usage()
+			return errors.New("delete needs at least one store ID")
+		}
+
+		failed := 0
+		for _, arg := range args {
+			id, err := strconv.Atoi(arg)
+			if err == nil {
+				_, err = storeRepo.Delete(ctx, id, anyVersion)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", arg, err)
+				failed++
+				continue
+			}
+			fmt.Printf("Deleted store %d\n", id)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d deletes failed", failed, len(args))
+		}
+		return nil
+	})
+}
+
+// printJSON writes v to standard output as indented JSON
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	ndjson := writeConfigFile(t, "stores.ndjson", "{\"id\":1,\"name\":\"A\",\"areaId\":1}\n")
+	unknownExt := writeConfigFile(t, "stores.txt", "id\n1\n")
+	exported := filepath.Join(t.TempDir(), "stores.csv")
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"unknown command", []string{"frobnicate"}, `unknown command "frobnicate"`},
+		{"unknown flag", []string{"get", "-backend", "memory", "-nope"}, "flag provided but not defined"},
+		{"get without an id", []string{"get", "-backend", "memory"}, "get needs one store ID"},
+		{"get with a bad id", []string{"get", "-backend", "memory", "x"}, `invalid store ID "x"`},
+		{"get a missing store", []string{"get", "-backend", "memory", "1"}, "store not found"},
+		{"delete without ids", []string{"delete", "-backend", "memory"}, "delete needs at least one store ID"},
+		{"delete missing stores", []string{"delete", "-backend", "memory", "1", "x"}, "2 of 2 deletes failed"},
+		{"search with too many typos", []string{"search", "-backend", "memory", "-fuzzy", "9"}, "fuzzy must be between"},
+		{"search", []string{"search", "-backend", "memory", "-name", "cafe"}, ""},
+		{"import without a file", []string{"import", "-backend", "memory"}, "import needs one file"},
+		{"import an unknown extension", []string{"import", "-backend", "memory", unknownExt}, "set -format to csv or ndjson"},
+		{"import a missing file", []string{"import", "-backend", "memory", "/nonexistent/stores.csv"}, "no such file"},
+		{"import reports unimported records", []string{"import", "-backend", "memory", "-dry-run", ndjson}, "1 records were not imported"},
+		{"export to a file", []string{"export", "-backend", "memory", "-format", "csv", "-o", exported}, ""},
+		{"export in an unknown format", []string{"export", "-backend", "memory", "-format", "xml", "-o", exported}, "format must be csv or ndjson"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMemoryRepositories(t)
+			clearSettingsEnv(t)
+			err := runCommand(tt.args)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+
+	data, err := os.ReadFile(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(data)); got != strings.Join(csvColumns, ",") {
+		t.Errorf("export of an empty repository wrote %q", got)
+	}
+}
+
+func TestPrintUsage(t *testing.T) {
+	var buf bytes.Buffer
+	printUsage(&buf)
+	for _, cmd := range commands {
+		if !strings.Contains(buf.String(), "  "+cmd.name+" ") {
+			t.Errorf("usage does not list %s:\n%s", cmd.name, buf.String())
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// config holds every runtime setting. It is resolved in layers: defaults, then
+// the YAML or TOML file named by -config or STORE_CONFIG, then environment
+// variables, then command-line flags.
+type config struct {
+	// Backend selects the storage, "cassandra" or "memory"
+	Backend   string          `yaml:"backend" toml:"backend"`
+	Server    serverConfig    `yaml:"server" toml:"server"`
+	Cassandra cassandraConfig `yaml:"cassandra" toml:"cassandra"`
+}
+
+type serverConfig struct {
+	ListenAddr   string   `yaml:"listen_addr" toml:"listen_addr"`
+	ReadTimeout  duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout duration `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout  duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	// TrustedNetworks are the client addresses or CIDR blocks allowed to
+	// request a stronger read consistency
+	TrustedNetworks []string `yaml:"trusted_networks" toml:"trusted_networks"`
+	// IdempotencyTTL is how long the response to a request sent with an
+	// Idempotency-Key is replayed to retries
+	IdempotencyTTL duration `yaml:"idempotency_ttl" toml:"idempotency_ttl"`
+	// CursorSecret signs pagination cursors. Every instance serving the same
+	// clients must share it; without one each instance signs with its own.
+	CursorSecret string `yaml:"cursor_secret" toml:"cursor_secret"`
+}
+
+type cassandraConfig struct {
+	// ContactPoints are the hosts to connect to. When empty the first
+	// non-loopback address of this machine is used.
+	ContactPoints []string `yaml:"contact_points" toml:"contact_points"`
+	Port          int      `yaml:"port" toml:"port"`
+	Username      string   `yaml:"username" toml:"username"`
+	Password      string   `yaml:"password" toml:"password"`
+	Keyspace      string   `yaml:"keyspace" toml:"keyspace"`
+	// LocalDC routes queries to one datacenter first when set
+	LocalDC           string            `yaml:"local_dc" toml:"local_dc"`
+	Replication       replicationConfig `yaml:"replication" toml:"replication"`
+	Consistency       string            `yaml:"consistency" toml:"consistency"`
+	SerialConsistency string            `yaml:"serial_consistency" toml:"serial_consistency"`
+	// ReadConsistency and WriteConsistency default to Consistency
+	ReadConsistency  string `yaml:"read_consistency" toml:"read_consistency"`
+	WriteConsistency string `yaml:"write_consistency" toml:"write_consistency"`
+	// OperationConsistency overrides the level of single operations: get,
+	// list, search, within, create, update or delete
+	OperationConsistency map[string]string `yaml:"operation_consistency" toml:"operation_consistency"`
+	ConnectTimeout       duration          `yaml:"connect_timeout" toml:"connect_timeout"`
+	Timeout              duration          `yaml:"timeout" toml:"timeout"`
+}
+
+// replicationConfig is the replication of the keyspace when it is created.
+// SimpleStrategy uses Factor; NetworkTopologyStrategy uses Datacenters.
+type replicationConfig struct {
+	Strategy    string         `yaml:"strategy" toml:"strategy"`
+	Factor      int            `yaml:"factor" toml:"factor"`
+	Datacenters map[string]int `yaml:"datacenters" toml:"datacenters"`
+}
+
+// duration is a time.Duration written as "10s" or "1m30s" in config files
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// defaultConfig matches the settings the server used before it was configurable
+func defaultConfig() config {
+	return config{
+		Backend: "cassandra",
+		Server: serverConfig{
+			ListenAddr:     ":8080",
+			ReadTimeout:    duration(15 * time.Second),
+			WriteTimeout:   duration(30 * time.Second),
+			IdleTimeout:    duration(60 * time.Second),
+			IdempotencyTTL: duration(24 * time.Hour),
+		},
+		Cassandra: cassandraConfig{
+			Port:     9042,
+			Username: "cassandra",
+			Password: "cassandra",
+			Keyspace: "store_management",
+			Replication: replicationConfig{
+				Strategy: "SimpleStrategy",
+				Factor:   1,
+			},
+			Consistency:       "QUORUM",
+			SerialConsistency: "SERIAL",
+			ConnectTimeout:    duration(10 * time.Second),
+			Timeout:           duration(10 * time.Second),
+		},
+	}
+}
+
+// setting is a value that can be overridden by an environment variable and a flag
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(cfg *config, value string) error
+}
+
+var settings = []setting{
+	{"backend", "STORE_BACKEND", "storage backend, cassandra or memory", func(cfg *config, v string) error {
+		cfg.Backend = v
+		return nil
+	}},
+	{"listen", "STORE_LISTEN_ADDR", "address the HTTP server listens on", func(cfg *config, v string) error {
+		cfg.Server.ListenAddr = v
+		return nil
+	}},
+	{"read-timeout", "STORE_READ_TIMEOUT", "HTTP read timeout", func(cfg *config, v string) error {
+		return cfg.Server.ReadTimeout.UnmarshalText([]byte(v))
+	}},
+	{"write-timeout", "STORE_WRITE_TIMEOUT", "HTTP write timeout", func(cfg *config, v string) error {
+		return cfg.Server.WriteTimeout.UnmarshalText([]byte(v))
+	}},
+	{"idle-timeout", "STORE_IDLE_TIMEOUT", "HTTP keep-alive idle timeout", func(cfg *config, v string) error {
+		return cfg.Server.IdleTimeout.UnmarshalText([]byte(v))
+	}},
+	{"trusted-networks", "STORE_TRUSTED_NETWORKS", "comma-separated clients allowed to request stronger reads", func(cfg *config, v string) error {
+		cfg.Server.TrustedNetworks = splitList(v)
+		return nil
+	}},
+	{"idempotency-ttl", "STORE_IDEMPOTENCY_TTL", "how long responses to Idempotency-Key requests are replayed", func(cfg *config, v string) error {
+		return cfg.Server.IdempotencyTTL.UnmarshalText([]byte(v))
+	}},
+	{"cursor-secret", "STORE_CURSOR_SECRET", "key signing pagination cursors, shared by every instance", func(cfg *config, v string) error {
+		cfg.Server.CursorSecret = v
+		return nil
+	}},
+	{"cassandra-hosts", "STORE_CASSANDRA_HOSTS", "comma-separated Cassandra contact points", func(cfg *config, v string) error {
+		cfg.Cassandra.ContactPoints = splitList(v)
+		return nil
+	}},
+	{"cassandra-port", "STORE_CASSANDRA_PORT", "Cassandra native protocol port", func(cfg *config, v string) error {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		cfg.Cassandra.Port = port
+		return nil
+	}},
+	{"cassandra-username", "STORE_CASSANDRA_USERNAME", "Cassandra username", func(cfg *config, v string) error {
+		cfg.Cassandra.Username = v
+		return nil
+	}},
+	{"cassandra-password", "STORE_CASSANDRA_PASSWORD", "Cassandra password", func(cfg *config, v string) error {
+		cfg.Cassandra.Password = v
+		return nil
+	}},
+	{"cassandra-keyspace", "STORE_CASSANDRA_KEYSPACE", "Cassandra keyspace", func(cfg *config, v string) error {
+		cfg.Cassandra.Keyspace = v
+		return nil
+	}},
+	{"cassandra-local-dc", "STORE_CASSANDRA_LOCAL_DC", "datacenter to route queries to first", func(cfg *config, v string) error {
+		cfg.Cassandra.LocalDC = v
+		return nil
+	}},
+	{"cassandra-replication", "STORE_CASSANDRA_REPLICATION",
+		`keyspace replication, "SimpleStrategy:3" or "dc1:3,dc2:2" for NetworkTopologyStrategy`,
+		func(cfg *config, v string) error {
+			r, err := parseReplication(v)
+			if err != nil {
+				return err
+			}
+			cfg.Cassandra.Replication = r
+			return nil
+		}},
+	{"cassandra-consistency", "STORE_CASSANDRA_CONSISTENCY", "default consistency level", func(cfg *config, v string) error {
+		cfg.Cassandra.Consistency = v
+		return nil
+	}},
+	{"cassandra-read-consistency", "STORE_CASSANDRA_READ_CONSISTENCY", "consistency level of reads", func(cfg *config, v string) error {
+		cfg.Cassandra.ReadConsistency = v
+		return nil
+	}},
+	{"cassandra-write-consistency", "STORE_CASSANDRA_WRITE_CONSISTENCY", "consistency level of writes", func(cfg *config, v string) error {
+		cfg.Cassandra.WriteConsistency = v
+		return nil
+	}},
+	{"cassandra-serial-consistency", "STORE_CASSANDRA_SERIAL_CONSISTENCY", "consistency of lightweight transactions", func(cfg *config, v string) error {
+		cfg.Cassandra.SerialConsistency = v
+		return nil
+	}},
+	{"cassandra-connect-timeout", "STORE_CASSANDRA_CONNECT_TIMEOUT", "Cassandra connect timeout", func(cfg *config, v string) error {
+		return cfg.Cassandra.ConnectTimeout.UnmarshalText([]byte(v))
+	}},
+	{"cassandra-timeout", "STORE_CASSANDRA_TIMEOUT", "Cassandra query timeout", func(cfg *config, v string) error {
+		return cfg.Cassandra.Timeout.UnmarshalText([]byte(v))
+	}},
+}
+
+// splitList splits a comma-separated value, dropping blanks
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseReplication reads "SimpleStrategy:N" or a "dc:N,dc:N" list
+func parseReplication(v string) (replicationConfig, error) {
+	if factor, ok := strings.CutPrefix(v, "SimpleStrategy:"); ok {
+		n, err := strconv.Atoi(factor)
+		if err != nil {
+			return replicationConfig{}, errors.New("replication factor must be a number")
+		}
+		return replicationConfig{Strategy: "SimpleStrategy", Factor: n}, nil
+	}
+
+	r := replicationConfig{Strategy: "NetworkTopologyStrategy", Datacenters: make(map[string]int)}
+	for _, item := range splitList(v) {
+		dc, factor, ok := strings.Cut(item, ":")
+		n, err := strconv.Atoi(factor)
+		if !ok || err != nil {
+			return replicationConfig{}, fmt.Errorf("expected dc:factor, got %q", item)
+		}
+		r.Datacenters[strings.TrimSpace(dc)] = n
+	}
+	return r, nil
+}
+
+// loadConfig resolves the configuration from defaults, the config file, the
+// environment and the flags in args. The configuration flags are added to fs,
+// which may define flags of its own; fs.Args() holds what is left after parsing.
+func loadConfig(fs *flag.FlagSet, args []string) (config, error) {
+	configPath := fs.String("config", os.Getenv("STORE_CONFIG"), "YAML or TOML config file")
+	flagValues := make(map[string]string)
+	for _, s := range settings {
+		flagName := s.flag
+		fs.Func(flagName, s.usage+" (env "+s.env+")", func(v string) error {
+			flagValues[flagName] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+
+	cfg := defaultConfig()
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return config{}, err
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := s.set(&cfg, v); err != nil {
+				return config{}, fmt.Errorf("%s: %v", s.env, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, ok := flagValues[s.flag]; ok {
+			if err := s.set(&cfg, v); err != nil {
+				return config{}, fmt.Errorf("-%s: %v", s.flag, err)
+			}
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return config{}, err
+	}
+	return cfg, nil
+}
+
+// loadFile overlays the settings of a YAML or TOML file, chosen by extension
+func (cfg *config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	case ".toml":
+		err = toml.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("config file %s: unsupported extension %q, use .yaml, .yml or .toml", path, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	return nil
+}
+
+var (
+	keyspaceName   = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,47}$`)
+	datacenterName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// validate reports every invalid setting at once
+func (cfg config) validate() error {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if cfg.Backend != "cassandra" && cfg.Backend != "memory" {
+		invalid("backend must be cassandra or memory, got %q", cfg.Backend)
+	}
+	if cfg.Server.ListenAddr == "" {
+		invalid("server.listen_addr is required")
+	}
+	if _, err := parseNetworks(cfg.Server.TrustedNetworks); err != nil {
+		invalid("server.trusted_networks: %v", err)
+	}
+	for name, d := range map[string]duration{
+		"server.read_timeout":       cfg.Server.ReadTimeout,
+		"server.write_timeout":      cfg.Server.WriteTimeout,
+		"server.idle_timeout":       cfg.Server.IdleTimeout,
+		"server.idempotency_ttl":    cfg.Server.IdempotencyTTL,
+		"cassandra.connect_timeout": cfg.Cassandra.ConnectTimeout,
+		"cassandra.timeout":         cfg.Cassandra.Timeout,
+	} {
+		if d <= 0 {
+			invalid("%s must be positive", name)
+		}
+	}
+
+	c := cfg.Cassandra
+	if c.Port < 1 || c.Port > 65535 {
+		invalid("cassandra.port must be between 1 and 65535, got %d", c.Port)
+	}
+	if !keyspaceName.MatchString(c.Keyspace) {
+		invalid("cassandra.keyspace %q must start with a letter and contain only letters, digits and underscores", c.Keyspace)
+	}
+	if _, err := newConsistencyPolicy(c); err != nil {
+		invalid("%v", err)
+	}
+	if _, err := c.serialConsistency(); err != nil {
+		invalid("cassandra.serial_consistency: %v", err)
+	}
+
+	switch r := c.Replication; r.Strategy {
+	case "SimpleStrategy":
+		if r.Factor < 1 {
+			invalid("cassandra.replication.factor must be at least 1")
+		}
+	case "NetworkTopologyStrategy":
+		if len(r.Datacenters) == 0 {
+			invalid("cassandra.replication.datacenters needs at least one datacenter")
+		}
+		for dc, n := range r.Datacenters {
+			if !datacenterName.MatchString(dc) {
+				invalid("cassandra.replication.datacenters: invalid datacenter name %q", dc)
+			}
+			if n < 1 {
+				invalid("cassandra.replication.datacenters.%s must be at least 1", dc)
+			}
+		}
+		if c.LocalDC != "" {
+			if _, ok := r.Datacenters[c.LocalDC]; !ok {
+				invalid("cassandra.local_dc %q is not one of the replication datacenters", c.LocalDC)
+			}
+		}
+	default:
+		invalid("cassandra.replication.strategy must be SimpleStrategy or NetworkTopologyStrategy, got %q", r.Strategy)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// serialConsistency parses the consistency used by lightweight transactions
+func (c cassandraConfig) serialConsistency() (gocql.SerialConsistency, error) {
+	var s gocql.SerialConsistency
+	err := s.UnmarshalText([]byte(strings.ToUpper(c.SerialConsistency)))
+	return s, err
+}
+
+// replicationCQL renders the replication map of CREATE KEYSPACE
+func (r replicationConfig) replicationCQL() string {
+	if r.Strategy == "SimpleStrategy" {
+		return fmt.Sprintf("{'class': 'SimpleStrategy', 'replication_factor': %d}", r.Factor)
+	}
+
+	dcs := make([]string, 0, len(r.Datacenters))
+	for dc := range r.Datacenters {
+		dcs = append(dcs, dc)
+	}
+	sort.Strings(dcs)
+
+	parts := []string{"'class': 'NetworkTopologyStrategy'"}
+	for _, dc := range dcs {
+		parts = append(parts, fmt.Sprintf("'%s': %d", dc, r.Datacenters[dc]))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// contactPoints returns the configured hosts or, when none are set, this
+// machine's first non-loopback address
+func (c cassandraConfig) contactPoints() []string {
+	if len(c.ContactPoints) > 0 {
+		return c.ContactPoints
+	}
+	return []string{getHostIP()}
+}
+
+// newCluster builds a gocql cluster configuration for the given keyspace,
+// which is empty for the connection that creates the keyspace
+func (c cassandraConfig) newCluster(keyspace string) *gocql.ClusterConfig {
+	cluster := gocql.NewCluster(c.contactPoints()...)
+	cluster.Keyspace = keyspace
+	cluster.Port = c.Port
+	cluster.Authenticator = gocql.PasswordAuthenticator{
+		Username: c.Username,
+		Password: c.Password,
+	}
+	// validate has already checked both levels
+	cluster.Consistency, _ = gocql.ParseConsistencyWrapper(c.Consistency)
+	cluster.SerialConsistency, _ = c.serialConsistency()
+	cluster.ConnectTimeout = time.Duration(c.ConnectTimeout)
+	cluster.Timeout = time.Duration(c.Timeout)
+	if c.LocalDC != "" {
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.DCAwareRoundRobinPolicy(c.LocalDC))
+	}
+	return cluster
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearSettingsEnv blanks every setting's environment variable for the
+// test; loadConfig ignores blank values
+func clearSettingsEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("STORE_CONFIG", "")
+	for _, s := range settings {
+		t.Setenv(s.env, "")
+	}
+}
+
+func quietFlagSet() *flag.FlagSet {
+	fs := newFlagSet("test", "")
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	yamlFile := writeConfigFile(t, "store.yaml", `
+server:
+  listen_addr: ":9000"
+  idle_timeout: 2m
+cassandra:
+  keyspace: from_file
+  port: 9142
+`)
+	tomlFile := writeConfigFile(t, "store.toml", `
+[server]
+listen_addr = ":9001"
+[cassandra]
+keyspace = "from_toml"
+`)
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(t *testing.T, cfg config)
+	}{
+		{"defaults", nil, nil, func(t *testing.T, cfg config) {
+			if cfg.Server.ListenAddr != ":8080" || cfg.Cassandra.Keyspace != "store_management" || cfg.Backend != "cassandra" {
+				t.Errorf("got %+v", cfg)
+			}
+		}},
+		{"yaml file", nil, []string{"-config", yamlFile}, func(t *testing.T, cfg config) {
+			if cfg.Server.ListenAddr != ":9000" || cfg.Cassandra.Keyspace != "from_file" || cfg.Cassandra.Port != 9142 {
+				t.Errorf("got %+v", cfg)
+			}
+			if time.Duration(cfg.Server.IdleTimeout) != 2*time.Minute {
+				t.Errorf("idle timeout %v", time.Duration(cfg.Server.IdleTimeout))
+			}
+			if cfg.Cassandra.Username != "cassandra" {
+				t.Errorf("file replaced the default username with %q", cfg.Cassandra.Username)
+			}
+		}},
+		{"toml file named by the environment", map[string]string{"STORE_CONFIG": tomlFile}, nil, func(t *testing.T, cfg config) {
+			if cfg.Server.ListenAddr != ":9001" || cfg.Cassandra.Keyspace != "from_toml" {
+				t.Errorf("got %+v", cfg)
+			}
+		}},
+		{"environment overrides the file", map[string]string{"STORE_CASSANDRA_KEYSPACE": "from_env"}, []string{"-config", yamlFile}, func(t *testing.T, cfg config) {
+			if cfg.Cassandra.Keyspace != "from_env" || cfg.Server.ListenAddr != ":9000" {
+				t.Errorf("got %+v", cfg)
+			}
+		}},
+		{"flags override the environment", map[string]string{"STORE_CASSANDRA_KEYSPACE": "from_env"}, []string{"-cassandra-keyspace", "from_flag"}, func(t *testing.T, cfg config) {
+			if cfg.Cassandra.Keyspace != "from_flag" {
+				t.Errorf("keyspace %q", cfg.Cassandra.Keyspace)
+			}
+		}},
+		{"idle timeout from the environment", map[string]string{"STORE_IDLE_TIMEOUT": "90s"}, nil, func(t *testing.T, cfg config) {
+			if time.Duration(cfg.Server.IdleTimeout) != 90*time.Second {
+				t.Errorf("idle timeout %v", time.Duration(cfg.Server.IdleTimeout))
+			}
+		}},
+		{"idle timeout from a flag", nil, []string{"-idle-timeout", "5m"}, func(t *testing.T, cfg config) {
+			if time.Duration(cfg.Server.IdleTimeout) != 5*time.Minute {
+				t.Errorf("idle timeout %v", time.Duration(cfg.Server.IdleTimeout))
+			}
+		}},
+		{"lists and replication", map[string]string{
+			"STORE_CASSANDRA_HOSTS":       " a, ,b ",
+			"STORE_CASSANDRA_REPLICATION": "dc1:3, dc2:2",
+			"STORE_CASSANDRA_LOCAL_DC":    "dc1",
+		}, nil, func(t *testing.T, cfg config) {
+			if strings.Join(cfg.Cassandra.ContactPoints, ",") != "a,b" {
+				t.Errorf("contact points %q", cfg.Cassandra.ContactPoints)
+			}
+			want := "{'class': 'NetworkTopologyStrategy', 'dc1': 3, 'dc2': 2}"
+			if got := cfg.Cassandra.Replication.replicationCQL(); got != want {
+				t.Errorf("replication %s, want %s", got, want)
+			}
+		}},
+		{"arguments after the flags are left", nil, []string{"-backend", "memory", "stores.yaml"}, func(t *testing.T, cfg config) {
+			if cfg.Backend != "memory" {
+				t.Errorf("backend %q", cfg.Backend)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearSettingsEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := loadConfig(quietFlagSet(), tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"unknown flag", nil, []string{"-nope"}, "flag provided but not defined"},
+		{"bad duration in the environment", map[string]string{"STORE_IDLE_TIMEOUT": "soon"}, nil, "STORE_IDLE_TIMEOUT"},
+		{"bad port flag", nil, []string{"-cassandra-port", "x"}, "must be a number"},
+		{"missing file", nil, []string{"-config", "/nonexistent/store.yaml"}, "reading config file"},
+		{"unsupported file", nil, []string{"-config", writeConfigFile(t, "store.ini", "")}, "unsupported extension"},
+		{"invalid yaml", nil, []string{"-config", writeConfigFile(t, "bad.yaml", "server: [")}, "bad.yaml"},
+		{"zero idle timeout", map[string]string{"STORE_IDLE_TIMEOUT": "0s"}, nil, "server.idle_timeout must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearSettingsEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, err := loadConfig(quietFlagSet(), tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *config)
+		want   string
+	}{
+		{"defaults are valid", func(cfg *config) {}, ""},
+		{"backend", func(cfg *config) { cfg.Backend = "redis" }, "backend must be cassandra or memory"},
+		{"listen address", func(cfg *config) { cfg.Server.ListenAddr = "" }, "server.listen_addr is required"},
+		{"port", func(cfg *config) { cfg.Cassandra.Port = 70000 }, "cassandra.port must be between 1 and 65535"},
+		{"keyspace", func(cfg *config) { cfg.Cassandra.Keyspace = "drop table;" }, "cassandra.keyspace"},
+		{"consistency", func(cfg *config) { cfg.Cassandra.Consistency = "MOST" }, "consistency"},
+		{"serial consistency", func(cfg *config) { cfg.Cassandra.SerialConsistency = "QUORUM" }, "cassandra.serial_consistency"},
+		{"trusted networks", func(cfg *config) { cfg.Server.TrustedNetworks = []string{"10.0.0.0/99"} }, "server.trusted_networks"},
+		{"replication factor", func(cfg *config) { cfg.Cassandra.Replication.Factor = 0 }, "replication.factor must be at least 1"},
+		{"strategy", func(cfg *config) { cfg.Cassandra.Replication.Strategy = "Everywhere" }, "replication.strategy"},
+		{"local datacenter", func(cfg *config) {
+			cfg.Cassandra.Replication = replicationConfig{Strategy: "NetworkTopologyStrategy", Datacenters: map[string]int{"dc1": 3}}
+			cfg.Cassandra.LocalDC = "dc2"
+		}, `cassandra.local_dc "dc2"`},
+		{"datacenter name", func(cfg *config) {
+			cfg.Cassandra.Replication = replicationConfig{Strategy: "NetworkTopologyStrategy", Datacenters: map[string]int{"dc'1": 3}}
+		}, "invalid datacenter name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			tt.modify(&cfg)
+			err := cfg.validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("every problem is reported", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Backend = "redis"
+		cfg.Cassandra.Port = 0
+		err := cfg.validate()
+		if err == nil || !strings.Contains(err.Error(), "backend") || !strings.Contains(err.Error(), "port") {
+			t.Errorf("got %v, want both problems", err)
+		}
+	})
+}
+
+func TestParseReplication(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"SimpleStrategy:3", "{'class': 'SimpleStrategy', 'replication_factor': 3}", true},
+		{"dc2:2,dc1:3", "{'class': 'NetworkTopologyStrategy', 'dc1': 3, 'dc2': 2}", true},
+		{"SimpleStrategy:x", "", false},
+		{"dc1", "", false},
+		{"dc1:many", "", false},
+	}
+	for _, tt := range tests {
+		r, err := parseReplication(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseReplication(%q): got error %v, want ok %v", tt.value, err, tt.ok)
+			continue
+		}
+		if tt.ok && r.replicationCQL() != tt.want {
+			t.Errorf("parseReplication(%q) renders %s, want %s", tt.value, r.replicationCQL(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+const (
+	// readConsistencyHeader lets trusted callers ask for a stronger read
+	readConsistencyHeader = "X-Read-Consistency"
+	// consistencyLevelHeader reports the level the request's queries ran at
+	consistencyLevelHeader = "X-Consistency-Level"
+)
+
+// operation is a kind of repository call with its own consistency level
+type operation string
+
+const (
+	opGet    operation = "get"
+	opList   operation = "list"
+	opSearch operation = "search"
+	opWithin operation = "within"
+	opCreate operation = "create"
+	opUpdate operation = "update"
+	opDelete operation = "delete"
+)
+
+var operations = []operation{opGet, opList, opSearch, opWithin, opCreate, opUpdate, opDelete}
+
+func (op operation) isWrite() bool {
+	return op == opCreate || op == opUpdate || op == opDelete
+}
+
+// consistencyStrength orders levels from weakest to strongest so a requested
+// read level can only raise the configured one
+var consistencyStrength = map[gocql.Consistency]int{
+	gocql.Any:         0,
+	gocql.One:         1,
+	gocql.LocalOne:    1,
+	gocql.Two:         2,
+	gocql.Three:       3,
+	gocql.LocalQuorum: 4,
+	gocql.Quorum:      5,
+	gocql.EachQuorum:  6,
+	gocql.All:         7,
+}
+
+// consistencyPolicy picks the consistency level of each repository operation
+type consistencyPolicy struct {
+	read       gocql.Consistency
+	write      gocql.Consistency
+	operations map[operation]gocql.Consistency
+}
+
+// newConsistencyPolicy resolves the configured levels. Reads and writes fall
+// back to the cluster default; operations fall back to their read or write level.
+func newConsistencyPolicy(cfg cassandraConfig) (consistencyPolicy, error) {
+	parse := func(name, value string, fallback gocql.Consistency) (gocql.Consistency, error) {
+		if value == "" {
+			return fallback, nil
+		}
+		level, err := gocql.ParseConsistencyWrapper(value)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", name, err)
+		}
+		return level, nil
+	}
+
+	def, err := parse("cassandra.consistency", cfg.Consistency, gocql.Quorum)
+	if err != nil {
+		return consistencyPolicy{}, err
+	}
+	p := consistencyPolicy{operations: make(map[operation]gocql.Consistency)}
+	if p.read, err = parse("cassandra.read_consistency", cfg.ReadConsistency, def); err != nil {
+		return consistencyPolicy{}, err
+	}
+	if p.write, err = parse("cassandra.write_consistency", cfg.WriteConsistency, def); err != nil {
+		return consistencyPolicy{}, err
+	}
+
+	for name, value := range cfg.OperationConsistency {
+		op := operation(name)
+		known := false
+		for _, o := range operations {
+			known = known || o == op
+		}
+		if !known {
+			return consistencyPolicy{}, fmt.Errorf("cassandra.operation_consistency: unknown operation %q", name)
+		}
+		if p.operations[op], err = parse("cassandra.operation_consistency."+name, value, def); err != nil {
+			return consistencyPolicy{}, err
+		}
+	}
+	return p, nil
+}
+
+type (
+	operationKey       struct{}
+	readConsistencyKey struct{}
+	consistencyKey     struct{}
+)
+
+// consistencyReport collects the levels a request's queries ran at. Queries
+// may run on several goroutines, so it is guarded by a mutex.
+type consistencyReport struct {
+	mu    sync.Mutex
+	level gocql.Consistency
+	set   bool
+}
+
+// record notes the level of a query, keeping the weakest one since that is
+// all the response can promise
+func (r *consistencyReport) record(level gocql.Consistency) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.set || consistencyStrength[level] < consistencyStrength[r.level] {
+		r.level, r.set = level, true
+	}
+}
+
+// get returns the recorded level and whether any query ran
+func (r *consistencyReport) get() (gocql.Consistency, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.level, r.set
+}
+
+// withOperation tags the context with the operation being run. The outermost
+// operation wins, so the reads a write does first run at the write level.
+func withOperation(ctx context.Context, op operation) context.Context {
+	if _, ok := ctx.Value(operationKey{}).(operation); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, operationKey{}, op)
+}
+
+// level returns the consistency for the context's operation, raised to the
+// read level the caller requested when that is stronger, and records it in the
+// context's report
+func (p consistencyPolicy) level(ctx context.Context) gocql.Consistency {
+	op, _ := ctx.Value(operationKey{}).(operation)
+
+	level, ok := p.operations[op]
+	if !ok {
+		level = p.read
+		if op.isWrite() {
+			level = p.write
+		}
+	}
+	if requested, ok := ctx.Value(readConsistencyKey{}).(gocql.Consistency); ok && !op.isWrite() &&
+		consistencyStrength[requested] > consistencyStrength[level] {
+		level = requested
+	}
+
+	if report, ok := ctx.Value(consistencyKey{}).(*consistencyReport); ok {
+		report.record(level)
+	}
+	return level
+}
+
+// consistencySession issues queries at the level the policy picks for the
+// context's operation
+type consistencySession struct {
+	*gocql.Session
+	policy consistencyPolicy
+}
+
+func (s consistencySession) query(ctx context.Context, stmt string, values ...interface{}) *gocql.Query {
+	return s.Query(stmt, values...).WithContext(ctx).Consistency(s.policy.level(ctx))
+}
+
+func (s consistencySession) newBatch(ctx context.Context, typ gocql.BatchType) *gocql.Batch {
+	batch := s.NewBatch(typ).WithContext(ctx)
+	batch.SetConsistency(s.policy.level(ctx))
+	return batch
+}
+
+// parseNetworks parses CIDR blocks or single addresses
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", v)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// consistencyWriter sets the consistency level header from the report just
+// before the response goes out, on the goroutine writing it
+type consistencyWriter struct {
+	gin.ResponseWriter
+	report *consistencyReport
+}
+
+func (w *consistencyWriter) setHeader() {
+	if w.ResponseWriter.Written() {
+		return
+	}
+	if level, ok := w.report.get(); ok {
+		w.Header().Set(consistencyLevelHeader, level.String())
+	}
+}
+
+func (w *consistencyWriter) WriteHeaderNow() {
+	w.setHeader()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *consistencyWriter) Write(b []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *consistencyWriter) WriteString(s string) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *consistencyWriter) Flush() {
+	w.setHeader()
+	w.ResponseWriter.Flush()
+}
+
+// ConsistencyMiddleware reports the weakest consistency level the request's
+// queries ran at and lets callers from the trusted networks request a
+// stronger read level
+func ConsistencyMiddleware(trusted []*net.IPNet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := &consistencyReport{}
+		ctx := context.WithValue(c.Request.Context(), consistencyKey{}, report)
+
+		if requested := c.GetHeader(readConsistencyHeader); requested != "" {
+			if !isTrusted(trusted, c.RemoteIP()) {
+				c.Error(&apiError{Status: http.StatusForbidden, Code: errCodeForbidden, Detail: readConsistencyHeader + " is only accepted from trusted clients"})
+				c.Abort()
+				return
+			}
+			level, err := gocql.ParseConsistencyWrapper(requested)
+			if err != nil {
+				c.Error(badRequest("invalid " + readConsistencyHeader + ": " + err.Error()))
+				c.Abort()
+				return
+			}
+			ctx = context.WithValue(ctx, readConsistencyKey{}, level)
+		}
+
+		c.Request = c.Request.WithContext(ctx)
+		w := &consistencyWriter{ResponseWriter: c.Writer, report: report}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+		// Responses left to the error middleware or with no body are written later
+		w.setHeader()
+	}
+}
+
+// isTrusted reports whether the address lies in one of the networks
+func isTrusted(networks []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+func TestConsistencyPolicyLevel(t *testing.T) {
+	policy, err := newConsistencyPolicy(cassandraConfig{
+		Consistency:          "LOCAL_QUORUM",
+		ReadConsistency:      "ONE",
+		OperationConsistency: map[string]string{"search": "LOCAL_ONE", "delete": "ALL"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		ops       []operation
+		requested *gocql.Consistency
+		want      gocql.Consistency
+	}{
+		{"no operation reads", nil, nil, gocql.One},
+		{"read", []operation{opGet}, nil, gocql.One},
+		{"write falls back to the default", []operation{opCreate}, nil, gocql.LocalQuorum},
+		{"operation override", []operation{opSearch}, nil, gocql.LocalOne},
+		{"write override", []operation{opDelete}, nil, gocql.All},
+		{"outermost operation wins", []operation{opUpdate, opGet}, nil, gocql.LocalQuorum},
+		{"stronger read requested", []operation{opGet}, ptr(gocql.Quorum), gocql.Quorum},
+		{"weaker read requested", []operation{opCreate}, ptr(gocql.One), gocql.LocalQuorum},
+		{"requested level does not weaken reads", []operation{opList}, ptr(gocql.Any), gocql.One},
+		{"requested level does not apply to writes", []operation{opUpdate}, ptr(gocql.All), gocql.LocalQuorum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &consistencyReport{}
+			ctx := context.WithValue(context.Background(), consistencyKey{}, report)
+			for _, op := range tt.ops {
+				ctx = withOperation(ctx, op)
+			}
+			if tt.requested != nil {
+				ctx = context.WithValue(ctx, readConsistencyKey{}, *tt.requested)
+			}
+
+			if got := policy.level(ctx); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if reported, _ := report.get(); reported != tt.want {
+				t.Errorf("reported %v, want %v", reported, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewConsistencyPolicyErrors(t *testing.T) {
+	tests := []cassandraConfig{
+		{Consistency: "SOME"},
+		{ReadConsistency: "SOME"},
+		{WriteConsistency: "SOME"},
+		{OperationConsistency: map[string]string{"truncate": "ONE"}},
+		{OperationConsistency: map[string]string{"get": "SOME"}},
+	}
+	for _, cfg := range tests {
+		if _, err := newConsistencyPolicy(cfg); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
+
+func TestTrustedNetworks(t *testing.T) {
+	networks, err := parseNetworks([]string{"10.0.0.0/8", "192.0.2.7", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.0.2.7", true},
+		{"192.0.2.8", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+		{"not an address", false},
+	}
+	for _, tt := range tests {
+		if got := isTrusted(networks, tt.addr); got != tt.want {
+			t.Errorf("isTrusted(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "host.example"} {
+		if _, err := parseNetworks([]string{bad}); err == nil {
+			t.Errorf("parseNetworks accepted %q", bad)
+		}
+	}
+}
+
+func TestConsistencyMiddleware(t *testing.T) {
+	networks, err := parseNetworks([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := newConsistencyPolicy(cassandraConfig{Consistency: "LOCAL_QUORUM"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(ErrorMiddleware(), ConsistencyMiddleware(networks))
+	r.GET("/stores/:id", func(c *gin.Context) {
+		policy.level(withOperation(c.Request.Context(), opGet))
+		c.Status(http.StatusNoContent)
+	})
+	// Queries on several goroutines, as area lookups and bulk writes run them
+	r.GET("/stores/within", func(c *gin.Context) {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				policy.level(withOperation(c.Request.Context(), opWithin))
+			}()
+		}
+		wg.Wait()
+		c.JSON(http.StatusOK, []store{})
+	})
+	r.GET("/stores/failing", func(c *gin.Context) {
+		policy.level(withOperation(c.Request.Context(), opList))
+		c.Error(errors.New("timeout"))
+	})
+
+	tests := []struct {
+		name      string
+		path      string
+		remote    string
+		requested string
+		status    int
+		level     string
+	}{
+		{"no request", "/stores/1", "192.0.2.1:5000", "", http.StatusNoContent, "LOCAL_QUORUM"},
+		{"trusted caller", "/stores/1", "10.0.0.5:5000", "ALL", http.StatusNoContent, "ALL"},
+		{"untrusted caller", "/stores/1", "192.0.2.1:5000", "ALL", http.StatusForbidden, ""},
+		{"invalid level", "/stores/1", "10.0.0.5:5000", "MOST", http.StatusBadRequest, ""},
+		{"concurrent queries", "/stores/within", "10.0.0.5:5000", "ALL", http.StatusOK, "ALL"},
+		{"error written after the handler", "/stores/failing", "192.0.2.1:5000", "", http.StatusInternalServerError, "LOCAL_QUORUM"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = tt.remote
+			if tt.requested != "" {
+				req.Header.Set(readConsistencyHeader, tt.requested)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := w.Header().Get(consistencyLevelHeader); got != tt.level {
+				t.Errorf("%s %q, want %q", consistencyLevelHeader, got, tt.level)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gocql/gocql"
+)
+
+// scriptedIDs is a store repository whose NextID returns ids in turn and then
+// err
+type scriptedIDs struct {
+	StoreRepository
+	ids []int
+	err error
+}
+
+func (r *scriptedIDs) NextID(ctx context.Context) (int, error) {
+	if len(r.ids) == 0 {
+		return 0, r.err
+	}
+	id := r.ids[0]
+	r.ids = r.ids[1:]
+	return id, nil
+}
+
+func TestCreateStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		taken   []int
+		ids     []int
+		idErr   error
+		in      store
+		want    int
+		wantErr error
+	}{
+		{"client chosen id", nil, nil, nil, store{ID: 9}, 9, nil},
+		{"client chosen id taken", []int{9}, nil, nil, store{ID: 9}, 0, errStoreExists},
+		{"allocated id", nil, []int{1}, nil, store{}, 1, nil},
+		{"allocated id taken by a client", []int{1}, []int{1, 2}, nil, store{}, 2, nil},
+		{"every attempt taken", []int{1, 2, 3}, []int{1, 2, 3, 4}, nil, store{}, 0, errStoreExists},
+		{"allocation fails", nil, nil, errIDContention, store{}, 0, errIDContention},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMemoryRepositories(t)
+			for _, id := range tt.taken {
+				mustCreateStores(t, store{ID: id, AreaID: 1, Name: "Taken"})
+			}
+			storeRepo = &scriptedIDs{StoreRepository: storeRepo, ids: tt.ids, err: tt.idErr}
+
+			tt.in.AreaID, tt.in.Name = 1, "New"
+			s, err := createStore(context.Background(), tt.in)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.ID != tt.want {
+				t.Errorf("created store %d, want %d", s.ID, tt.want)
+			}
+			if got, err := storeRepo.Get(context.Background(), tt.want); err != nil || got.Name != "New" {
+				t.Errorf("store %d is %+v, %v", tt.want, got, err)
+			}
+		})
+	}
+}
+
+func TestPostStoresAllocatesIDs(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRouter()
+
+	// Each case runs against the stores the previous ones created
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		status   int
+		location string
+		ids      []int
+	}{
+		{"first store", "/v1/stores", `{"name":"A","areaId":1}`, http.StatusCreated, "/v1/stores/1", []int{1}},
+		{"client chosen id", "/v1/stores", `{"id":3,"name":"B","areaId":1}`, http.StatusCreated, "/v1/stores/3", []int{3}},
+		{"allocation continues past chosen ids", "/v1/stores", `[{"name":"C","areaId":1},{"name":"D","areaId":1}]`, http.StatusCreated, "", []int{4, 5}},
+		{"allocation after another route", "/v1/stores", `{"name":"E","areaId":1}`, http.StatusCreated, "/v1/stores/6", []int{6}},
+		{"taken id", "/v1/stores", `{"id":3,"name":"F","areaId":1}`, http.StatusConflict, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodPost, tt.path, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location %q, want %q", got, tt.location)
+			}
+			if tt.ids == nil {
+				return
+			}
+			var resp bulkResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var ids []int
+			for _, result := range resp.Results {
+				ids = append(ids, result.ID)
+				if result.Store == nil || result.Store.ID != result.ID {
+					t.Errorf("result %+v does not carry its store", result)
+				}
+			}
+			// Items are created concurrently, so allocation order is not fixed
+			sort.Ints(ids)
+			if !equalInts(ids, tt.ids) {
+				t.Errorf("ids %v, want %v", ids, tt.ids)
+			}
+		})
+	}
+
+	if s, _ := storeRepo.Get(context.Background(), 3); s.Name != "B" {
+		t.Errorf("store 3 is %+v after the conflicting create", s)
+	}
+}
+
+func TestPostStoresIDContention(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	storeRepo = &scriptedIDs{StoreRepository: storeRepo, err: errIDContention}
+
+	w := serve(newTestRouter(), http.MethodPost, "/v1/stores", `{"name":"A","areaId":1}`)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d, want 503: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, problemContentType) {
+		t.Errorf("Content-Type %q, want %s", ct, problemContentType)
+	}
+	var p problem
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Code != errCodeOverloaded || p.Detail != toAPIError(errIDContention).Detail {
+		t.Errorf("got %+v", p)
+	}
+}
+
+func TestPostStoresConflictNamesTriedID(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	mustCreateStores(t,
+		store{ID: 1, AreaID: 1, Name: "Taken"},
+		store{ID: 2, AreaID: 1, Name: "Taken"},
+		store{ID: 3, AreaID: 1, Name: "Taken"},
+	)
+	// A NextID that does not move past the taken IDs
+	storeRepo = &scriptedIDs{StoreRepository: storeRepo, ids: []int{1, 2, 3}}
+
+	w := serve(newTestRouter(), http.MethodPost, "/v1/stores", `{"name":"A","areaId":1}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status %d, want 409: %s", w.Code, w.Body)
+	}
+	var p problem
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Detail != "store 3 already exists" {
+		t.Errorf("detail %q, want the last ID tried", p.Detail)
+	}
+}
+
+// failingCreates is a store repository whose Create fails with the error set
+// for the store's ID
+type failingCreates struct {
+	StoreRepository
+	errs map[int]error
+}
+
+func (r *failingCreates) Create(ctx context.Context, s store) error {
+	if err, ok := r.errs[s.ID]; ok {
+		return err
+	}
+	return r.StoreRepository.Create(ctx, s)
+}
+
+func TestPostStoresSharedFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		errs    map[int]error
+		status  int
+		problem bool
+	}{
+		{"every item unavailable", map[int]error{1: gocql.ErrNoConnections, 2: gocql.ErrUnavailable}, http.StatusServiceUnavailable, true},
+		{"every item timed out", map[int]error{1: context.DeadlineExceeded, 2: gocql.ErrTimeoutNoResponse}, http.StatusGatewayTimeout, true},
+		{"different reasons", map[int]error{1: gocql.ErrNoConnections, 2: context.DeadlineExceeded}, http.StatusInternalServerError, false},
+		{"one item failed", map[int]error{1: gocql.ErrNoConnections}, http.StatusMultiStatus, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMemoryRepositories(t)
+			if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+				t.Fatal(err)
+			}
+			storeRepo = &failingCreates{StoreRepository: storeRepo, errs: tt.errs}
+
+			w := serve(newTestRouter(), http.MethodPost, "/v1/stores", `[{"id":1,"name":"A","areaId":1},{"id":2,"name":"B","areaId":1}]`)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if isProblem := strings.HasPrefix(w.Header().Get("Content-Type"), problemContentType); isProblem != tt.problem {
+				t.Errorf("problem response %v, want %v: %s", isProblem, tt.problem, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// anyVersion makes a conditional write apply to whatever version is stored
+const anyVersion int64 = -1
+
+// errVersionConflict is returned when a store no longer has the version a
+// conditional write expected
+var errVersionConflict = errors.New("store was modified")
+
+// nextVersion returns the version of a write replacing current. Versions are
+// write times in microseconds, so a deleted and recreated store never reuses
+// the version of its earlier incarnation.
+func nextVersion(current int64) int64 {
+	return max(time.Now().UnixMicro(), current+1)
+}
+
+// storeETag is the strong entity tag of a store version
+func storeETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// ifMatchVersion returns the version required by the request's If-Match
+// header: anyVersion without a header or for "*". ok is false when the header
+// names a tag that can never match, such as a weak or malformed one.
+func ifMatchVersion(c *gin.Context) (version int64, ok bool) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return anyVersion, true
+	}
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(header[1:len(header)-1], 10, 64)
+	if err != nil || version < 0 {
+		return 0, false
+	}
+	return version, true
+}
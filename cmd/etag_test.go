@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIfMatchVersion(t *testing.T) {
+	tests := []struct {
+		header  string
+		version int64
+		ok      bool
+	}{
+		{"", anyVersion, true},
+		{"*", anyVersion, true},
+		{` "42" `, 42, true},
+		{`"0"`, 0, true},
+		{`W/"42"`, 0, false},
+		{`42`, 0, false},
+		{`"-1"`, 0, false},
+		{`"abc"`, 0, false},
+		{`"`, 0, false},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPut, "/v1/stores/1", nil)
+		if tt.header != "" {
+			c.Request.Header.Set("If-Match", tt.header)
+		}
+		version, ok := ifMatchVersion(c)
+		if version != tt.version || ok != tt.ok {
+			t.Errorf("If-Match %q: got %d, %v, want %d, %v", tt.header, version, ok, tt.version, tt.ok)
+		}
+	}
+}
+
+func TestNextVersion(t *testing.T) {
+	future := nextVersion(0) + 1e12
+	if got := nextVersion(future); got != future+1 {
+		t.Errorf("nextVersion(%d) = %d, want the next microsecond", future, got)
+	}
+	if first, second := nextVersion(0), nextVersion(0); second < first {
+		t.Errorf("versions went back from %d to %d", first, second)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	mustCreateStores(t, store{ID: 1, AreaID: 1, Name: "A"})
+	r := newTestRouter()
+
+	w := serve(r, http.MethodGet, "/v1/stores/1", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET: status %d, ETag %q", w.Code, etag)
+	}
+	first := etag
+
+	// Each case runs against the state the previous one left
+	tests := []struct {
+		name    string
+		method  string
+		ifMatch func() string
+		status  int
+		newETag bool
+	}{
+		{"weak tag never matches", http.MethodPut, func() string { return "W/" + etag }, http.StatusPreconditionFailed, false},
+		{"malformed tag", http.MethodPut, func() string { return "42" }, http.StatusPreconditionFailed, false},
+		{"current tag", http.MethodPut, func() string { return etag }, http.StatusOK, true},
+		{"stale tag", http.MethodPut, func() string { return first }, http.StatusPreconditionFailed, false},
+		{"any version", http.MethodPut, func() string { return "*" }, http.StatusOK, true},
+		{"no header", http.MethodPut, func() string { return "" }, http.StatusOK, true},
+		{"stale tag on delete", http.MethodDelete, func() string { return first }, http.StatusPreconditionFailed, false},
+		{"current tag on delete", http.MethodDelete, func() string { return etag }, http.StatusOK, false},
+		{"deleted store", http.MethodPut, func() string { return etag }, http.StatusNotFound, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := ""
+			if tt.method == http.MethodPut {
+				body = `{"name":"Renamed"}`
+			}
+			var headers []string
+			if h := tt.ifMatch(); h != "" {
+				headers = []string{"If-Match", h}
+			}
+			w := serve(r, tt.method, "/v1/stores/1", body, headers...)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			got := w.Header().Get("ETag")
+			if tt.newETag {
+				if got == "" || got == etag {
+					t.Errorf("ETag %q after replacing %q", got, etag)
+				}
+				etag = got
+			}
+			if w.Code == http.StatusPreconditionFailed {
+				var p problem
+				if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || p.Code != errCodePrecondition {
+					t.Errorf("got %s, want a %s problem", w.Body, errCodePrecondition)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+// maxFuzzyDistance caps the edit distance accepted by fuzzy search
+const maxFuzzyDistance = 3
+
+// editDistance returns the optimal string alignment distance between a and b:
+// insertions, deletions, substitutions and transpositions of adjacent runes
+// each cost one, so "alpah" is one edit away from "alpha"
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	rows := make([][]int, len(ra)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(rb)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d := min(rows[i-1][j]+1, rows[i][j-1]+1, rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d = min(d, rows[i-2][j-2]+1)
+			}
+			rows[i][j] = d
+		}
+	}
+	return rows[len(ra)][len(rb)]
+}
+
+// similarity turns an edit distance into a score between 0 and 1
+func similarity(a, b string, distance int) float64 {
+	longest := max(len([]rune(a)), len([]rune(b)))
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(distance)/float64(longest)
+}
+
+// fuzzyTrigramThreshold is the minimum number of padded trigrams a field token
+// must share with a query token of gramCount trigrams to be within maxDistance
+// edits. A substitution destroys at most three trigrams, but a transposition
+// of adjacent runes destroys up to four. A threshold of zero or less means any
+// token may be within reach, so the index cannot narrow the search.
+func fuzzyTrigramThreshold(gramCount, maxDistance int) int {
+	return gramCount - 4*maxDistance
+}
+
+// fuzzyCandidates returns the stores sharing enough padded trigrams with the
+// token to possibly be within maxDistance edits, or nil when the token is too
+// short to rule any store out. lookup returns the stores indexed under a term.
+func fuzzyCandidates(token string, maxDistance int, lookup func(term string) (map[int]bool, error)) (map[int]bool, error) {
+	grams := trigrams("^" + token + "$")
+	threshold := fuzzyTrigramThreshold(len(grams), maxDistance)
+	if threshold <= 0 {
+		return nil, nil
+	}
+
+	shared := make(map[int]int)
+	for _, gram := range grams {
+		ids, err := lookup("g:" + gram)
+		if err != nil {
+			return nil, err
+		}
+		for id := range ids {
+			shared[id]++
+		}
+	}
+
+	candidates := make(map[int]bool)
+	for id, count := range shared {
+		if count >= threshold {
+			candidates[id] = true
+		}
+	}
+	return candidates, nil
+}
+
+// fuzzyFieldSimilarity matches each query token to its closest field token and
+// returns the mean similarity. Every token must be within maxDistance edits.
+func fuzzyFieldSimilarity(queryTokens []string, value string, maxDistance int) (float64, bool) {
+	fieldTokens := tokenize(value)
+	total := 0.0
+	for _, q := range queryTokens {
+		best := -1.0
+		for _, t := range fieldTokens {
+			if d := editDistance(q, t); d <= maxDistance {
+				if sim := similarity(q, t, d); sim > best {
+					best = sim
+				}
+			}
+		}
+		if best < 0 {
+			return 0, false
+		}
+		total += best
+	}
+	return total / float64(len(queryTokens)), true
+}
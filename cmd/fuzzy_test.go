@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"alpha", "alpha", 0},
+		{"", "abc", 3},
+		{"alpah", "alpha", 1},
+		{"alpa", "alpha", 1},
+		{"alphaa", "alpha", 1},
+		{"alpxa", "alpha", 1},
+		{"kitten", "sitting", 3},
+		{"ca", "abc", 3},
+		{"café", "cafe", 1},
+		{"مكتبه", "مكتبة", 1},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := editDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		distance int
+		want     float64
+	}{
+		{"", "", 0, 1},
+		{"alpha", "alpha", 0, 1},
+		{"alpah", "alpha", 1, 0.8},
+		{"ab", "abcd", 2, 0.5},
+		{"café", "cafe", 1, 0.75},
+	}
+	for _, tt := range tests {
+		if got := similarity(tt.a, tt.b, tt.distance); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("similarity(%q, %q, %d) = %v, want %v", tt.a, tt.b, tt.distance, got, tt.want)
+		}
+	}
+}
+
+func TestFuzzyFieldSimilarity(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens []string
+		value  string
+		max    int
+		want   float64
+		ok     bool
+	}{
+		{"exact", []string{"alpha"}, "Store Alpha", 1, 1, true},
+		{"transposition", []string{"alpah"}, "Store Alpha", 1, 0.8, true},
+		{"mean over tokens", []string{"stor", "alpha"}, "Store Alpha", 1, 0.9, true},
+		{"one token too far", []string{"store", "omega"}, "Store Alpha", 2, 0, false},
+		{"empty value", []string{"alpha"}, "", 3, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := fuzzyFieldSimilarity(tt.tokens, tt.value, tt.max)
+			if ok != tt.ok || math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestFuzzyTrigramThreshold(t *testing.T) {
+	// A query token within maxDistance edits of a field token always shares
+	// at least the threshold of padded trigrams with it
+	pairs := [][2]string{
+		{"alpha", "alpah"}, {"pharmacy", "farmacy"}, {"books", "boks"}, {"central", "centrale"},
+		// Transpositions destroy four trigrams
+		{"pharmcay", "pharmacy"}, {"abcdefg", "abcedfg"},
+		// Too short for the index to rule anything out
+		{"ab", "cd"},
+	}
+	for _, p := range pairs {
+		d := editDistance(p[0], p[1])
+		query := trigrams("^" + p[0] + "$")
+		field := make(map[string]bool)
+		for _, g := range trigrams("^" + p[1] + "$") {
+			field[g] = true
+		}
+		shared := 0
+		for _, g := range query {
+			if field[g] {
+				shared++
+			}
+		}
+		if threshold := fuzzyTrigramThreshold(len(query), d); shared < threshold {
+			t.Errorf("%q and %q share %d trigrams, below the threshold %d", p[0], p[1], shared, threshold)
+		}
+	}
+}
+
+func TestFuzzySearchStores(t *testing.T) {
+	useMemoryRepositories(t)
+	mustCreateStores(t,
+		store{ID: 1, Name: "Store Alpha"},
+		store{ID: 2, Name: "Store Alps"},
+		store{ID: 3, Name: "Pharmacy"},
+	)
+	r := newTestRouter()
+
+	tests := []struct {
+		name  string
+		query string
+		want  []int
+	}{
+		{"exact search misses typos", "name=alpah", []int{}},
+		{"one edit", "name=alpah&fuzzy=1", []int{1}},
+		{"closest first", "name=alpa&fuzzy=2", []int{1, 2}},
+		{"typo in another store", "name=farmacy&fuzzy=2", []int{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, "/v1/stores/search?"+tt.query, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var page storePage[searchResult]
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			ids := []int{}
+			for _, s := range page.Stores {
+				ids = append(ids, s.ID)
+				if s.Similarity == nil {
+					t.Errorf("store %d has no similarity", s.ID)
+				}
+			}
+			if !equalInts(ids, tt.want) {
+				t.Errorf("got %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// earthRadiusMeters is the mean Earth radius used for great-circle distances
+const earthRadiusMeters = 6371008.8
+
+const (
+	defaultNearbyLimit = 10
+	maxNearbyLimit     = 100
+)
+
+// nearbyFirstRadiusMeters is the radius of the first ring getNearbyStores
+// searches; each miss widens it by nearbyRadiusGrowth
+const (
+	nearbyFirstRadiusMeters = 1000
+	nearbyRadiusGrowth      = 4
+)
+
+// nearbyStore is a store annotated with its distance from the query point
+type nearbyStore struct {
+	store
+	DistanceMeters float64 `json:"distanceMeters"`
+}
+
+// hasCoordinates reports whether the store has both latitude and longitude set
+func (s store) hasCoordinates() bool {
+	return s.Latitude != nil && s.Longitude != nil
+}
+
+// validLatLon checks that a latitude/longitude pair is within WGS84 range
+func validLatLon(lat, lon float64) error {
+	if math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return errors.New("latitude must be between -90 and 90")
+	}
+	if math.IsNaN(lon) || lon < -180 || lon > 180 {
+		return errors.New("longitude must be between -180 and 180")
+	}
+	return nil
+}
+
+// haversineMeters returns the great-circle distance between two points in meters
+func haversineMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	rlat1 := lat1 * math.Pi / 180
+	rlat2 := lat2 * math.Pi / 180
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rlat1)*math.Cos(rlat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// sortByDistance returns the stores with coordinates ordered by distance from the given point
+func sortByDistance(stores []store, lat, lon float64) []nearbyStore {
+	results := make([]nearbyStore, 0, len(stores))
+	for _, s := range stores {
+		if !s.hasCoordinates() {
+			continue
+		}
+		results = append(results, nearbyStore{
+			store:          s,
+			DistanceMeters: haversineMeters(lat, lon, *s.Latitude, *s.Longitude),
+		})
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].DistanceMeters < results[j].DistanceMeters
+	})
+	return results
+}
+
+// parseLatLon reads and validates a latitude/longitude pair from the query string
+func parseLatLon(c *gin.Context, latKey, lonKey string) (float64, float64, error) {
+	lat, err := strconv.ParseFloat(c.Query(latKey), 64)
+	if err != nil {
+		return 0, 0, errors.New("invalid " + latKey)
+	}
+	lon, err := strconv.ParseFloat(c.Query(lonKey), 64)
+	if err != nil {
+		return 0, 0, errors.New("invalid " + lonKey)
+	}
+	if err := validLatLon(lat, lon); err != nil {
+		return 0, 0, err
+	}
+	return lat, lon, nil
+}
+
+// getNearbyStores returns the stores closest to lat/lon ordered by great-circle distance
+func getNearbyStores(c *gin.Context) {
+	lat, lon, err := parseLatLon(c, "lat", "lon")
+	if err != nil {
+		c.Error(badRequest(err.Error()))
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultNearbyLimit)))
+	if err != nil || limit <= 0 {
+		c.Error(badRequest("invalid limit"))
+		return
+	}
+	if limit > maxNearbyLimit {
+		limit = maxNearbyLimit
+	}
+
+	results, err := nearestStores(c.Request.Context(), lat, lon, limit, -1)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	renderStoreList(c, results)
+}
+
+// nearestStores returns up to limit stores closest to lat/lon, only those of
+// one area unless areaID is negative. It searches the geohash index in
+// widening circles and only stops once a circle holds limit stores, since a
+// store outside the circle may still beat one in its corners. When the circle
+// outgrows the index it falls back to scanning every store, or the area.
+func nearestStores(ctx context.Context, lat, lon float64, limit, areaID int) ([]nearbyStore, error) {
+	for radius := float64(nearbyFirstRadiusMeters); ; radius *= nearbyRadiusGrowth {
+		candidates, err := storesWithin(ctx, radiusBoxes(lat, lon, radius))
+		if errors.Is(err, errAreaTooLarge) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if areaID >= 0 {
+			candidates = slices.DeleteFunc(candidates, func(s store) bool { return s.AreaID != areaID })
+		}
+
+		results := sortByDistance(candidates, lat, lon)
+		inside := 0
+		for inside < len(results) && results[inside].DistanceMeters <= radius {
+			inside++
+		}
+		if inside >= limit {
+			return results[:limit], nil
+		}
+		// A circle reaching the antipode already holds every store
+		if radius >= math.Pi*earthRadiusMeters {
+			return results, nil
+		}
+	}
+
+	var stores []store
+	var err error
+	if areaID >= 0 {
+		stores, err = allStoresInArea(ctx, storeRepo, areaID)
+	} else {
+		stores, err = allStores(ctx, storeRepo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	results := sortByDistance(stores, lat, lon)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
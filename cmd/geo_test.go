@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"testing"
+)
+
+func TestHaversineMeters(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		{"same point", 30.0444, 31.2357, 30.0444, 31.2357, 0},
+		{"one degree of longitude on the equator", 0, 0, 0, 1, 111195},
+		{"pole to pole", 90, 0, -90, 0, math.Pi * earthRadiusMeters},
+		{"across the antimeridian", 0, 179.5, 0, -179.5, 111195},
+		{"cairo to alexandria", 30.0444, 31.2357, 31.2001, 29.9187, 179500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := haversineMeters(tt.lat1, tt.lon1, tt.lat2, tt.lon2)
+			if math.Abs(got-tt.want) > tt.want*0.005+1 {
+				t.Errorf("got %.0f m, want about %.0f m", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidLatLon(t *testing.T) {
+	tests := []struct {
+		lat, lon float64
+		ok       bool
+	}{
+		{0, 0, true},
+		{90, 180, true},
+		{-90, -180, true},
+		{90.1, 0, false},
+		{0, -180.1, false},
+		{math.NaN(), 0, false},
+		{0, math.NaN(), false},
+	}
+	for _, tt := range tests {
+		if err := validLatLon(tt.lat, tt.lon); (err == nil) != tt.ok {
+			t.Errorf("validLatLon(%v, %v) = %v, want ok %v", tt.lat, tt.lon, err, tt.ok)
+		}
+	}
+}
+
+func TestSortByDistance(t *testing.T) {
+	stores := []store{
+		{ID: 1, Latitude: ptr(0.0), Longitude: ptr(3.0)},
+		{ID: 2},
+		{ID: 3, Latitude: ptr(0.0), Longitude: ptr(1.0)},
+		{ID: 4, Latitude: ptr(0.0), Longitude: ptr(-2.0)},
+	}
+	results := sortByDistance(stores, 0, 0)
+
+	var ids []int
+	for i, r := range results {
+		ids = append(ids, r.ID)
+		if i > 0 && r.DistanceMeters < results[i-1].DistanceMeters {
+			t.Errorf("result %d is closer than the one before it", i)
+		}
+	}
+	if want := []int{3, 4, 1}; !equalInts(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+}
+
+func TestGetNearbyStores(t *testing.T) {
+	useMemoryRepositories(t)
+	mustCreateStores(t,
+		store{ID: 1, Name: "Far", Latitude: ptr(5.0), Longitude: ptr(5.0)},
+		store{ID: 2, Name: "Near", Latitude: ptr(0.1), Longitude: ptr(0.1)},
+		store{ID: 3, Name: "Unplaced"},
+		store{ID: 4, Name: "Middle", Latitude: ptr(1.0), Longitude: ptr(1.0)},
+	)
+	r := newTestRouter()
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   []int
+	}{
+		{"closest first", "lat=0&lon=0", http.StatusOK, []int{2, 4, 1}},
+		{"limit", "lat=0&lon=0&limit=2", http.StatusOK, []int{2, 4}},
+		{"from the far store", "lat=5&lon=5", http.StatusOK, []int{1, 4, 2}},
+		{"missing lon", "lat=0", http.StatusBadRequest, nil},
+		{"latitude out of range", "lat=91&lon=0", http.StatusBadRequest, nil},
+		{"zero limit", "lat=0&lon=0&limit=0", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, "/v1/stores/nearby?"+tt.query, "")
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var got []nearbyStore
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			var ids []int
+			for _, s := range got {
+				ids = append(ids, s.ID)
+			}
+			if !equalInts(ids, tt.want) {
+				t.Errorf("got %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+// indexedRepository behaves like the Cassandra repository for area queries:
+// Within refuses boxes the geohash index cannot cover, and full scans and
+// searches are counted
+type indexedRepository struct {
+	StoreRepository
+	lists    int
+	searches int
+}
+
+func (r *indexedRepository) Within(ctx context.Context, box boundingBox) ([]store, error) {
+	if _, err := coveringCells(box); err != nil {
+		return nil, err
+	}
+	return r.StoreRepository.Within(ctx, box)
+}
+
+func (r *indexedRepository) List(ctx context.Context, limit int, cursor pageCursor) ([]store, pageCursor, error) {
+	r.lists++
+	return r.StoreRepository.List(ctx, limit, cursor)
+}
+
+func (r *indexedRepository) Search(ctx context.Context, criteria searchCriteria) ([]searchResult, error) {
+	r.searches++
+	return r.StoreRepository.Search(ctx, criteria)
+}
+
+func TestNearestStores(t *testing.T) {
+	useMemoryRepositories(t)
+	mustCreateStores(t,
+		store{ID: 1, Name: "Across the antimeridian", Latitude: ptr(0.0), Longitude: ptr(-179.99)},
+		store{ID: 2, Name: "Same side", Latitude: ptr(0.0), Longitude: ptr(179.9)},
+		store{ID: 3, Name: "Other side of the world", Latitude: ptr(0.0), Longitude: ptr(0.0)},
+	)
+	repo := &indexedRepository{StoreRepository: storeRepo}
+	storeRepo = repo
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		limit int
+		want  []int
+		scans int
+	}{
+		{"found in the index", 1, []int{1}, 0},
+		{"ring widened across the antimeridian", 2, []int{1, 2}, 0},
+		{"more than the index covers falls back to a scan", 3, []int{1, 2, 3}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo.lists = 0
+			results, err := nearestStores(ctx, 0, 179.99, tt.limit, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int
+			for _, r := range results {
+				ids = append(ids, r.ID)
+			}
+			if !equalInts(ids, tt.want) {
+				t.Errorf("got %v, want %v", ids, tt.want)
+			}
+			if repo.lists != tt.scans {
+				t.Errorf("listed stores %d times, want %d", repo.lists, tt.scans)
+			}
+		})
+	}
+}
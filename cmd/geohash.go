@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohashPrecisions are the prefix lengths each store is indexed under in
+// stores_by_geohash, finest first. Precision 6 cells are roughly 1.2km x 0.6km,
+// precision 4 roughly 39km x 20km and precision 2 roughly 1250km x 625km.
+var geohashPrecisions = []int{6, 4, 2}
+
+// maxGeohashCells bounds how many partitions a single area query may touch
+const maxGeohashCells = 64
+
+// maxRadiusMeters bounds the radius accepted by getStoresWithinRadius
+const maxRadiusMeters = 100000
+
+var errAreaTooLarge = errors.New("requested area is too large")
+
+// boundingBox is a latitude/longitude rectangle that does not cross the antimeridian
+type boundingBox struct {
+	MinLat, MinLon, MaxLat, MaxLon float64
+}
+
+// contains reports whether the point lies inside the box, edges included
+func (b boundingBox) contains(lat, lon float64) bool {
+	return lat >= b.MinLat && lat <= b.MaxLat && lon >= b.MinLon && lon <= b.MaxLon
+}
+
+// radiusBoxes returns the smallest boxes containing the circle of radiusMeters
+// around lat/lon. A circle crossing the antimeridian is split into one box on
+// each side of it.
+func radiusBoxes(lat, lon, radiusMeters float64) []boundingBox {
+	dLat := radiusMeters / earthRadiusMeters * 180 / math.Pi
+	box := boundingBox{
+		MinLat: math.Max(-90, lat-dLat),
+		MaxLat: math.Min(90, lat+dLat),
+		MinLon: -180,
+		MaxLon: 180,
+	}
+
+	// Near the poles the circle wraps every meridian
+	cosLat := math.Cos(math.Max(math.Abs(box.MinLat), math.Abs(box.MaxLat)) * math.Pi / 180)
+	if cosLat <= 1e-9 {
+		return []boundingBox{box}
+	}
+	dLon := dLat / cosLat
+	if dLon >= 180 {
+		return []boundingBox{box}
+	}
+
+	west, east := box, box
+	switch {
+	case lon-dLon < -180:
+		west.MinLon, west.MaxLon = -180, lon+dLon
+		east.MinLon, east.MaxLon = lon-dLon+360, 180
+		return []boundingBox{west, east}
+	case lon+dLon > 180:
+		west.MinLon, west.MaxLon = -180, lon+dLon-360
+		east.MinLon, east.MaxLon = lon-dLon, 180
+		return []boundingBox{west, east}
+	}
+	box.MinLon, box.MaxLon = lon-dLon, lon+dLon
+	return []boundingBox{box}
+}
+
+// storesWithin returns the stores inside any of the boxes, which must not overlap
+func storesWithin(ctx context.Context, boxes []boundingBox) ([]store, error) {
+	var stores []store
+	for _, box := range boxes {
+		found, err := storeRepo.Within(ctx, box)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, found...)
+	}
+	return stores, nil
+}
+
+// geohashEncode returns the geohash of lat/lon with the given number of characters
+func geohashEncode(lat, lon float64, precision int) string {
+	minLat, maxLat := -90.0, 90.0
+	minLon, maxLon := -180.0, 180.0
+
+	hash := make([]byte, 0, precision)
+	bit, ch := 0, 0
+	even := true
+	for len(hash) < precision {
+		if even {
+			mid := (minLon + maxLon) / 2
+			if lon >= mid {
+				ch |= 1 << (4 - bit)
+				minLon = mid
+			} else {
+				maxLon = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if lat >= mid {
+				ch |= 1 << (4 - bit)
+				minLat = mid
+			} else {
+				maxLat = mid
+			}
+		}
+		even = !even
+
+		if bit < 4 {
+			bit++
+		} else {
+			hash = append(hash, geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// geohashCellSize returns the latitude and longitude span in degrees of a geohash cell
+func geohashCellSize(precision int) (float64, float64) {
+	bits := 5 * precision
+	lonBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 180 / math.Exp2(float64(latBits)), 360 / math.Exp2(float64(lonBits))
+}
+
+// geohashCover returns the geohash cells of the given precision that intersect the box
+func geohashCover(box boundingBox, precision int) []string {
+	cellLat, cellLon := geohashCellSize(precision)
+
+	firstLat := int(math.Floor((box.MinLat + 90) / cellLat))
+	lastLat := int(math.Min(math.Floor((box.MaxLat+90)/cellLat), 180/cellLat-1))
+	firstLon := int(math.Floor((box.MinLon + 180) / cellLon))
+	lastLon := int(math.Min(math.Floor((box.MaxLon+180)/cellLon), 360/cellLon-1))
+
+	cells := make([]string, 0, (lastLat-firstLat+1)*(lastLon-firstLon+1))
+	for i := firstLat; i <= lastLat; i++ {
+		for j := firstLon; j <= lastLon; j++ {
+			lat := -90 + (float64(i)+0.5)*cellLat
+			lon := -180 + (float64(j)+0.5)*cellLon
+			cells = append(cells, geohashEncode(lat, lon, precision))
+		}
+	}
+	return cells
+}
+
+// coveringCells picks the finest indexed precision whose cover of the box stays
+// within maxGeohashCells partitions
+func coveringCells(box boundingBox) ([]string, error) {
+	for _, precision := range geohashPrecisions {
+		cellLat, cellLon := geohashCellSize(precision)
+		rows := math.Floor((box.MaxLat+90)/cellLat) - math.Floor((box.MinLat+90)/cellLat) + 1
+		cols := math.Floor((box.MaxLon+180)/cellLon) - math.Floor((box.MinLon+180)/cellLon) + 1
+		if rows*cols <= maxGeohashCells {
+			return geohashCover(box, precision), nil
+		}
+	}
+	return nil, errAreaTooLarge
+}
+
+// storeGeohashes returns the index prefixes a store with coordinates is written under
+func storeGeohashes(s store) []string {
+	if !s.hasCoordinates() {
+		return nil
+	}
+	full := geohashEncode(*s.Latitude, *s.Longitude, geohashPrecisions[0])
+	hashes := make([]string, 0, len(geohashPrecisions))
+	for _, precision := range geohashPrecisions {
+		hashes = append(hashes, full[:precision])
+	}
+	return hashes
+}
+
+// addGeohashIndexQueries appends the statements keeping stores_by_geohash in
+// step with a store write. previous is the row being overwritten, if any.
+func addGeohashIndexQueries(batch *gocql.Batch, previous *store, s store) {
+	current := storeGeohashes(s)
+
+	if previous != nil {
+		keep := make(map[string]bool, len(current))
+		for _, hash := range current {
+			keep[hash] = true
+		}
+		for _, hash := range storeGeohashes(*previous) {
+			if !keep[hash] {
+				batch.Query("DELETE FROM stores_by_geohash WHERE geohash = ? AND store_id = ?", hash, previous.ID)
+			}
+		}
+	}
+
+	for _, hash := range current {
+		batch.Query(`INSERT INTO stores_by_geohash (geohash, store_id, area_id, name, location, latitude, longitude)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			hash, s.ID, s.AreaID, s.Name, s.Location, s.Latitude, s.Longitude)
+	}
+}
+
+// getStoresWithinRadius returns the stores within radius_m meters of lat/lon, nearest first
+func getStoresWithinRadius(c *gin.Context) {
+	lat, lon, err := parseLatLon(c, "lat", "lon")
+	if err != nil {
+		c.Error(badRequest(err.Error()))
+		return
+	}
+
+	radius, err := strconv.ParseFloat(c.Query("radius_m"), 64)
+	if err != nil || radius <= 0 || radius > maxRadiusMeters {
+		c.Error(badRequest("radius_m must be between 0 and " + strconv.Itoa(maxRadiusMeters)))
+		return
+	}
+
+	candidates, err := storesWithin(c.Request.Context(), radiusBoxes(lat, lon, radius))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	results := sortByDistance(candidates, lat, lon)
+	within := results[:0]
+	for _, r := range results {
+		if r.DistanceMeters <= radius {
+			within = append(within, r)
+		}
+	}
+
+	renderStoreList(c, within)
+}
+
+// getStoresInBoundingBox returns the stores inside the minLat/minLon/maxLat/maxLon rectangle
+func getStoresInBoundingBox(c *gin.Context) {
+	minLat, minLon, err := parseLatLon(c, "minLat", "minLon")
+	if err != nil {
+		c.Error(badRequest(err.Error()))
+		return
+	}
+	maxLat, maxLon, err := parseLatLon(c, "maxLat", "maxLon")
+	if err != nil {
+		c.Error(badRequest(err.Error()))
+		return
+	}
+	if minLat > maxLat || minLon > maxLon {
+		c.Error(badRequest("minimum coordinates must not exceed maximum coordinates"))
+		return
+	}
+
+	stores, err := storeRepo.Within(c.Request.Context(), boundingBox{MinLat: minLat, MinLon: minLon, MaxLat: maxLat, MaxLon: maxLon})
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	renderStoreList(c, stores)
+}
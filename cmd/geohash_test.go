@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestGeohashEncode(t *testing.T) {
+	tests := []struct {
+		lat, lon  float64
+		precision int
+		want      string
+	}{
+		{57.64911, 10.40744, 11, "u4pruydqqvj"},
+		{42.6, -5.6, 5, "ezs42"},
+		{0, 0, 1, "s"},
+		{-90, -180, 4, "0000"},
+		{90, 180, 4, "zzzz"},
+	}
+	for _, tt := range tests {
+		if got := geohashEncode(tt.lat, tt.lon, tt.precision); got != tt.want {
+			t.Errorf("geohashEncode(%v, %v, %d) = %q, want %q", tt.lat, tt.lon, tt.precision, got, tt.want)
+		}
+	}
+}
+
+func TestGeohashCover(t *testing.T) {
+	tests := []struct {
+		name      string
+		box       boundingBox
+		precision int
+		want      []string
+	}{
+		{"inside one cell", boundingBox{MinLat: 1, MinLon: 1, MaxLat: 2, MaxLon: 2}, 1, []string{"s"}},
+		{"across the equator and meridian", boundingBox{MinLat: -1, MinLon: -1, MaxLat: 1, MaxLon: 1}, 1, []string{"7", "e", "k", "s"}},
+		{"the whole world", boundingBox{MinLat: -90, MinLon: -180, MaxLat: 90, MaxLon: 180}, 1, strings.Split(geohashAlphabet, "")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := geohashCover(tt.box, tt.precision)
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCoveringCells(t *testing.T) {
+	tests := []struct {
+		name      string
+		box       boundingBox
+		precision int
+		err       error
+	}{
+		{"small box uses the finest cells", radiusBoxes(30, 31, 500)[0], 6, nil},
+		{"city sized box", radiusBoxes(30, 31, 50000)[0], 4, nil},
+		{"country sized box", boundingBox{MinLat: 22, MinLon: 25, MaxLat: 31, MaxLon: 35}, 2, nil},
+		{"a hemisphere is too large", boundingBox{MinLat: 0, MinLon: -180, MaxLat: 90, MaxLon: 0}, 0, errAreaTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cells, err := coveringCells(tt.box)
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if len(cells) == 0 || len(cells) > maxGeohashCells {
+				t.Fatalf("got %d cells", len(cells))
+			}
+			for _, cell := range cells {
+				if len(cell) != tt.precision {
+					t.Errorf("cell %q has precision %d, want %d", cell, len(cell), tt.precision)
+				}
+			}
+		})
+	}
+}
+
+func TestRadiusBoxes(t *testing.T) {
+	boxes := radiusBoxes(30, 31, 10000)
+	if len(boxes) != 1 {
+		t.Fatalf("got %d boxes, want 1", len(boxes))
+	}
+	box := boxes[0]
+	for _, corner := range [][2]float64{{box.MinLat, 31}, {box.MaxLat, 31}, {30, box.MinLon}, {30, box.MaxLon}} {
+		if d := haversineMeters(30, 31, corner[0], corner[1]); d < 9999 {
+			t.Errorf("edge %v is %.0f m away, inside the radius", corner, d)
+		}
+	}
+
+	polar := radiusBoxes(89.99, 0, 10000)
+	if len(polar) != 1 || polar[0].MinLon != -180 || polar[0].MaxLon != 180 || polar[0].MaxLat != 90 {
+		t.Errorf("boxes around the pole are %+v, want every meridian up to 90", polar)
+	}
+
+	tests := []struct {
+		name string
+		lon  float64
+	}{
+		{"east of the antimeridian", -179.99},
+		{"west of the antimeridian", 179.99},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			boxes := radiusBoxes(0, tt.lon, 10000)
+			if len(boxes) != 2 {
+				t.Fatalf("got boxes %+v, want one on each side", boxes)
+			}
+			if boxes[0].MinLon != -180 || boxes[1].MaxLon != 180 {
+				t.Errorf("boxes %+v do not meet at the antimeridian", boxes)
+			}
+			for _, lon := range []float64{179.95, -179.95} {
+				if !boxes[0].contains(0, lon) && !boxes[1].contains(0, lon) {
+					t.Errorf("longitude %v within the radius is in no box", lon)
+				}
+			}
+			if boxes[0].contains(0, 0) || boxes[1].contains(0, 0) {
+				t.Errorf("boxes %+v reach the prime meridian", boxes)
+			}
+		})
+	}
+}
+
+func TestStoreGeohashes(t *testing.T) {
+	got := storeGeohashes(store{Latitude: ptr(57.64911), Longitude: ptr(10.40744)})
+	if want := []string{"u4pruy", "u4pr", "u4"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := storeGeohashes(store{}); got != nil {
+		t.Errorf("store without coordinates has hashes %v", got)
+	}
+}
+
+func TestAreaQueries(t *testing.T) {
+	useMemoryRepositories(t)
+	mustCreateStores(t,
+		store{ID: 1, Name: "Center", Latitude: ptr(30.0), Longitude: ptr(31.0)},
+		store{ID: 2, Name: "Two km north", Latitude: ptr(30.018), Longitude: ptr(31.0)},
+		store{ID: 3, Name: "Far", Latitude: ptr(31.0), Longitude: ptr(31.0)},
+		store{ID: 4, Name: "Unplaced"},
+	)
+	r := newTestRouter()
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		want   []int
+	}{
+		{"radius", "/v1/stores/within?lat=30&lon=31&radius_m=1000", http.StatusOK, []int{1}},
+		{"larger radius, nearest first", "/v1/stores/within?lat=30.02&lon=31&radius_m=5000", http.StatusOK, []int{2, 1}},
+		{"radius too large", "/v1/stores/within?lat=30&lon=31&radius_m=1000000", http.StatusBadRequest, nil},
+		{"no radius", "/v1/stores/within?lat=30&lon=31", http.StatusBadRequest, nil},
+		{"bounding box", "/v1/stores/bbox?minLat=29.9&minLon=30.9&maxLat=30.1&maxLon=31.1", http.StatusOK, []int{1, 2}},
+		{"inverted bounding box", "/v1/stores/bbox?minLat=31&minLon=30.9&maxLat=30&maxLon=31.1", http.StatusBadRequest, nil},
+		{"bounding box out of range", "/v1/stores/bbox?minLat=-91&minLon=0&maxLat=0&maxLon=1", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, tt.path, "")
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var got []store
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if ids := storeIDs(got); !equalInts(ids, tt.want) {
+				t.Errorf("got %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const geoJSONContentType = "application/geo+json"
+
+// pointGeometry is a GeoJSON Point with [longitude, latitude] coordinates
+type pointGeometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// feature is an RFC 7946 Feature. Geometry is null for stores without coordinates.
+type feature struct {
+	Type       string                 `json:"type"`
+	ID         int                    `json:"id"`
+	Geometry   *pointGeometry         `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// featureCollection is an RFC 7946 FeatureCollection. NextCursor is a foreign
+// member set on paginated listings.
+type featureCollection struct {
+	Type       string    `json:"type"`
+	Features   []feature `json:"features"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// featurer is implemented by every store listing item that can be rendered as GeoJSON
+type featurer interface {
+	toFeature() feature
+}
+
+// toFeature renders the store as a Point feature with the remaining fields as properties
+func (s store) toFeature() feature {
+	f := feature{
+		Type: "Feature",
+		ID:   s.ID,
+		Properties: map[string]interface{}{
+			"areaId":   s.AreaID,
+			"name":     s.Name,
+			"location": s.Location,
+		},
+	}
+	if s.hasCoordinates() {
+		f.Geometry = &pointGeometry{Type: "Point", Coordinates: []float64{*s.Longitude, *s.Latitude}}
+	}
+	return f
+}
+
+// toFeature adds the distance from the query point to the store feature
+func (n nearbyStore) toFeature() feature {
+	f := n.store.toFeature()
+	f.Properties["distanceMeters"] = n.DistanceMeters
+	return f
+}
+
+// wantsGeoJSON reports whether the client asked for GeoJSON through the
+// format query parameter or the Accept header
+func wantsGeoJSON(c *gin.Context) bool {
+	if c.Query("format") == "geojson" {
+		return true
+	}
+	return strings.Contains(c.GetHeader("Accept"), geoJSONContentType)
+}
+
+// renderStoreList writes a store listing as a JSON array or, when negotiated,
+// as a GeoJSON FeatureCollection
+func renderStoreList[T featurer](c *gin.Context, items []T) {
+	if !wantsGeoJSON(c) {
+		c.IndentedJSON(http.StatusOK, items)
+		return
+	}
+
+	c.Header("Content-Type", geoJSONContentType)
+	c.IndentedJSON(http.StatusOK, newFeatureCollection(items))
+}
+
+// newFeatureCollection renders every item as a feature
+func newFeatureCollection[T featurer](items []T) featureCollection {
+	collection := featureCollection{Type: "FeatureCollection", Features: make([]feature, 0, len(items))}
+	for _, item := range items {
+		collection.Features = append(collection.Features, item.toFeature())
+	}
+	return collection
+}
+
+// featureInput is a GeoJSON Feature or FeatureCollection posted to /stores
+type featureInput struct {
+	Type       string         `json:"type"`
+	ID         *int           `json:"id"`
+	Geometry   *pointGeometry `json:"geometry"`
+	Properties storeInput     `json:"properties"`
+	Features   []featureInput `json:"features"`
+}
+
+// toStoreInput converts a Point feature into a store payload
+func (f featureInput) toStoreInput() (storeInput, error) {
+	if f.Type != "Feature" {
+		return storeInput{}, fmt.Errorf("expected a Feature, got %q", f.Type)
+	}
+
+	in := f.Properties
+	if f.ID != nil {
+		in.ID = *f.ID
+	}
+	if f.Geometry != nil {
+		if f.Geometry.Type != "Point" || len(f.Geometry.Coordinates) < 2 {
+			return storeInput{}, errors.New("store features must have Point geometry")
+		}
+		lon, lat := f.Geometry.Coordinates[0], f.Geometry.Coordinates[1]
+		in.Latitude, in.Longitude = &lat, &lon
+	}
+	return in, nil
+}
+
+// decodeStoreInputs parses a POST /stores body, which is a single store, a JSON
+// array of stores or a GeoJSON Feature or FeatureCollection
+func decodeStoreInputs(body []byte) ([]storeInput, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil, errors.New("request body is empty")
+	}
+
+	if trimmed[0] == '[' {
+		var inputs []storeInput
+		if err := json.Unmarshal(trimmed, &inputs); err != nil {
+			return nil, err
+		}
+		return inputs, nil
+	}
+
+	var f featureInput
+	if err := json.Unmarshal(trimmed, &f); err != nil {
+		return nil, err
+	}
+
+	switch f.Type {
+	case "":
+		var in storeInput
+		if err := json.Unmarshal(trimmed, &in); err != nil {
+			return nil, err
+		}
+		return []storeInput{in}, nil
+	case "Feature":
+		in, err := f.toStoreInput()
+		if err != nil {
+			return nil, err
+		}
+		return []storeInput{in}, nil
+	case "FeatureCollection":
+		inputs := make([]storeInput, 0, len(f.Features))
+		for i, member := range f.Features {
+			in, err := member.toStoreInput()
+			if err != nil {
+				return nil, fmt.Errorf("feature %d: %v", i, err)
+			}
+			inputs = append(inputs, in)
+		}
+		return inputs, nil
+	default:
+		return nil, errors.New("expected a store, an array of stores or a GeoJSON Feature or FeatureCollection")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDecodeStoreInputs(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []storeInput
+		err  string
+	}{
+		{"single store", `{"id":1,"name":"A","areaId":2}`, []storeInput{{ID: 1, Name: "A", AreaID: ptr(2)}}, ""},
+		{"array", ` [{"id":1,"name":"A"},{"id":2,"name":"B"}]`, []storeInput{{ID: 1, Name: "A"}, {ID: 2, Name: "B"}}, ""},
+		{"feature", `{"type":"Feature","id":3,"geometry":{"type":"Point","coordinates":[31.2,30.1]},"properties":{"name":"C"}}`,
+			[]storeInput{{ID: 3, Name: "C", Latitude: ptr(30.1), Longitude: ptr(31.2)}}, ""},
+		{"feature without geometry", `{"type":"Feature","geometry":null,"properties":{"id":4,"name":"D","areaId":1}}`,
+			[]storeInput{{ID: 4, Name: "D", AreaID: ptr(1)}}, ""},
+		{"feature collection", `{"type":"FeatureCollection","features":[
+			{"type":"Feature","id":5,"geometry":{"type":"Point","coordinates":[1,2]},"properties":{"name":"E"}},
+			{"type":"Feature","id":6,"geometry":null,"properties":{"name":"F"}}]}`,
+			[]storeInput{{ID: 5, Name: "E", Latitude: ptr(2.0), Longitude: ptr(1.0)}, {ID: 6, Name: "F"}}, ""},
+		{"empty", "  ", nil, "request body is empty"},
+		{"point without latitude", `{"type":"Feature","geometry":{"type":"Point","coordinates":[1]},"properties":{}}`, nil, "Point geometry"},
+		{"collection member that is not a feature", `{"type":"FeatureCollection","features":[{"type":"Point"}]}`, nil, "feature 0"},
+		{"unknown type", `{"type":"Polygon"}`, nil, "expected a store"},
+		{"malformed", `{"id":`, nil, "unexpected end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeStoreInputs([]byte(tt.body))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("got %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestStoreToFeature(t *testing.T) {
+	placed := store{ID: 1, AreaID: 2, Name: "A", Location: "Main St", Latitude: ptr(30.1), Longitude: ptr(31.2)}
+	f := nearbyStore{store: placed, DistanceMeters: 12.5}.toFeature()
+	if f.Type != "Feature" || f.ID != 1 {
+		t.Errorf("got %+v", f)
+	}
+	if f.Geometry == nil || f.Geometry.Coordinates[0] != 31.2 || f.Geometry.Coordinates[1] != 30.1 {
+		t.Errorf("geometry %+v, want [longitude, latitude]", f.Geometry)
+	}
+	if f.Properties["areaId"] != 2 || f.Properties["distanceMeters"] != 12.5 {
+		t.Errorf("properties %v", f.Properties)
+	}
+
+	if f := (store{ID: 2, Name: "Unplaced"}).toFeature(); f.Geometry != nil {
+		t.Errorf("store without coordinates has geometry %+v", f.Geometry)
+	}
+}
+
+func TestGeoJSONListings(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	mustCreateStores(t,
+		store{ID: 1, AreaID: 1, Name: "A", Latitude: ptr(1.0), Longitude: ptr(1.0)},
+		store{ID: 2, AreaID: 1, Name: "B"},
+	)
+	r := newTestRouter()
+
+	tests := []struct {
+		name     string
+		path     string
+		accept   string
+		geoJSON  bool
+		features int
+	}{
+		{"listing", "/v1/stores", "", false, 0},
+		{"listing by format", "/v1/stores?format=geojson", "", true, 2},
+		{"listing by Accept", "/v1/stores", geoJSONContentType, true, 2},
+		{"area listing", "/v1/stores/area/1?format=geojson", "", true, 2},
+		{"nearby", "/v1/stores/nearby?lat=0&lon=0", geoJSONContentType, true, 1},
+		{"bounding box", "/v1/stores/bbox?minLat=0&minLon=0&maxLat=2&maxLon=2&format=geojson", "", true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, tt.path, "", "Accept", tt.accept)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			isGeoJSON := strings.HasPrefix(w.Header().Get("Content-Type"), geoJSONContentType)
+			if isGeoJSON != tt.geoJSON {
+				t.Fatalf("Content-Type %q", w.Header().Get("Content-Type"))
+			}
+			if !tt.geoJSON {
+				return
+			}
+			var collection featureCollection
+			if err := json.Unmarshal(w.Body.Bytes(), &collection); err != nil {
+				t.Fatal(err)
+			}
+			if collection.Type != "FeatureCollection" || len(collection.Features) != tt.features {
+				t.Errorf("got %s with %d features, want %d", collection.Type, len(collection.Features), tt.features)
+			}
+		})
+	}
+}
+
+func TestPostFeatureCollection(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRouter()
+
+	w := serve(r, http.MethodPost, "/v1/stores", `{"type":"FeatureCollection","features":[
+		{"type":"Feature","id":1,"geometry":{"type":"Point","coordinates":[2,1]},"properties":{"name":"A"}},
+		{"type":"Feature","id":2,"geometry":{"type":"Point","coordinates":[3,4]},"properties":{"name":"B"}}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	s, err := storeRepo.Get(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *s.Latitude != 1 || *s.Longitude != 2 || s.AreaID != 1 {
+		t.Errorf("created %+v", s)
+	}
+}
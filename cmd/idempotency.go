@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// maxIdempotencyKeyLength bounds the keys clients may send
+	maxIdempotencyKeyLength = 255
+	// idempotencyClaimTTL releases the key of a request the server never
+	// finished, such as when it stopped mid-request
+	idempotencyClaimTTL = 5 * time.Minute
+	// idempotencyClaimRenewal is how often a running request extends its
+	// claim, so requests longer than idempotencyClaimTTL keep the key
+	idempotencyClaimRenewal = idempotencyClaimTTL / 5
+	// maxReplayBodySize bounds the response stored for replay. Larger
+	// responses are replaced by the summary the handler set, if any.
+	maxReplayBodySize = 256 << 10
+	// replaySummaryKey is the context key of that summary
+	replaySummaryKey = "idempotency.summary"
+)
+
+var errClaimLost = errors.New("the idempotency key is no longer held by this request")
+
+// idempotencyRecord is what is remembered of a request sent with an
+// Idempotency-Key. Claim identifies the request holding the key; the hash of
+// the request and its response are stored once it has finished, and Status is
+// 0 until then.
+type idempotencyRecord struct {
+	Key         string
+	Claim       string
+	RequestHash string
+	Status      int
+	ContentType string
+	Location    string
+	Body        []byte
+}
+
+// newClaim returns a token no other request holds
+func newClaim() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newRequestHash starts the hash identifying what a request asks for, so a
+// key reused for a different request is told apart from a retry. The body is
+// written to it as it is read. The /v1 prefix is left out because the
+// unversioned route does the same thing.
+func newRequestHash(c *gin.Context) hash.Hash {
+	h := sha256.New()
+	io.WriteString(h, c.Request.Method+" "+strings.TrimPrefix(c.FullPath(), apiVersionPrefix)+"?"+c.Request.URL.RawQuery+"\n")
+	io.WriteString(h, c.ContentType()+"\n")
+	return h
+}
+
+// setReplaySummary gives the bounded form of a response, stored for replay
+// in place of a response too large to store
+func setReplaySummary(c *gin.Context, summary interface{}) {
+	c.Set(replaySummaryKey, summary)
+}
+
+// recordingWriter keeps a copy of the response body as it is written, up to
+// maxReplayBodySize
+type recordingWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *recordingWriter) record(n int, write func()) {
+	if w.overflow || w.body.Len()+n > maxReplayBodySize {
+		w.overflow = true
+		w.body.Reset()
+		return
+	}
+	write()
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.record(len(b), func() { w.body.Write(b) })
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.record(len(s), func() { w.body.WriteString(s) })
+	return w.ResponseWriter.WriteString(s)
+}
+
+// replayBody is the response body to store: the body itself when it fit,
+// otherwise the handler's summary
+func (w *recordingWriter) replayBody(c *gin.Context) (string, []byte) {
+	if !w.overflow {
+		return w.Header().Get("Content-Type"), w.body.Bytes()
+	}
+	if summary, ok := c.Get(replaySummaryKey); ok {
+		if data, err := json.Marshal(summary); err == nil && len(data) <= maxReplayBodySize {
+			return "application/json; charset=utf-8", data
+		}
+	}
+	data, _ := json.Marshal(gin.H{"detail": "the response was too large to store; read the stores to see the outcome"})
+	return "application/json; charset=utf-8", data
+}
+
+// hashedBody feeds a request body to the request hash as the handler reads it
+type hashedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// idempotent replays the response to a request retried with the same
+// Idempotency-Key instead of running it again. A key reused with a different
+// request is rejected with 422, and a retry arriving while the first attempt
+// still runs with 409. Requests without the header run as usual.
+//
+// Bodies are hashed while they stream rather than held in memory, so the
+// first request is told apart from a different one only once it has run.
+func idempotent(c *gin.Context) {
+	key := c.GetHeader(idempotencyKeyHeader)
+	if key == "" {
+		c.Next()
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		c.Error(badRequest(idempotencyKeyHeader + " is too long"))
+		c.Abort()
+		return
+	}
+
+	claim, err := newClaim()
+	if err != nil {
+		c.Error(err)
+		c.Abort()
+		return
+	}
+	rec := idempotencyRecord{Key: key, Claim: claim}
+	held, claimed, err := idempotencyRepo.Claim(c.Request.Context(), rec)
+	if err != nil {
+		c.Error(err)
+		c.Abort()
+		return
+	}
+	h := newRequestHash(c)
+	if !claimed {
+		if held.Status == 0 {
+			c.Error(conflict("a request with this " + idempotencyKeyHeader + " is still in progress"))
+			c.Abort()
+			return
+		}
+		if _, err := io.Copy(h, c.Request.Body); err != nil {
+			c.Error(decodeError(err))
+			c.Abort()
+			return
+		}
+		if hex.EncodeToString(h.Sum(nil)) != held.RequestHash {
+			c.Error(&apiError{
+				Status: http.StatusUnprocessableEntity,
+				Code:   errCodeIdempotencyReuse,
+				Detail: idempotencyKeyHeader + " was already used for a different request",
+			})
+		} else {
+			replayResponse(c, held)
+		}
+		c.Abort()
+		return
+	}
+
+	// The client may be gone before the request is done, which is when a
+	// retry is most likely
+	ctx := context.WithoutCancel(c.Request.Context())
+	stop := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		renewClaim(ctx, rec, idempotencyClaimRenewal, stop)
+	}()
+
+	body := c.Request.Body
+	c.Request.Body = hashedBody{Reader: io.TeeReader(body, h), Closer: body}
+	w := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+	close(stop)
+	<-renewed
+
+	release := func() {
+		if err := idempotencyRepo.Release(ctx, rec); err != nil {
+			log.Printf("releasing %s %q: %v", idempotencyKeyHeader, key, err)
+		}
+	}
+
+	// Errors the handler left to the error middleware and server failures are
+	// not stored, so a retry runs the request again
+	if !w.Written() || w.Status() >= http.StatusInternalServerError {
+		release()
+		return
+	}
+	// Whatever the handler left unread still identifies the request
+	if _, err := io.Copy(h, body); err != nil {
+		release()
+		return
+	}
+
+	rec.RequestHash = hex.EncodeToString(h.Sum(nil))
+	rec.Status = w.Status()
+	rec.Location = w.Header().Get("Location")
+	rec.ContentType, rec.Body = w.replayBody(c)
+	// A key left claimed would answer every retry with 409 until it expires
+	if err := idempotencyRepo.Complete(ctx, rec); err != nil {
+		log.Printf("storing the response to %s %q: %v", idempotencyKeyHeader, key, err)
+		release()
+	}
+}
+
+// renewClaim extends the claim on the request's key every interval until stop
+// is closed. A claim that was lost, because renewals failed until it expired,
+// is logged, as a retry may then run the request a second time.
+func renewClaim(ctx context.Context, rec idempotencyRecord, every time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		held, err := idempotencyRepo.Renew(ctx, rec)
+		switch {
+		case err != nil:
+			log.Printf("renewing %s %q: %v", idempotencyKeyHeader, rec.Key, err)
+		case !held:
+			log.Printf("renewing %s %q: %v", idempotencyKeyHeader, rec.Key, errClaimLost)
+			return
+		}
+	}
+}
+
+// replayResponse writes a stored response again, marked as a replay
+func replayResponse(c *gin.Context, rec idempotencyRecord) {
+	if rec.Location != "" {
+		c.Header("Location", rec.Location)
+	}
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(rec.Status, rec.ContentType, rec.Body)
+}
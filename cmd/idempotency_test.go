@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIdempotentStores(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	claim, err := newClaim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := idempotencyRepo.Claim(context.Background(), idempotencyRecord{Key: "running", Claim: claim}); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRouter()
+	create := `{"name":"A","areaId":1}`
+
+	// Each case runs against the keys the previous ones left
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		key      string
+		status   int
+		replayed bool
+		code     string
+	}{
+		{"first request", "/v1/stores", create, "k1", http.StatusCreated, false, ""},
+		{"retry", "/v1/stores", create, "k1", http.StatusCreated, true, ""},
+		{"retry on the legacy route", "/stores", create, "k1", http.StatusCreated, true, ""},
+		{"different body", "/v1/stores", `{"name":"B","areaId":1}`, "k1", http.StatusUnprocessableEntity, false, errCodeIdempotencyReuse},
+		{"different query", "/v1/stores?x=1", create, "k1", http.StatusUnprocessableEntity, false, errCodeIdempotencyReuse},
+		{"different route", "/v1/stores/import?format=ndjson", create, "k1", http.StatusUnprocessableEntity, false, errCodeIdempotencyReuse},
+		{"invalid request is not stored", "/v1/stores", `{"areaId":1}`, "k2", http.StatusBadRequest, false, errCodeValidation},
+		{"corrected request runs", "/v1/stores", `{"name":"C","areaId":1}`, "k2", http.StatusCreated, false, ""},
+		{"request in progress", "/v1/stores", create, "running", http.StatusConflict, false, errCodeConflict},
+		{"key too long", "/v1/stores", create, strings.Repeat("k", maxIdempotencyKeyLength+1), http.StatusBadRequest, false, errCodeBadRequest},
+		{"no key", "/v1/stores", create, "", http.StatusCreated, false, ""},
+	}
+	var first *httptest.ResponseRecorder
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var headers []string
+			if tt.key != "" {
+				headers = []string{idempotencyKeyHeader, tt.key}
+			}
+			w := serve(r, http.MethodPost, tt.path, tt.body, headers...)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := w.Header().Get("Idempotent-Replayed") == "true"; got != tt.replayed {
+				t.Errorf("replayed %v, want %v", got, tt.replayed)
+			}
+			if first == nil {
+				first = w
+			}
+			if tt.replayed {
+				if w.Body.String() != first.Body.String() || w.Header().Get("Location") != first.Header().Get("Location") {
+					t.Errorf("replay differs from the first response:\n%s\n%s", w.Body, first.Body)
+				}
+			}
+			if tt.code != "" {
+				var p problem
+				if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || p.Code != tt.code {
+					t.Errorf("got %s, want a %s problem", w.Body, tt.code)
+				}
+			}
+		})
+	}
+
+	stores, err := allStores(context.Background(), storeRepo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stores) != 3 {
+		t.Errorf("%d stores were created, want one each for k1, k2 and no key", len(stores))
+	}
+}
+
+// failingCompletes cannot store responses
+type failingCompletes struct {
+	IdempotencyRepository
+}
+
+func (failingCompletes) Complete(ctx context.Context, rec idempotencyRecord) error {
+	return errors.New("write timed out")
+}
+
+func TestIdempotentReleasesKeyWhenCompleteFails(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	idempotencyRepo = failingCompletes{IdempotencyRepository: idempotencyRepo}
+	r := newTestRouter()
+
+	for i, name := range []string{"A", "B"} {
+		w := serve(r, http.MethodPost, "/v1/stores", `{"name":"`+name+`","areaId":1}`, idempotencyKeyHeader, "k1")
+		if w.Code != http.StatusCreated {
+			t.Fatalf("request %d: status %d, want %d: %s", i, w.Code, http.StatusCreated, w.Body)
+		}
+	}
+}
+
+func TestMemoryIdempotencyClaims(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryIdempotencyRepository(time.Hour)
+	mine := idempotencyRecord{Key: "k1", Claim: "mine"}
+	if _, claimed, err := repo.Claim(ctx, mine); err != nil || !claimed {
+		t.Fatalf("claim: %v, %v", claimed, err)
+	}
+	other := idempotencyRecord{Key: "k1", Claim: "other"}
+
+	if held, err := repo.Renew(ctx, mine); err != nil || !held {
+		t.Errorf("renewing the claim: %v, %v", held, err)
+	}
+	if held, _ := repo.Renew(ctx, other); held {
+		t.Error("another claim renewed the key")
+	}
+	if err := repo.Complete(ctx, other); err != errClaimLost {
+		t.Errorf("completing another claim: got %v, want errClaimLost", err)
+	}
+	mine.Status = http.StatusCreated
+	if err := repo.Complete(ctx, mine); err != nil {
+		t.Errorf("completing the claim: %v", err)
+	}
+}
+
+// countingRenewals counts renewals and loses the claim after the last one
+type countingRenewals struct {
+	IdempotencyRepository
+	mu       sync.Mutex
+	renewals int
+	last     int
+}
+
+func (r *countingRenewals) Renew(ctx context.Context, rec idempotencyRecord) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.renewals++
+	return r.renewals < r.last, nil
+}
+
+func TestRenewClaim(t *testing.T) {
+	useMemoryRepositories(t)
+	repo := &countingRenewals{IdempotencyRepository: idempotencyRepo, last: 3}
+	idempotencyRepo = repo
+
+	// Renewal stops once the claim is lost, without waiting for stop
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		renewClaim(context.Background(), idempotencyRecord{Key: "k1"}, time.Millisecond, make(chan struct{}))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("renewal did not stop after the claim was lost")
+	}
+	if repo.renewals != repo.last {
+		t.Errorf("renewed %d times, want %d", repo.renewals, repo.last)
+	}
+}
+
+func TestIdempotentImport(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRouter()
+	body := "id,areaId,name\n1,1,A\n"
+
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		replayed bool
+	}{
+		{"first import", body, http.StatusOK, false},
+		{"retry replays the first summary", body, http.StatusOK, true},
+		{"different file", "id,areaId,name\n2,1,B\n", http.StatusUnprocessableEntity, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodPost, "/v1/stores/import?format=csv", tt.body, idempotencyKeyHeader, "import-1")
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := w.Header().Get("Idempotent-Replayed") == "true"; got != tt.replayed {
+				t.Errorf("replayed %v, want %v", got, tt.replayed)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var summary importSummary
+			if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+				t.Fatal(err)
+			}
+			if summary.Created != 1 {
+				t.Errorf("got %+v, want the summary of the first import", summary)
+			}
+		})
+	}
+}
+
+func TestIdempotentReplayOfLargeResponse(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRouter()
+
+	var items []string
+	for i := 0; i < 3000; i++ {
+		items = append(items, `{"name":"Store `+strconv.Itoa(i)+`","areaId":1}`)
+	}
+	body := "[" + strings.Join(items, ",") + "]"
+
+	w := serve(r, http.MethodPost, "/v1/stores", body, idempotencyKeyHeader, "large")
+	if w.Code != http.StatusCreated || w.Body.Len() <= maxReplayBodySize {
+		t.Fatalf("status %d with %d bytes, want 201 over %d bytes", w.Code, w.Body.Len(), maxReplayBodySize)
+	}
+
+	w = serve(r, http.MethodPost, "/v1/stores", body, idempotencyKeyHeader, "large")
+	if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry: status %d, replayed %q", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	var resp bulkResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Created != len(items) || len(resp.Results) != len(items) {
+		t.Fatalf("replayed summary reports %d created and %d results", resp.Created, len(resp.Results))
+	}
+	if resp.Results[0].Store != nil || resp.Results[0].ID == 0 {
+		t.Errorf("replayed result %+v, want the summary form", resp.Results[0])
+	}
+}
+
+func TestRecordingWriterReplayBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		writes  []int
+		summary interface{}
+		want    string
+	}{
+		{"fits", []int{10, 20}, nil, strings.Repeat("x", 30)},
+		{"too large with a summary", []int{maxReplayBodySize, 1}, gin.H{"created": 2}, `{"created":2}`},
+		{"too large without a summary", []int{maxReplayBodySize + 1}, nil, "too large to store"},
+		{"summary too large", []int{maxReplayBodySize + 1}, strings.Repeat("s", maxReplayBodySize), "too large to store"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			w := &recordingWriter{ResponseWriter: c.Writer}
+			for i, n := range tt.writes {
+				if i%2 == 0 {
+					w.Write([]byte(strings.Repeat("x", n)))
+				} else {
+					w.WriteString(strings.Repeat("x", n))
+				}
+			}
+			if tt.summary != nil {
+				setReplaySummary(c, tt.summary)
+			}
+			_, body := w.replayBody(c)
+			if !strings.Contains(string(body), tt.want) {
+				t.Errorf("stored %.80q, want %.80q", body, tt.want)
+			}
+			if len(body) > maxReplayBodySize {
+				t.Errorf("stored %d bytes", len(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// importWindow is how many records are validated and written at a time
+	importWindow = 320
+	// maxNDJSONLine bounds the length of one NDJSON record
+	maxNDJSONLine = 1 << 20
+	// maxImportBodySize caps an upload, which is streamed rather than held
+	// in memory
+	maxImportBodySize = 256 << 20
+)
+
+// csvColumns are the export columns, which the import also understands
+var csvColumns = []string{"id", "areaId", "name", "location", "latitude", "longitude"}
+
+// csvHeaderAliases maps normalized spreadsheet headers to store fields
+var csvHeaderAliases = map[string]string{
+	"id":        "id",
+	"storeid":   "id",
+	"areaid":    "areaId",
+	"area":      "areaId",
+	"name":      "name",
+	"storename": "name",
+	"location":  "location",
+	"address":   "location",
+	"latitude":  "latitude",
+	"lat":       "latitude",
+	"longitude": "longitude",
+	"lon":       "longitude",
+	"lng":       "longitude",
+}
+
+// normalizeHeader folds case and drops spaces, underscores and dashes
+func normalizeHeader(h string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '_' || r == '-' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(h)))
+}
+
+// importRecord is one decoded record of an import, or why it could not be decoded
+type importRecord struct {
+	input storeInput
+	err   error
+}
+
+// recordReader yields import records until io.EOF
+type recordReader interface {
+	next() (importRecord, error)
+}
+
+// csvRecordReader decodes CSV rows using the column of each field found in the header
+type csvRecordReader struct {
+	r       *csv.Reader
+	columns map[string]int
+}
+
+// newCSVRecordReader reads the header row. mapping, as "header:field" pairs,
+// names the field of headers the aliases do not cover.
+func newCSVRecordReader(body io.Reader, mapping string) (*csvRecordReader, error) {
+	fields := make(map[string]string, len(csvHeaderAliases))
+	for header, field := range csvHeaderAliases {
+		fields[header] = field
+	}
+	for _, pair := range splitList(mapping) {
+		header, field, ok := strings.Cut(pair, ":")
+		canonical, known := csvHeaderAliases[normalizeHeader(field)]
+		if !ok || !known {
+			return nil, fmt.Errorf("invalid map entry %q, expected header:field", pair)
+		}
+		fields[normalizeHeader(header)] = canonical
+	}
+
+	r := csv.NewReader(body)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+
+	columns := make(map[string]int)
+	for i, h := range header {
+		field, ok := fields[normalizeHeader(h)]
+		if !ok {
+			continue
+		}
+		if _, dup := columns[field]; dup {
+			return nil, fmt.Errorf("more than one column maps to %s", field)
+		}
+		columns[field] = i
+	}
+	if _, ok := columns["id"]; !ok {
+		return nil, errors.New("CSV header has no id column")
+	}
+	return &csvRecordReader{r: r, columns: columns}, nil
+}
+
+func (cr *csvRecordReader) next() (importRecord, error) {
+	row, err := cr.r.Read()
+	if err == io.EOF {
+		return importRecord{}, io.EOF
+	}
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) && parseErr.Err == csv.ErrFieldCount {
+		err = nil
+	}
+	if err != nil {
+		// A malformed row leaves the rest of the stream unreadable
+		return importRecord{}, err
+	}
+
+	cell := func(field string) string {
+		if i, ok := cr.columns[field]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	number := func(field string) (*float64, error) {
+		v := cell(field)
+		if v == "" {
+			return nil, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q is not a number", field, v)
+		}
+		return &f, nil
+	}
+
+	var in storeInput
+	id, err := strconv.Atoi(cell("id"))
+	if err != nil {
+		return importRecord{err: fmt.Errorf("id %q is not an integer", cell("id"))}, nil
+	}
+	in.ID = id
+	if v := cell("areaId"); v != "" {
+		areaID, err := strconv.Atoi(v)
+		if err != nil {
+			return importRecord{input: in, err: fmt.Errorf("areaId %q is not an integer", v)}, nil
+		}
+		in.AreaID = &areaID
+	}
+	in.Name = cell("name")
+	in.Location = cell("location")
+	if in.Latitude, err = number("latitude"); err != nil {
+		return importRecord{input: in, err: err}, nil
+	}
+	if in.Longitude, err = number("longitude"); err != nil {
+		return importRecord{input: in, err: err}, nil
+	}
+	return importRecord{input: in}, nil
+}
+
+// ndjsonRecordReader decodes one store object per line, skipping blank lines
+type ndjsonRecordReader struct {
+	s *bufio.Scanner
+}
+
+func newNDJSONRecordReader(body io.Reader) *ndjsonRecordReader {
+	s := bufio.NewScanner(body)
+	s.Buffer(make([]byte, 0, 64*1024), maxNDJSONLine)
+	return &ndjsonRecordReader{s: s}
+}
+
+func (nr *ndjsonRecordReader) next() (importRecord, error) {
+	for nr.s.Scan() {
+		line := strings.TrimSpace(nr.s.Text())
+		if line == "" {
+			continue
+		}
+		var in storeInput
+		if err := json.Unmarshal([]byte(line), &in); err != nil {
+			return importRecord{err: err}, nil
+		}
+		return importRecord{input: in}, nil
+	}
+	if err := nr.s.Err(); err != nil {
+		return importRecord{}, err
+	}
+	return importRecord{}, io.EOF
+}
+
+// importIssue is a record that was not imported
+type importIssue struct {
+	Record int          `json:"record"`
+	ID     int          `json:"id,omitempty"`
+	Status string       `json:"status"`
+	Error  string       `json:"error"`
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+// importChange is a record a dry run would write
+type importChange struct {
+	Record int    `json:"record"`
+	ID     int    `json:"id"`
+	Action string `json:"action"`
+}
+
+// importSummary is the body of POST /stores/import. Records are numbered from
+// 1, not counting a CSV header.
+type importSummary struct {
+	DryRun    bool           `json:"dry_run"`
+	Records   int            `json:"records"`
+	Created   int            `json:"created"`
+	Updated   int            `json:"updated"`
+	Unchanged int            `json:"unchanged"`
+	Invalid   int            `json:"invalid"`
+	Conflict  int            `json:"conflict"`
+	Failed    int            `json:"failed"`
+	Changes   []importChange `json:"changes,omitempty"`
+	Issues    []importIssue  `json:"issues"`
+}
+
+// maxSummaryItems bounds the changes and issues of a compact summary
+const maxSummaryItems = 100
+
+// compact keeps the counts but only the first changes and issues, replayed to
+// retries when the full summary is too large to store
+func (s importSummary) compact() importSummary {
+	if len(s.Changes) > maxSummaryItems {
+		s.Changes = s.Changes[:maxSummaryItems]
+	}
+	if len(s.Issues) > maxSummaryItems {
+		s.Issues = s.Issues[:maxSummaryItems]
+	}
+	return s
+}
+
+// sameStore reports whether two stores hold the same values
+func sameStore(a, b store) bool {
+	return a.ID == b.ID && a.AreaID == b.AreaID && a.Name == b.Name && a.Location == b.Location &&
+		sameFloat(a.Latitude, b.Latitude) && sameFloat(a.Longitude, b.Longitude)
+}
+
+// sameFloat reports whether two optional coordinates are equal
+func sameFloat(x, y *float64) bool {
+	return (x == nil && y == nil) || (x != nil && y != nil && *x == *y)
+}
+
+// importStores reads records window by window, validates them, compares them
+// with the stored rows and writes the ones that change
+func importStores(ctx context.Context, records recordReader, dryRun bool) (importSummary, error) {
+	summary := importSummary{DryRun: dryRun, Issues: []importIssue{}}
+	for done := false; !done; {
+		var window []importRecord
+		for len(window) < importWindow {
+			rec, err := records.next()
+			if err == io.EOF {
+				done = true
+				break
+			}
+			if err != nil {
+				return summary, fmt.Errorf("record %d: %w", summary.Records+len(window)+1, err)
+			}
+			window = append(window, rec)
+		}
+		if err := importWindowRecords(ctx, window, summary.Records, dryRun, &summary); err != nil {
+			return summary, err
+		}
+		summary.Records += len(window)
+	}
+	return summary, nil
+}
+
+// importWindowRecords imports one window of records numbered from offset+1
+func importWindowRecords(ctx context.Context, window []importRecord, offset int, dryRun bool, summary *importSummary) error {
+	issue := func(i int, id int, status, msg string, errs []fieldError) {
+		summary.Issues = append(summary.Issues, importIssue{Record: offset + i + 1, ID: id, Status: status, Error: msg, Errors: errs})
+		switch status {
+		case bulkInvalid:
+			summary.Invalid++
+		case bulkConflict:
+			summary.Conflict++
+		default:
+			summary.Failed++
+		}
+	}
+
+	// Records that could not be decoded never reach validation
+	var inputs []storeInput
+	var positions []int
+	for i, rec := range window {
+		if rec.err != nil {
+			issue(i, rec.input.ID, bulkInvalid, rec.err.Error(), nil)
+			continue
+		}
+		if err := requireID(rec.input); err != nil {
+			issue(i, 0, bulkInvalid, err.Error(), fieldErrors(err))
+			continue
+		}
+		inputs = append(inputs, rec.input)
+		positions = append(positions, i)
+	}
+
+	results := make([]bulkResult, len(inputs))
+	items := validateBulk(ctx, inputs, results)
+
+	// Only stores that differ from the stored row are written, and only if
+	// that row is still what was compared when the write happens
+	var changed []bulkItem
+	actions := make(map[int]string, len(items))
+	versions := make(map[int]int64, len(items))
+	for _, item := range items {
+		current, err := storeRepo.Get(ctx, item.store.ID)
+		switch {
+		case errors.Is(err, errStoreNotFound):
+			actions[item.index] = "create"
+		case err != nil:
+			results[item.index].Status = bulkFailed
+			results[item.index].Error = failureDetail(err)
+			continue
+		case sameStore(current, item.store):
+			summary.Unchanged++
+			continue
+		default:
+			actions[item.index] = "update"
+			versions[item.index] = current.Version
+		}
+		changed = append(changed, item)
+	}
+
+	if dryRun {
+		for _, item := range changed {
+			summary.Changes = append(summary.Changes, importChange{
+				Record: offset + positions[item.index] + 1,
+				ID:     item.store.ID,
+				Action: actions[item.index],
+			})
+			if actions[item.index] == "create" {
+				summary.Created++
+			} else {
+				summary.Updated++
+			}
+		}
+	} else {
+		writeImport(ctx, changed, versions, results)
+	}
+
+	for i, r := range results {
+		switch r.Status {
+		case bulkInvalid, bulkConflict, bulkFailed:
+			issue(positions[i], r.ID, r.Status, r.Error, r.Errors)
+		case bulkCreated:
+			if actions[i] == "create" {
+				summary.Created++
+			} else {
+				summary.Updated++
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// writeImport writes the changed stores, at most bulkParallelism at a time,
+// and records each item's outcome. Items with a version in versions update the
+// store only if it still has that version; the others create it only if its ID
+// is still free. A store written by someone else since it was compared is
+// reported as a conflict rather than overwritten.
+func writeImport(ctx context.Context, items []bulkItem, versions map[int]int64, results []bulkResult) {
+	sem := make(chan struct{}, bulkParallelism)
+	var wg sync.WaitGroup
+
+	for _, item := range items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(item bulkItem) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			s := item.store
+			var err error
+			if version, ok := versions[item.index]; ok {
+				s, _, err = storeRepo.Update(ctx, s, version)
+			} else {
+				err = storeRepo.Create(ctx, s)
+			}
+
+			// Each goroutine owns a distinct index of results
+			result := &results[item.index]
+			switch {
+			case errors.Is(err, errStoreExists):
+				result.Status = bulkConflict
+				result.Error = "store " + strconv.Itoa(item.store.ID) + " was created during the import"
+			case errors.Is(err, errVersionConflict), errors.Is(err, errStoreNotFound):
+				result.Status = bulkConflict
+				result.Error = "store " + strconv.Itoa(item.store.ID) + " was changed during the import"
+			case err != nil:
+				result.Status = bulkFailed
+				result.Error = failureDetail(err)
+			default:
+				result.Status = bulkCreated
+				result.Store = &s
+			}
+		}(item)
+	}
+	wg.Wait()
+}
+
+// importFormat picks csv or ndjson from ?format or the Content-Type
+func importFormat(c *gin.Context) string {
+	if format := c.Query("format"); format != "" {
+		return format
+	}
+	mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+	switch mediaType {
+	case "text/csv":
+		return "csv"
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return "ndjson"
+	}
+	return ""
+}
+
+// postStoreImport streams a CSV or NDJSON upload into the repository.
+// ?dry_run=true reports what would change without writing.
+func postStoreImport(c *gin.Context) {
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		c.Error(badRequest("invalid dry_run"))
+		return
+	}
+
+	var records recordReader
+	switch importFormat(c) {
+	case "csv":
+		records, err = newCSVRecordReader(c.Request.Body, c.Query("map"))
+		if err != nil {
+			c.Error(decodeError(err))
+			return
+		}
+	case "ndjson":
+		records = newNDJSONRecordReader(c.Request.Body)
+	default:
+		c.Error(unsupportedMediaType("send text/csv or application/x-ndjson, or set format=csv|ndjson"))
+		return
+	}
+
+	summary, err := importStores(c.Request.Context(), records, dryRun)
+	if err != nil {
+		// Records before the unreadable one have been imported
+		e := decodeError(err)
+		e.Result = summary
+		c.Error(e)
+		return
+	}
+
+	setReplaySummary(c, summary.compact())
+
+	status := http.StatusOK
+	if summary.Invalid+summary.Conflict+summary.Failed > 0 && summary.Created+summary.Updated+summary.Unchanged > 0 {
+		status = http.StatusMultiStatus
+	}
+	c.IndentedJSON(status, summary)
+}
+
+// storeWriter streams stores in an export format
+type storeWriter interface {
+	write(s store) error
+	flush() error
+}
+
+type csvStoreWriter struct {
+	w *csv.Writer
+}
+
+func (cw csvStoreWriter) write(s store) error {
+	formatFloat := func(f *float64) string {
+		if f == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*f, 'f', -1, 64)
+	}
+	return cw.w.Write([]string{
+		strconv.Itoa(s.ID), strconv.Itoa(s.AreaID), s.Name, s.Location,
+		formatFloat(s.Latitude), formatFloat(s.Longitude),
+	})
+}
+
+func (cw csvStoreWriter) flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type ndjsonStoreWriter struct {
+	enc *json.Encoder
+}
+
+func (nw ndjsonStoreWriter) write(s store) error { return nw.enc.Encode(s) }
+
+func (nw ndjsonStoreWriter) flush() error { return nil }
+
+// exportContentTypes are the media types of the export formats
+var exportContentTypes = map[string]string{
+	"csv":    "text/csv; charset=utf-8",
+	"ndjson": "application/x-ndjson",
+}
+
+// newStoreWriter returns a writer for format, writing the CSV header row first
+func newStoreWriter(format string, w io.Writer) (storeWriter, error) {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvColumns); err != nil {
+			return nil, err
+		}
+		return csvStoreWriter{w: cw}, nil
+	case "ndjson":
+		return ndjsonStoreWriter{enc: json.NewEncoder(w)}, nil
+	default:
+		return nil, errors.New("format must be csv or ndjson")
+	}
+}
+
+// copyStores writes an already read first page and then every following page,
+// calling afterPage, when set, once each page is flushed
+func copyStores(ctx context.Context, out storeWriter, stores []store, next pageCursor, afterPage func()) error {
+	for {
+		for _, s := range stores {
+			if err := out.write(s); err != nil {
+				return err
+			}
+		}
+		if err := out.flush(); err != nil {
+			return err
+		}
+		if afterPage != nil {
+			afterPage()
+		}
+
+		if next.encode() == "" {
+			return nil
+		}
+		var err error
+		stores, next, err = storeRepo.List(ctx, maxPageSize, next)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// exportStores streams every store, page by page, in CSV or NDJSON
+func exportStores(c *gin.Context) {
+	format := c.DefaultQuery("format", "ndjson")
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		c.Error(badRequest("format must be csv or ndjson"))
+		return
+	}
+
+	// Read the first page before committing to a streamed response
+	ctx := c.Request.Context()
+	stores, next, err := storeRepo.List(ctx, maxPageSize, pageCursor{})
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", `attachment; filename="stores.`+format+`"`)
+	c.Status(http.StatusOK)
+
+	out, err := newStoreWriter(format, c.Writer)
+	if err == nil {
+		err = copyStores(ctx, out, stores, next, c.Writer.Flush)
+	}
+	// Headers are already sent, so a failure can only end the stream early
+	if err != nil {
+		log.Printf("Export aborted: %v", err)
+	}
+}
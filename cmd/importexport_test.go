@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// readRecords reads every record, returning the records and the error that ended them
+func readRecords(r recordReader) ([]importRecord, error) {
+	var records []importRecord
+	for {
+		rec, err := r.next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestCSVRecordReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		mapping string
+		want    []storeInput
+		errs    []string
+	}{
+		{"export columns", "id,areaId,name,location,latitude,longitude\n1,2,A,Main St,30.5,31.25\n",
+			"", []storeInput{{ID: 1, AreaID: ptr(2), Name: "A", Location: "Main St", Latitude: ptr(30.5), Longitude: ptr(31.25)}}, []string{""}},
+		{"aliases in another order", "Store Name, Store_ID, lng, LAT, Address\nB, 3, 31, 30, \"Hill Rd, 4\"\n",
+			"", []storeInput{{ID: 3, Name: "B", Location: "Hill Rd, 4", Latitude: ptr(30.0), Longitude: ptr(31.0)}}, []string{""}},
+		{"mapping", "code,title,zone\n4,C,1\n",
+			"code:id, title:name, zone:areaId", []storeInput{{ID: 4, Name: "C", AreaID: ptr(1)}}, []string{""}},
+		{"unknown columns are ignored and short rows allowed", "id,name,notes\n5,D,old\n6\n",
+			"", []storeInput{{ID: 5, Name: "D"}, {ID: 6}}, []string{"", ""}},
+		{"bad cells are record errors", "id,areaId,latitude\nx,1,1\n7,one,1\n8,1,north\n",
+			"", []storeInput{{}, {ID: 7}, {ID: 8, AreaID: ptr(1)}},
+			[]string{`id "x" is not an integer`, `areaId "one" is not an integer`, `latitude "north" is not a number`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newCSVRecordReader(strings.NewReader(tt.csv), tt.mapping)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records, err := readRecords(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != len(tt.want) {
+				t.Fatalf("got %d records, want %d", len(records), len(tt.want))
+			}
+			for i, rec := range records {
+				gotErr := ""
+				if rec.err != nil {
+					gotErr = rec.err.Error()
+				}
+				if gotErr != tt.errs[i] {
+					t.Errorf("record %d: error %q, want %q", i, gotErr, tt.errs[i])
+				}
+				got, _ := json.Marshal(rec.input)
+				want, _ := json.Marshal(tt.want[i])
+				if string(got) != string(want) {
+					t.Errorf("record %d: got %s, want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCSVRecordReaderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		mapping string
+		want    string
+	}{
+		{"empty", "", "", "reading CSV header"},
+		{"no id column", "name,location\nA,B\n", "", "no id column"},
+		{"two id columns", "id,store_id\n1,1\n", "", "more than one column maps to id"},
+		{"mapping to an unknown field", "code\n1\n", "code:sku", "invalid map entry"},
+		{"mapping without a field", "code\n1\n", "code", "invalid map entry"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newCSVRecordReader(strings.NewReader(tt.csv), tt.mapping)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("malformed row ends the stream", func(t *testing.T) {
+		r, err := newCSVRecordReader(strings.NewReader("id,name\n1,A\n2,\"B\n"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := readRecords(r)
+		if len(records) != 1 || err == nil {
+			t.Errorf("got %d records and %v, want 1 record and a parse error", len(records), err)
+		}
+	})
+}
+
+func TestNDJSONRecordReader(t *testing.T) {
+	r := newNDJSONRecordReader(strings.NewReader("{\"id\":1,\"name\":\"A\"}\n\n  \n{\"id\":\"two\"}\r\n{\"id\":3,\"areaId\":1}"))
+	records, err := readRecords(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3", len(records))
+	}
+	if records[0].err != nil || records[0].input.ID != 1 || records[0].input.Name != "A" {
+		t.Errorf("record 0: %+v", records[0])
+	}
+	if records[1].err == nil {
+		t.Error("record 1 with a string id decoded")
+	}
+	if records[2].err != nil || records[2].input.ID != 3 || *records[2].input.AreaID != 1 {
+		t.Errorf("record 2: %+v", records[2])
+	}
+
+	long := newNDJSONRecordReader(strings.NewReader(`{"name":"` + strings.Repeat("x", maxNDJSONLine) + `"}`))
+	if _, err := long.next(); err == nil {
+		t.Error("a line over maxNDJSONLine was read")
+	}
+}
+
+func TestPostStoreImport(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	mustCreateStores(t,
+		store{ID: 1, AreaID: 1, Name: "Same"},
+		store{ID: 2, AreaID: 1, Name: "Old name"},
+	)
+	r := newTestRouter()
+	csvType := []string{"Content-Type", "text/csv"}
+
+	tests := []struct {
+		name    string
+		path    string
+		body    string
+		headers []string
+		status  int
+		want    importSummary
+	}{
+		{"dry run", "/v1/stores/import?dry_run=true", "id,areaId,name\n1,1,Same\n2,1,New name\n3,1,Third\n", csvType, http.StatusOK,
+			importSummary{DryRun: true, Records: 3, Created: 1, Updated: 1, Unchanged: 1}},
+		{"import", "/v1/stores/import", "id,areaId,name\n1,1,Same\n2,1,New name\n3,1,Third\n", csvType, http.StatusOK,
+			importSummary{Records: 3, Created: 1, Updated: 1, Unchanged: 1}},
+		{"again changes nothing", "/v1/stores/import?format=csv", "id,areaId,name\n1,1,Same\n2,1,New name\n3,1,Third\n", nil, http.StatusOK,
+			importSummary{Records: 3, Unchanged: 3}},
+		{"ndjson with issues", "/v1/stores/import", "{\"id\":4,\"areaId\":1,\"name\":\"Four\"}\n{\"name\":\"No id\",\"areaId\":1}\n{\"id\":5,\"areaId\":9,\"name\":\"No area\"}\nnot json\n",
+			[]string{"Content-Type", "application/x-ndjson"}, http.StatusMultiStatus,
+			importSummary{Records: 4, Created: 1, Invalid: 3}},
+		{"only issues", "/v1/stores/import?format=ndjson", "{\"id\":6}\n", nil, http.StatusOK,
+			importSummary{Records: 1, Invalid: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodPost, tt.path, tt.body, tt.headers...)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var got importSummary
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.DryRun != tt.want.DryRun || got.Records != tt.want.Records || got.Created != tt.want.Created ||
+				got.Updated != tt.want.Updated || got.Unchanged != tt.want.Unchanged || got.Invalid != tt.want.Invalid {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if len(got.Issues) != got.Invalid+got.Failed {
+				t.Errorf("%d issues for %d invalid and %d failed records", len(got.Issues), got.Invalid, got.Failed)
+			}
+		})
+	}
+
+	t.Run("issues are numbered by record", func(t *testing.T) {
+		w := serve(r, http.MethodPost, "/v1/stores/import?format=ndjson", "{\"id\":1,\"areaId\":1,\"name\":\"Same\"}\n\n{\"id\":7}\n")
+		var got importSummary
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Issues) != 1 || got.Issues[0].Record != 2 || got.Issues[0].ID != 7 {
+			t.Errorf("issues %+v, want record 2 with id 7", got.Issues)
+		}
+	})
+
+	if s, _ := storeRepo.Get(context.Background(), 2); s.Name != "New name" {
+		t.Errorf("store 2 is %q after the import", s.Name)
+	}
+}
+
+func TestPostStoreImportProblems(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRouter()
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"unknown format", "/v1/stores/import", "id\n1\n", http.StatusUnsupportedMediaType, errCodeUnsupportedMedia},
+		{"invalid dry_run", "/v1/stores/import?format=csv&dry_run=maybe", "id\n1\n", http.StatusBadRequest, errCodeBadRequest},
+		{"no id column", "/v1/stores/import?format=csv", "name\nA\n", http.StatusBadRequest, errCodeBadRequest},
+		{"malformed row", "/v1/stores/import?format=csv", "id,areaId,name\n1,1,A\n2,1,\"B\n", http.StatusBadRequest, errCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodPost, tt.path, tt.body, "Content-Type", "text/plain")
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var p problem
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			if p.Code != tt.code {
+				t.Errorf("code %q, want %q", p.Code, tt.code)
+			}
+		})
+	}
+
+	// The window holding the malformed row is abandoned unwritten
+	if _, err := storeRepo.Get(context.Background(), 1); err == nil {
+		t.Error("a record from the abandoned window was imported")
+	}
+}
+
+func TestImportSummaryCompact(t *testing.T) {
+	s := importSummary{Records: 300, Invalid: 150, Failed: 0}
+	for i := 0; i < 150; i++ {
+		s.Issues = append(s.Issues, importIssue{Record: i + 1})
+		s.Changes = append(s.Changes, importChange{Record: i + 151})
+	}
+	compact := s.compact()
+	if len(compact.Issues) != maxSummaryItems || len(compact.Changes) != maxSummaryItems {
+		t.Errorf("compact keeps %d issues and %d changes", len(compact.Issues), len(compact.Changes))
+	}
+	if compact.Records != 300 || compact.Invalid != 150 {
+		t.Errorf("compact changed the counts: %+v", compact)
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	for _, format := range []string{"csv", "ndjson"} {
+		t.Run(format, func(t *testing.T) {
+			useMemoryRepositories(t)
+			if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+				t.Fatal(err)
+			}
+			stores := []store{
+				{ID: 1, AreaID: 1, Name: "A, with comma", Location: "Line \"quoted\"", Latitude: ptr(1.5), Longitude: ptr(2.25)},
+				{ID: 2, AreaID: 1, Name: "B"},
+			}
+			mustCreateStores(t, stores...)
+			r := newTestRouter()
+
+			w := serve(r, http.MethodGet, "/v1/stores/export?format="+format, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != exportContentTypes[format] {
+				t.Errorf("Content-Type %q", got)
+			}
+			exported := w.Body.String()
+
+			// Importing the export into an empty repository recreates the stores
+			useMemoryRepositories(t)
+			if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+				t.Fatal(err)
+			}
+			w = serve(r, http.MethodPost, "/v1/stores/import?format="+format, exported)
+			if w.Code != http.StatusOK {
+				t.Fatalf("import status %d: %s", w.Code, w.Body)
+			}
+			for _, want := range stores {
+				got, err := storeRepo.Get(context.Background(), want.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !sameStore(got, want) {
+					t.Errorf("got %+v, want %+v", got, want)
+				}
+			}
+		})
+	}
+
+	t.Run("unknown format", func(t *testing.T) {
+		useMemoryRepositories(t)
+		if w := serve(newTestRouter(), http.MethodGet, "/v1/stores/export?format=xml", ""); w.Code != http.StatusBadRequest {
+			t.Errorf("status %d, want 400", w.Code)
+		}
+	})
+}
+
+func TestImportStoresStopsAtUnreadableRecord(t *testing.T) {
+	useMemoryRepositories(t)
+	failing := &failingReader{records: []importRecord{{input: storeInput{ID: 1, Name: "A"}}}, err: errors.New("connection reset")}
+	summary, err := importStores(context.Background(), failing, true)
+	if err == nil || !strings.Contains(err.Error(), "record 2") {
+		t.Errorf("got %v, want the error of record 2", err)
+	}
+	if summary.Records != 0 {
+		t.Errorf("records %d, want the unfinished window left uncounted", summary.Records)
+	}
+}
+
+// failingReader yields its records and then err
+type failingReader struct {
+	records []importRecord
+	err     error
+}
+
+func (f *failingReader) next() (importRecord, error) {
+	if len(f.records) == 0 {
+		return importRecord{}, f.err
+	}
+	rec := f.records[0]
+	f.records = f.records[1:]
+	return rec, nil
+}
+
+// racingRepository lets another writer change each store right after the
+// import read it: an existing store is renamed and a missing one created
+type racingRepository struct {
+	StoreRepository
+}
+
+func (r racingRepository) Get(ctx context.Context, id int) (store, error) {
+	s, err := r.StoreRepository.Get(ctx, id)
+	if err == nil {
+		s2 := s
+		s2.Name = "Concurrent"
+		if _, _, err := r.StoreRepository.Update(ctx, s2, anyVersion); err != nil {
+			return store{}, err
+		}
+	} else if errors.Is(err, errStoreNotFound) {
+		if err := r.StoreRepository.Create(ctx, store{ID: id, AreaID: 1, Name: "Concurrent"}); err != nil {
+			return store{}, err
+		}
+	}
+	return s, err
+}
+
+func TestImportStoresReportsConcurrentWrites(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	mustCreateStores(t, store{ID: 1, AreaID: 1, Name: "Old name"})
+	storeRepo = racingRepository{StoreRepository: storeRepo}
+
+	records, err := newCSVRecordReader(strings.NewReader("id,areaId,name\n1,1,Imported\n2,1,Imported\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := importStores(context.Background(), records, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Conflict != 2 || summary.Created+summary.Updated != 0 || len(summary.Issues) != 2 {
+		t.Fatalf("got %+v, want both records in conflict", summary)
+	}
+	for _, issue := range summary.Issues {
+		if issue.Status != bulkConflict {
+			t.Errorf("issue %+v, want a conflict", issue)
+		}
+	}
+	for _, id := range []int{1, 2} {
+		if s, _ := storeRepo.Get(context.Background(), id); s.Name != "Concurrent" {
+			t.Errorf("store %d is %q, want the concurrent write kept", id, s.Name)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// The unversioned routes answer the store requests of the two old servers
+// with the bodies and status codes those servers sent. Clients of main.go
+// name stores by integer ID; clients of run.go name them by a UUID of their
+// own choosing, which is mapped to a store ID when first written. Errors use
+// the {"message": ...} and {"error": ...} bodies of the old servers rather
+// than problem details.
+//
+// Where both servers served the same route, the request tells them apart:
+// GET /stores with ?limit is the run.go listing and without it the main.go
+// one, /stores/:id with a UUID is run.go's, and POST /stores with a single
+// object carrying a string id is run.go's while an array is main.go's.
+
+// legacyStore is a store as run.go sent it. Stores created by main.go clients
+// or through /v1 have no UUID and carry their decimal store ID instead.
+type legacyStore struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Location string `json:"location"`
+}
+
+// legacyError responds as main.go did: {"message": ...} for requests it
+// refused and {"error": ...} for failures. The detail of a failure is the
+// one toAPIError gives, so the cause is logged rather than sent.
+func legacyError(c *gin.Context, err error) {
+	e := toAPIError(err)
+	if e.Status >= http.StatusInternalServerError {
+		log.Printf("%s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+		c.IndentedJSON(e.Status, gin.H{"error": e.Detail})
+		return
+	}
+	c.IndentedJSON(e.Status, gin.H{"message": e.Detail})
+}
+
+// runGoFailure responds as run.go did to a failed request, with a fixed
+// message and the cause logged
+func runGoFailure(c *gin.Context, message string, err error) {
+	log.Printf("%s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+}
+
+// parseStoreUUID returns the canonical form of a run.go store ID
+func parseStoreUUID(s string) (string, bool) {
+	uuid, err := gocql.ParseUUID(s)
+	if err != nil {
+		return "", false
+	}
+	return uuid.String(), true
+}
+
+// legacyListStores serves GET /stores: with ?limit, run.go's listing of at
+// most limit stores, and otherwise main.go's listing of every store
+func legacyListStores(c *gin.Context) {
+	limitParam, hasLimit := c.GetQuery("limit")
+	if !hasLimit {
+		stores, err := allStores(c.Request.Context(), storeRepo)
+		if err != nil {
+			legacyError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, stores)
+		return
+	}
+
+	limit, err := strconv.Atoi(limitParam)
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	stores, _, err := storeRepo.List(c.Request.Context(), limit, pageCursor{})
+	if err != nil {
+		runGoFailure(c, "Failed to retrieve stores", err)
+		return
+	}
+	legacyStores, err := toLegacyStores(c.Request.Context(), stores)
+	if err != nil {
+		runGoFailure(c, "Failed to retrieve stores", err)
+		return
+	}
+	c.JSON(http.StatusOK, legacyStores)
+}
+
+// toLegacyStores gives each store its UUID, or its store ID where it has none
+func toLegacyStores(ctx context.Context, stores []store) ([]legacyStore, error) {
+	if len(stores) == 0 {
+		return nil, nil
+	}
+	uuids, err := legacyIDRepo.UUIDs(ctx, storeIDs(stores))
+	if err != nil {
+		return nil, err
+	}
+
+	legacy := make([]legacyStore, len(stores))
+	for i, s := range stores {
+		id, ok := uuids[s.ID]
+		if !ok {
+			id = strconv.Itoa(s.ID)
+		}
+		legacy[i] = legacyStore{ID: id, Name: s.Name, Location: s.Location}
+	}
+	return legacy, nil
+}
+
+// storeIDs returns the IDs of the stores
+func storeIDs(stores []store) []int {
+	ids := make([]int, len(stores))
+	for i, s := range stores {
+		ids[i] = s.ID
+	}
+	return ids
+}
+
+// legacyGetStore serves GET /stores/:id for an integer ID as main.go did and
+// for a UUID as run.go did
+func legacyGetStore(c *gin.Context) {
+	if uuid, ok := parseStoreUUID(c.Param("id")); ok {
+		runGoGetStore(c, uuid)
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "invalid id"})
+		return
+	}
+	s, err := storeRepo.Get(c.Request.Context(), id)
+	if err != nil {
+		legacyError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, s)
+}
+
+func runGoGetStore(c *gin.Context, uuid string) {
+	id, err := legacyIDRepo.Get(c.Request.Context(), uuid)
+	var s store
+	if err == nil {
+		s, err = storeRepo.Get(c.Request.Context(), id)
+	}
+	if errors.Is(err, errUUIDNotFound) || errors.Is(err, errStoreNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Store not found"})
+		return
+	}
+	if err != nil {
+		runGoFailure(c, "Failed to retrieve store", err)
+		return
+	}
+	c.JSON(http.StatusOK, legacyStore{ID: uuid, Name: s.Name, Location: s.Location})
+}
+
+// legacyStoresByArea serves GET /stores/area/:areaid as main.go did, with
+// every store of the area in a bare array
+func legacyStoresByArea(c *gin.Context) {
+	areaID, err := strconv.Atoi(c.Param("areaid"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "invalid area ID"})
+		return
+	}
+
+	var stores []store
+	var cursor pageCursor
+	for {
+		page, next, err := storeRepo.ListByArea(c.Request.Context(), areaID, maxPageSize, cursor)
+		if err != nil {
+			legacyError(c, err)
+			return
+		}
+		stores = append(stores, page...)
+		if next.encode() == "" {
+			break
+		}
+		cursor = next
+	}
+	c.IndentedJSON(http.StatusOK, stores)
+}
+
+// legacySearchStores serves GET /stores/search as main.go did: every match in
+// a bare array, or 404 when nothing matches
+func legacySearchStores(c *gin.Context) {
+	areaID, err := strconv.Atoi(c.DefaultQuery("areaid", "-1"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "invalid area ID"})
+		return
+	}
+
+	results, err := parallelStoreSearch(c.Request.Context(), []searchCriteria{
+		{AreaID: areaID, Name: c.Query("name"), Location: c.Query("location")},
+	})
+	if err != nil {
+		legacyError(c, err)
+		return
+	}
+	if len(results) == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "no stores found"})
+		return
+	}
+
+	stores := make([]store, len(results))
+	for i, r := range results {
+		stores[i] = r.store
+	}
+	c.IndentedJSON(http.StatusOK, stores)
+}
+
+// legacyPostStores serves POST /stores: a single object with a string id is
+// run.go's create and anything else main.go's batch create
+func legacyPostStores(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		legacyError(c, decodeError(err))
+		return
+	}
+
+	var probe struct {
+		ID interface{} `json:"id"`
+	}
+	if json.Unmarshal(body, &probe) == nil {
+		if _, ok := probe.ID.(string); ok {
+			runGoPostStore(c, body)
+			return
+		}
+	}
+	mainGoPostStores(c, body)
+}
+
+// mainGoPostStores creates a JSON array of stores and answers with the array
+// of stores created. No store is written unless every one is valid. A store
+// that cannot be created answers for the whole request with the status /v1
+// would give it; the stores before it may have been created.
+func mainGoPostStores(c *gin.Context, body []byte) {
+	var inputs []storeInput
+	if err := json.Unmarshal(body, &inputs); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": decodeError(err).Detail})
+		return
+	}
+
+	results := make([]bulkResult, len(inputs))
+	items := validateBulk(c.Request.Context(), inputs, results)
+	if len(items) < len(inputs) {
+		for _, r := range results {
+			if r.Status == bulkInvalid {
+				c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "[" + strconv.Itoa(r.Index) + "]: " + r.Error})
+				return
+			}
+			if r.Status == bulkFailed {
+				legacyError(c, r.err)
+				return
+			}
+		}
+	}
+
+	createBulk(c.Request.Context(), items, results)
+	created := make([]store, 0, len(results))
+	for _, r := range results {
+		switch r.Status {
+		case bulkCreated:
+			created = append(created, *r.Store)
+		case bulkConflict:
+			c.IndentedJSON(http.StatusConflict, gin.H{"error": r.Error})
+			return
+		default:
+			legacyError(c, r.err)
+			return
+		}
+	}
+	c.IndentedJSON(http.StatusCreated, created)
+}
+
+// runGoPostStore creates or replaces the store a run.go client names by UUID
+func runGoPostStore(c *gin.Context, body []byte) {
+	var in legacyStore
+	if err := json.Unmarshal(body, &in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	uuid, ok := parseStoreUUID(in.ID)
+	if !ok || !validLegacyStore(in) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if err := saveLegacyStore(c.Request.Context(), uuid, in); err != nil {
+		runGoFailure(c, "Failed to create store", err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "Store created successfully"})
+}
+
+// validLegacyStore applies the length limits of every store. run.go checked
+// nothing, but an empty name is accepted as it was.
+func validLegacyStore(in legacyStore) bool {
+	return utf8.RuneCountInString(in.Name) <= maxNameLength && utf8.RuneCountInString(in.Location) <= maxLocationLength
+}
+
+// saveLegacyStore writes the name and location of the store a UUID names,
+// creating it on first use as run.go's upserts did. run.go stores have no
+// area, so a new one is created outside every area; an existing one keeps
+// its area and coordinates.
+func saveLegacyStore(ctx context.Context, uuid string, in legacyStore) error {
+	id, err := legacyIDRepo.Get(ctx, uuid)
+	if errors.Is(err, errUUIDNotFound) {
+		if id, err = storeRepo.NextID(ctx); err != nil {
+			return err
+		}
+		// A concurrent request may have mapped the UUID first
+		id, err = legacyIDRepo.Claim(ctx, uuid, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		current, err := storeRepo.Get(ctx, id)
+		if errors.Is(err, errStoreNotFound) {
+			err = storeRepo.Create(ctx, store{ID: id, Name: in.Name, Location: in.Location})
+			if errors.Is(err, errStoreExists) && attempt < maxUpdateAttempts {
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		current.Name, current.Location = in.Name, in.Location
+		_, _, err = storeRepo.Update(ctx, current, current.Version)
+		if errors.Is(err, errVersionConflict) && attempt < maxUpdateAttempts {
+			continue
+		}
+		return err
+	}
+}
+
+// legacyUpdateStore serves PUT /stores/:id, which only run.go had, for a UUID
+// and otherwise updates as /v1 does
+func legacyUpdateStore(c *gin.Context) {
+	uuid, ok := parseStoreUUID(c.Param("id"))
+	if !ok {
+		updateStore(c)
+		return
+	}
+
+	var in legacyStore
+	if err := c.ShouldBindJSON(&in); err != nil || !validLegacyStore(in) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := saveLegacyStore(c.Request.Context(), uuid, in); err != nil {
+		runGoFailure(c, "Failed to update store", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Store updated successfully"})
+}
+
+// legacyDeleteStore serves DELETE /stores/:id, which only run.go had, for a
+// UUID and otherwise deletes as /v1 does. Like run.go it succeeds whether or
+// not the store existed.
+func legacyDeleteStore(c *gin.Context) {
+	uuid, ok := parseStoreUUID(c.Param("id"))
+	if !ok {
+		deleteStore(c)
+		return
+	}
+
+	ctx := c.Request.Context()
+	id, err := legacyIDRepo.Get(ctx, uuid)
+	if err == nil {
+		_, err = storeRepo.Delete(ctx, id, anyVersion)
+		if errors.Is(err, errStoreNotFound) {
+			err = nil
+		}
+		if err == nil {
+			err = legacyIDRepo.Delete(ctx, uuid)
+		}
+	}
+	if err != nil && !errors.Is(err, errUUIDNotFound) {
+		runGoFailure(c, "Failed to delete store", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Store deleted successfully"})
+}
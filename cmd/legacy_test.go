@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMainGoRoutes(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	mustCreateStores(t,
+		store{ID: 1, AreaID: 1, Name: "Alpha"},
+		store{ID: 2, AreaID: 1, Name: "Beta"},
+		store{ID: 3, AreaID: 2, Name: "Gamma"},
+	)
+	r := newTestRouter()
+
+	// Each case runs against the stores the previous ones created. body is
+	// the expected body, compared after decoding; ids lists the store IDs of
+	// a bare array instead.
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		send   string
+		status int
+		ids    []int
+		body   string
+	}{
+		{"listing is a bare array of every store", http.MethodGet, "/stores", "", http.StatusOK, []int{1, 2, 3}, ""},
+		{"store", http.MethodGet, "/stores/2", "", http.StatusOK, nil, `{"id":2,"areaId":1,"name":"Beta","location":""}`},
+		{"missing store", http.MethodGet, "/stores/9", "", http.StatusNotFound, nil, `{"message":"store not found"}`},
+		{"invalid id", http.MethodGet, "/stores/x", "", http.StatusBadRequest, nil, `{"message":"invalid id"}`},
+		{"area", http.MethodGet, "/stores/area/1", "", http.StatusOK, []int{1, 2}, ""},
+		{"empty area", http.MethodGet, "/stores/area/7", "", http.StatusOK, nil, `null`},
+		{"invalid area", http.MethodGet, "/stores/area/x", "", http.StatusBadRequest, nil, `{"message":"invalid area ID"}`},
+		{"search", http.MethodGet, "/stores/search?name=gamma", "", http.StatusOK, []int{3}, ""},
+		{"search without matches", http.MethodGet, "/stores/search?name=delta", "", http.StatusNotFound, nil, `{"message":"no stores found"}`},
+		{"search with an invalid area", http.MethodGet, "/stores/search?areaid=x", "", http.StatusBadRequest, nil, `{"message":"invalid area ID"}`},
+		{"create answers with the stores", http.MethodPost, "/stores", `[{"id":4,"areaId":1,"name":"Delta"},{"id":5,"areaId":1,"name":"Epsilon"}]`,
+			http.StatusCreated, []int{4, 5}, ""},
+		{"create an empty array", http.MethodPost, "/stores", `[]`, http.StatusCreated, nil, `[]`},
+		{"create a single object", http.MethodPost, "/stores", `{"id":6,"areaId":1,"name":"Zeta"}`, http.StatusBadRequest, nil, ""},
+		{"create an invalid store", http.MethodPost, "/stores", `[{"id":6,"areaId":1,"name":"Zeta"},{"id":7,"areaId":1}]`,
+			http.StatusBadRequest, nil, `{"error":"[1]: name is required"}`},
+		{"create a taken id", http.MethodPost, "/stores", `[{"id":1,"areaId":1,"name":"Again"}]`, http.StatusConflict, nil, `{"error":"store 1 already exists"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, tt.method, tt.path, tt.send)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if strings.HasPrefix(w.Header().Get("Content-Type"), problemContentType) {
+				t.Errorf("got a problem response: %s", w.Body)
+			}
+			if tt.ids != nil {
+				var stores []store
+				if err := json.Unmarshal(w.Body.Bytes(), &stores); err != nil {
+					t.Fatalf("not a bare array: %v: %s", err, w.Body)
+				}
+				if ids := storeIDs(stores); !equalInts(ids, tt.ids) {
+					t.Errorf("got %v, want %v", ids, tt.ids)
+				}
+			}
+			if tt.body != "" {
+				assertJSONEqual(t, w.Body.Bytes(), tt.body)
+			}
+		})
+	}
+
+	if _, err := storeRepo.Get(context.Background(), 6); err == nil {
+		t.Error("store 6 was created although another store of its request was invalid")
+	}
+}
+
+func TestRunGoRoutes(t *testing.T) {
+	useMemoryRepositories(t)
+	mustCreateStores(t, store{ID: 1, AreaID: 1, Name: "Numbered"})
+	r := newTestRouter()
+	const uuid = "11111111-1111-1111-1111-111111111111"
+
+	// Each case runs against the stores the previous ones wrote
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		send   string
+		status int
+		body   string
+	}{
+		{"missing store", http.MethodGet, "/stores/" + uuid, "", http.StatusNotFound, `{"message":"Store not found"}`},
+		{"create", http.MethodPost, "/stores", `{"id":"` + uuid + `","name":"Store Alpha","location":"Downtown"}`,
+			http.StatusCreated, `{"message":"Store created successfully"}`},
+		{"store", http.MethodGet, "/stores/" + uuid, "", http.StatusOK, `{"id":"` + uuid + `","name":"Store Alpha","location":"Downtown"}`},
+		{"create again replaces", http.MethodPost, "/stores", `{"id":"` + uuid + `","name":"Store Alpha","location":"Uptown"}`,
+			http.StatusCreated, `{"message":"Store created successfully"}`},
+		{"update", http.MethodPut, "/stores/" + strings.ToUpper(uuid), `{"name":"Store A","location":"Uptown"}`,
+			http.StatusOK, `{"message":"Store updated successfully"}`},
+		{"store after the update", http.MethodGet, "/stores/" + uuid, "", http.StatusOK, `{"id":"` + uuid + `","name":"Store A","location":"Uptown"}`},
+		{"listing with limit", http.MethodGet, "/stores?limit=10", "", http.StatusOK,
+			`[{"id":"1","name":"Numbered","location":""},{"id":"` + uuid + `","name":"Store A","location":"Uptown"}]`},
+		{"listing with an invalid limit", http.MethodGet, "/stores?limit=0", "", http.StatusBadRequest, `{"error":"Invalid limit"}`},
+		{"create with an invalid uuid", http.MethodPost, "/stores", `{"id":"nope","name":"Store Beta"}`, http.StatusBadRequest, `{"error":"Invalid request body"}`},
+		{"delete", http.MethodDelete, "/stores/" + uuid, "", http.StatusOK, `{"message":"Store deleted successfully"}`},
+		{"store after the delete", http.MethodGet, "/stores/" + uuid, "", http.StatusNotFound, `{"message":"Store not found"}`},
+		{"delete a missing store", http.MethodDelete, "/stores/" + uuid, "", http.StatusOK, `{"message":"Store deleted successfully"}`},
+		{"update a missing store creates it", http.MethodPut, "/stores/" + uuid, `{"name":"Store B","location":"Suburbs"}`,
+			http.StatusOK, `{"message":"Store updated successfully"}`},
+		{"store after the upsert", http.MethodGet, "/stores/" + uuid, "", http.StatusOK, `{"id":"` + uuid + `","name":"Store B","location":"Suburbs"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, tt.method, tt.path, tt.send)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			assertJSONEqual(t, w.Body.Bytes(), tt.body)
+		})
+	}
+
+	// The store is an ordinary store to /v1
+	id, err := legacyIDRepo.Get(context.Background(), uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := storeRepo.Get(context.Background(), id); err != nil || s.Name != "Store B" || id == 1 {
+		t.Errorf("store %d is %+v, %v", id, s, err)
+	}
+}
+
+// assertJSONEqual compares two JSON documents ignoring layout
+func assertJSONEqual(t *testing.T, got []byte, want string) {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("body is not JSON: %v: %s", err, got)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	gotJSON, _ := json.Marshal(g)
+	wantJSON, _ := json.Marshal(w)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("body %s, want %s", gotJSON, wantJSON)
+	}
+}
@@ -1,10 +1,22 @@
+// Command cmd serves the store locator API. Every route lives under /v1; the
+// same routes without the prefix answer clients of the old main.go and run.go
+// servers with the bodies and status codes those servers sent, plus a
+// Deprecation header. run.go clients keep naming stores by their UUIDs, which
+// are mapped to store IDs. Store IDs are positive integers allocated by the
+// server; a client may still choose one, and creating a store with an ID that
+// already exists is rejected with 409. Areas are identified by client-chosen
+// integer IDs.
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,15 +24,46 @@ import (
 	"github.com/gocql/gocql"
 )
 
+// store is a physical store. Its ID is a positive int allocated by the server
+// from the id_counters table unless the client supplies one, and a supplied ID
+// that already exists is rejected with 409. The ID is the partition key of
+// every table. UUIDs are only accepted on the legacy run.go routes, which map
+// them to allocated IDs.
 type store struct {
-	ID       int    `json:"id"`
-	AreaID   int    `json:"areaId"`
-	Name     string `json:"name"`
-	Location string `json:"location"`
+	ID        int      `json:"id"`
+	AreaID    int      `json:"areaId"`
+	Name      string   `json:"name"`
+	Location  string   `json:"location"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	// Version changes on every write and is sent as the ETag, not in the body
+	Version int64 `json:"-"`
+}
+
+// storeInput is the POST and PUT /stores payload. AreaID is optional: stores
+// written with coordinates but no areaId are assigned the area containing them.
+type storeInput struct {
+	ID        int      `json:"id" yaml:"id"`
+	AreaID    *int     `json:"areaId" yaml:"areaId"`
+	Name      string   `json:"name" yaml:"name"`
+	Location  string   `json:"location" yaml:"location"`
+	Latitude  *float64 `json:"latitude" yaml:"latitude"`
+	Longitude *float64 `json:"longitude" yaml:"longitude"`
+}
+
+// storeColumns lists the stores table columns in the order scanTargets expects
+const storeColumns = "id, area_id, name, location, latitude, longitude"
+
+// scanTargets returns the scan destinations matching storeColumns
+func (s *store) scanTargets() []interface{} {
+	return []interface{}{&s.ID, &s.AreaID, &s.Name, &s.Location, &s.Latitude, &s.Longitude}
 }
 
 var session *gocql.Session
 
+// keyspace is the keyspace the session is connected to
+var keyspace string
+
 // getHostIP attempts to get the non-loopback IP address
 func getHostIP() string {
 	addrs, err := net.InterfaceAddrs()
@@ -38,58 +81,10 @@ func getHostIP() string {
 	return "localhost"
 }
 
-// optimizedStoreSearch performs an optimized search based on areaID, name, and location
-func optimizedStoreSearch(areaID int, name, location string) ([]store, error) {
-	var stores []store
-
-	// Prepare the query with flexible criteria
-	query := "SELECT id, area_id, name, location FROM stores WHERE 1=1"
-	var args []interface{}
-
-	if areaID >= 0 {
-		query += " AND area_id = ?"
-		args = append(args, areaID)
-	}
-	if name != "" {
-		query += " AND name LIKE ?"
-		args = append(args, "%"+name+"%")
-	}
-	if location != "" {
-		query += " AND location LIKE ?"
-		args = append(args, "%"+location+"%")
-	}
-
-	iter := session.Query(query, args...).Iter()
-	var s store
-	for iter.Scan(&s.ID, &s.AreaID, &s.Name, &s.Location) {
-		stores = append(stores, s)
-	}
-
-	if err := iter.Close(); err != nil {
-		return nil, err
-	}
-
-	return stores, nil
-}
-
-// Implement batch processing for writes
-func batchStoreInsert(stores []store) error {
-	batch := session.NewBatch(gocql.LoggedBatch)
-
-	for _, s := range stores {
-		batch.Query(`INSERT INTO stores (id, area_id, name, location) 
-			VALUES (?, ?, ?, ?)`,
-			s.ID, s.AreaID, s.Name, s.Location)
-	}
-
-	// Execute batch with consistency level
-	err := session.ExecuteBatch(batch)
-	return err
-}
-
 // parallelStoreSearch searches for stores concurrently based on multiple criteria
-func parallelStoreSearch(searchParams []searchCriteria) ([]store, error) {
-	var results []store
+func parallelStoreSearch(ctx context.Context, searchParams []searchCriteria) ([]searchResult, error) {
+	var results []searchResult
+	var firstErr error
 	var mu sync.Mutex
 	var wg sync.WaitGroup
 
@@ -100,18 +95,27 @@ func parallelStoreSearch(searchParams []searchCriteria) ([]store, error) {
 			defer wg.Done()
 
 			// Perform the search
-			searchResults, err := optimizedStoreSearch(p.AreaID, p.Name, p.Location)
-			if err == nil {
-				// Lock to append results safely across goroutines
-				mu.Lock()
-				results = append(results, searchResults...)
-				mu.Unlock()
+			searchResults, err := storeRepo.Search(ctx, p)
+
+			// Lock to append results safely across goroutines
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
 			}
+			results = append(results, searchResults...)
 		}(params)
 	}
 
 	// Wait for all goroutines to complete
 	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	sortByScore(results)
 	return results, nil
 }
 
@@ -120,66 +124,58 @@ type searchCriteria struct {
 	AreaID   int
 	Name     string
 	Location string
+	Fuzzy    int // maximum edit distance per token, 0 for exact matching
 }
 
-func initCassandra() {
-	// Determine host IP
-	cassandraHost := getHostIP()
-	log.Printf("Attempting to connect to Cassandra at %s:9042", cassandraHost)
+// connectCassandra creates the keyspace if needed and opens the package session
+func connectCassandra(cfg cassandraConfig) {
+	log.Printf("Attempting to connect to Cassandra at %s port %d", strings.Join(cfg.contactPoints(), ","), cfg.Port)
 
 	// First, connect without a keyspace to create it
-	defaultCluster := gocql.NewCluster(cassandraHost)
-	defaultCluster.Port = 9042
-	defaultCluster.Authenticator = gocql.PasswordAuthenticator{
-		Username: "cassandra",
-		Password: "cassandra",
-	}
-	defaultCluster.Consistency = gocql.Quorum
-	defaultCluster.ConnectTimeout = time.Second * 10
-
-	// Create initial session to create keyspace
-	defaultSession, err := defaultCluster.CreateSession()
+	defaultSession, err := cfg.newCluster("").CreateSession()
 	if err != nil {
 		log.Fatalf("Error creating default Cassandra session: %v", err)
 	}
 	defer defaultSession.Close()
 
 	// Create keyspace
-	err = defaultSession.Query(`CREATE KEYSPACE IF NOT EXISTS store_management 
-		WITH REPLICATION = {
-			'class': 'SimpleStrategy', 
-			'replication_factor': 1
-		}`).Exec()
+	err = defaultSession.Query(`CREATE KEYSPACE IF NOT EXISTS ` + cfg.Keyspace + `
+		WITH REPLICATION = ` + cfg.Replication.replicationCQL()).Exec()
 	if err != nil {
 		log.Fatalf("Error creating keyspace: %v", err)
 	}
 
 	// Now connect with the keyspace
-	cluster := gocql.NewCluster(cassandraHost)
-	cluster.Keyspace = "store_management"
-	cluster.Port = 9042
-	cluster.Authenticator = gocql.PasswordAuthenticator{
-		Username: "cassandra",
-		Password: "cassandra",
-	}
-	cluster.Consistency = gocql.Quorum
-	cluster.ConnectTimeout = time.Second * 10
-
-	session, err = cluster.CreateSession()
+	session, err = cfg.newCluster(cfg.Keyspace).CreateSession()
 	if err != nil {
 		log.Fatalf("Error creating Cassandra session with keyspace: %v", err)
 	}
+	keyspace = cfg.Keyspace
+}
 
-	// Create table
-	err = session.Query(`CREATE TABLE IF NOT EXISTS stores (
-		id int PRIMARY KEY,
-		area_id int,
-		name text,
-		location text
-	)`).Exec()
-	if err != nil {
-		log.Fatalf("Error creating stores table: %v", err)
+// initCassandra connects and brings the schema up to date
+func initCassandra(cfg cassandraConfig) {
+	connectCassandra(cfg)
+
+	// Versioned schema changes live in the embedded migrations directory
+	if err := migrateSchema(context.Background(), session); err != nil {
+		log.Fatalf("Error migrating schema: %v", err)
+	}
+}
+
+// ensureColumn adds a column to a table in the session keyspace unless it already exists
+func ensureColumn(session *gocql.Session, table, column, cqlType string) error {
+	var name string
+	err := session.Query(`SELECT column_name FROM system_schema.columns
+		WHERE keyspace_name = ? AND table_name = ? AND column_name = ?`,
+		keyspace, table, column).Scan(&name)
+	if err == nil {
+		return nil
+	}
+	if err != gocql.ErrNotFound {
+		return err
 	}
+	return session.Query("ALTER TABLE " + table + " ADD " + column + " " + cqlType).Exec()
 }
 
 func ResponseTimeMiddleware() gin.HandlerFunc {
@@ -197,44 +193,37 @@ func ResponseTimeMiddleware() gin.HandlerFunc {
 }
 
 func getStores(c *gin.Context) {
-	var stores []store
-	iter := session.Query("SELECT id, area_id, name, location FROM stores").Iter()
-	
-	var s store
-	for iter.Scan(&s.ID, &s.AreaID, &s.Name, &s.Location) {
-		stores = append(stores, s)
+	scope := cursorScope(c, "stores")
+	pageSize, cursor, err := parsePageParams(c, scope)
+	if err != nil {
+		c.Error(badRequest(err.Error()))
+		return
 	}
 
-	if err := iter.Close(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	stores, next, err := storeRepo.List(c.Request.Context(), pageSize, cursor)
+	if err != nil {
+		c.Error(err)
 		return
 	}
 
-	c.IndentedJSON(http.StatusOK, stores)
+	renderStorePage(c, stores, pageSize, next, scope)
 }
 
 func getStoreByID(c *gin.Context) {
 	idParam := c.Param("id")
 	id, err := strconv.Atoi(idParam)
 	if err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "invalid id"})
+		c.Error(badRequest("invalid id"))
 		return
 	}
 
-	var s store
-	err = session.Query("SELECT id, area_id, name, location FROM stores WHERE id = ?", id).Scan(
-		&s.ID, &s.AreaID, &s.Name, &s.Location,
-	)
-	
+	s, err := storeRepo.Get(c.Request.Context(), id)
 	if err != nil {
-		if err == gocql.ErrNotFound {
-			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "store not found"})
-		} else {
-			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
+		c.Error(err)
 		return
 	}
 
+	c.Header("ETag", storeETag(s.Version))
 	c.IndentedJSON(http.StatusOK, s)
 }
 
@@ -242,35 +231,107 @@ func getStoresByAreaID(c *gin.Context) {
 	areaIDParam := c.Param("areaid")
 	areaID, err := strconv.Atoi(areaIDParam)
 	if err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "invalid area ID"})
+		c.Error(badRequest("invalid area ID"))
+		return
+	}
+
+	if _, err := areaRepo.Get(c.Request.Context(), areaID); err != nil {
+		c.Error(err)
+		return
+	}
+
+	scope := cursorScope(c, "area")
+	pageSize, cursor, err := parsePageParams(c, scope)
+	if err != nil {
+		c.Error(badRequest(err.Error()))
 		return
 	}
 
-	// Use optimizedStoreSearch to retrieve stores for a specific area
-	stores, err := optimizedStoreSearch(areaID, "", "")
+	stores, next, err := storeRepo.ListByArea(c.Request.Context(), areaID, pageSize, cursor)
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.Error(err)
 		return
 	}
 
-	c.IndentedJSON(http.StatusOK, stores)
+	renderStorePage(c, stores, pageSize, next, scope)
 }
 
-func postStores(c *gin.Context) {
-	var newStores []store
-	if err := c.BindJSON(&newStores); err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+// inputError is a problem with the request payload, reported as 400
+type inputError string
+
+func (e inputError) Error() string { return string(e) }
+
+// updateStore replaces a store. A payload without areaId or coordinates keeps
+// the store in its current area.
+func updateStore(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Error(badRequest("invalid id"))
+		return
+	}
+
+	var in storeInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.Error(decodeError(err))
+		return
+	}
+	if in.ID != 0 && in.ID != id {
+		c.Error(invalidFields("store is invalid", []fieldError{
+			{Field: "id", Code: codeMismatch, Message: "id in body does not match the URL"},
+		}))
+		return
+	}
+	in.ID = id
+
+	ifVersion, ok := ifMatchVersion(c)
+	if !ok {
+		c.Error(preconditionFailed("If-Match does not match the store"))
+		return
+	}
+
+	current, err := storeRepo.Get(c.Request.Context(), id)
+	if err != nil {
+		c.Error(err)
 		return
 	}
+	if in.AreaID == nil && (in.Latitude == nil || in.Longitude == nil) {
+		in.AreaID = &current.AreaID
+	}
 
-	// Insert stores in bulk using batchStoreInsert
-	err := batchStoreInsert(newStores)
+	s, err := storeUpdateFromInput(c.Request.Context(), in, current)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	s, _, err = storeRepo.Update(c.Request.Context(), s, ifVersion)
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.Error(err)
+		return
+	}
+
+	c.Header("ETag", storeETag(s.Version))
+	c.IndentedJSON(http.StatusOK, s)
+}
+
+func deleteStore(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Error(badRequest("invalid id"))
+		return
+	}
+
+	ifVersion, ok := ifMatchVersion(c)
+	if !ok {
+		c.Error(preconditionFailed("If-Match does not match the store"))
 		return
 	}
 
-	c.IndentedJSON(http.StatusCreated, newStores)
+	if _, err := storeRepo.Delete(c.Request.Context(), id, ifVersion); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "store deleted"})
 }
 
 func searchStores(c *gin.Context) {
@@ -280,45 +341,136 @@ func searchStores(c *gin.Context) {
 
 	areaID, err := strconv.Atoi(areaIDParam)
 	if err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "invalid area ID"})
+		c.Error(badRequest("invalid area ID"))
+		return
+	}
+
+	fuzzy, err := strconv.Atoi(c.DefaultQuery("fuzzy", "0"))
+	if err != nil || fuzzy < 0 || fuzzy > maxFuzzyDistance {
+		c.Error(badRequest("fuzzy must be between 0 and " + strconv.Itoa(maxFuzzyDistance)))
+		return
+	}
+
+	// An optional origin blends proximity into the ranking
+	ranking, err := parseRankingOptions(c)
+	if err != nil {
+		c.Error(badRequest(err.Error()))
+		return
+	}
+
+	scope := cursorScope(c, "search")
+	pageSize, cursor, err := parsePageParams(c, scope)
+	if err != nil {
+		c.Error(badRequest(err.Error()))
+		return
+	}
+
+	// Unranked area listings page straight through the repository
+	if len(tokenize(name)) == 0 && len(tokenize(location)) == 0 && ranking == nil {
+		var stores []store
+		var next pageCursor
+		if areaID >= 0 {
+			stores, next, err = storeRepo.ListByArea(c.Request.Context(), areaID, pageSize, cursor)
+		} else {
+			stores, next, err = storeRepo.List(c.Request.Context(), pageSize, cursor)
+		}
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		results := make([]searchResult, 0, len(stores))
+		for _, s := range stores {
+			results = append(results, searchResult{store: s})
+		}
+		renderStorePage(c, results, pageSize, next, scope)
+		return
+	}
+
+	// Without text the ranking is by distance alone, so the nearest stores are
+	// found through the geohash index rather than by scoring every store.
+	// Stores without coordinates cannot be ranked and are left out.
+	if len(tokenize(name)) == 0 && len(tokenize(location)) == 0 {
+		nearest, err := nearestStores(c.Request.Context(), ranking.Lat, ranking.Lon, cursor.Offset+pageSize+1, areaID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		results := make([]searchResult, len(nearest))
+		for i, n := range nearest {
+			d := n.DistanceMeters
+			results[i] = searchResult{store: n.store, DistanceMeters: &d, Score: ranking.Weight * proximity(d, ranking.ScaleMeters)}
+		}
+		page, next := pageResults(results, pageSize, cursor)
+		renderStorePage(c, page, pageSize, next, scope)
 		return
 	}
 
 	// Perform parallel search
 	searchParams := []searchCriteria{
-		{AreaID: areaID, Name: name, Location: location},
+		{AreaID: areaID, Name: name, Location: location, Fuzzy: fuzzy},
 	}
-	stores, err := parallelStoreSearch(searchParams)
+	stores, err := parallelStoreSearch(c.Request.Context(), searchParams)
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.Error(err)
 		return
 	}
-
-	if len(stores) == 0 {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "no stores found"})
-	} else {
-		c.IndentedJSON(http.StatusOK, stores)
+	if ranking != nil {
+		rankByDistance(stores, *ranking)
 	}
+
+	// Ranked results are ordered in memory, so they page by offset. No
+	// matches is an empty page, not an error.
+	page, next := pageResults(stores, pageSize, cursor)
+	renderStorePage(c, page, pageSize, next, scope)
 }
 
 func main() {
-	// Initialize Cassandra connection
-	initCassandra()
-	defer session.Close()
+	if err := runCommand(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runServe starts the HTTP API
+func runServe(args []string) error {
+	cfg, err := loadConfig(newFlagSet("serve", ""), args)
+	if err != nil {
+		return err
+	}
+
+	// Initialize the configured storage backend
+	closeRepositories, err := setupRepositories(cfg)
+	if err != nil {
+		return fmt.Errorf("initializing storage: %w", err)
+	}
+	defer closeRepositories()
+
+	// validate has already checked the networks
+	trusted, _ := parseNetworks(cfg.Server.TrustedNetworks)
+
+	if cfg.Server.CursorSecret != "" {
+		cursorKey = []byte(cfg.Server.CursorSecret)
+	} else {
+		log.Println("No cursor secret configured; pagination cursors only work on this instance")
+	}
 
-	// Seed some initial data if the database is empty
 	r := gin.Default()
+	r.Use(ErrorMiddleware())
 	r.Use(ResponseTimeMiddleware())
+	r.Use(ConsistencyMiddleware(trusted))
 
 	// API Routes
-	r.GET("/stores", getStores)
-	r.GET("/stores/:id", getStoreByID)
-	r.GET("/stores/area/:areaid", getStoresByAreaID)
-	r.POST("/stores", postStores)
-	r.GET("/stores/search", searchStores)
+	registerRoutes(r)
 
 	// Start the server
-	r.Run(":8080")
+	server := &http.Server{
+		Addr:         cfg.Server.ListenAddr,
+		Handler:      r,
+		ReadTimeout:  time.Duration(cfg.Server.ReadTimeout),
+		WriteTimeout: time.Duration(cfg.Server.WriteTimeout),
+		IdleTimeout:  time.Duration(cfg.Server.IdleTimeout),
+	}
+	log.Printf("Listening on %s", cfg.Server.ListenAddr)
+	return server.ListenAndServe()
 }
 
 
@@ -539,37 +691,6 @@ func main() {
 // 	})
 // }
 
-// // createStore adds a new store
-// func createStore(c *gin.Context) {
-// 	var newStore Store
-// 	if err := c.ShouldBindJSON(&newStore); err != nil {
-// 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-// 		return
-// 	}
-
-// 	// Check if store with same ID already exists
-// 	var existingStore Store
-// 	err := session.Query("SELECT id FROM stores WHERE area_id = ? AND id = ?",
-// 		newStore.AreaID, newStore.ID).Scan(&existingStore.ID)
-
-// 	if err == nil {
-// 		c.JSON(http.StatusConflict, gin.H{"error": "Store with this ID already exists in the area"})
-// 		return
-// 	}
-
-// 	// Insert the new store into Cassandra
-// 	err = session.Query(`INSERT INTO stores (id, area_id, name, location)
-// 		VALUES (?, ?, ?, ?)`,
-// 		newStore.ID, newStore.AreaID, newStore.Name, newStore.Location).Exec()
-
-// 	if err != nil {
-// 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-// 		return
-// 	}
-
-// 	c.JSON(http.StatusCreated, newStore)
-// }
-
 // // updateStore updates an existing store
 // func updateStore(c *gin.Context) {
 // 	idParam := c.Param("id")
@@ -647,28 +768,6 @@ func main() {
 // 	c.JSON(http.StatusOK, gin.H{"message": "Store deleted successfully"})
 // }
 
-// func main() {
-// 	// Initialize Cassandra connection
-// 	initCassandra()
-// 	defer session.Close()
-
-// 	// Setup Gin router
-// 	router := gin.Default()
-
-// 	// Add middleware
-// 	router.Use(responseTimeMiddleware())
-
-// 	// Define routes with improved REST conventions
-// 	router.GET("/stores", getAllStores)
-// 	router.GET("/stores/:id", getStoreByID)
-// 	router.GET("/areas/:area_id/stores", getStoresByAreaID)
-// 	router.POST("/stores", createStore)
-// 	router.PUT("/stores/:id", updateStore)
-// 	router.DELETE("/stores/:id", deleteStore)
-
-// 	// Run the server
-// 	router.Run("localhost:8080")
-// }
 
 // package main
 
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStoreRepository keeps stores in a map. It is safe for concurrent use
+// and lets the API run without Cassandra.
+type memoryStoreRepository struct {
+	mu     sync.RWMutex
+	stores map[int]store
+	lastID int
+}
+
+func newMemoryStoreRepository() *memoryStoreRepository {
+	return &memoryStoreRepository{stores: make(map[int]store)}
+}
+
+// clone copies a store so callers cannot alias the coordinates held by the repository
+func (s store) clone() store {
+	if s.Latitude != nil {
+		lat := *s.Latitude
+		s.Latitude = &lat
+	}
+	if s.Longitude != nil {
+		lon := *s.Longitude
+		s.Longitude = &lon
+	}
+	return s
+}
+
+// snapshot returns copies of the stores accepted by keep, ordered by ID
+func (r *memoryStoreRepository) snapshot(keep func(store) bool) []store {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stores := make([]store, 0, len(r.stores))
+	for _, s := range r.stores {
+		if keep == nil || keep(s) {
+			stores = append(stores, s.clone())
+		}
+	}
+	sort.Slice(stores, func(i, j int) bool { return stores[i].ID < stores[j].ID })
+	return stores
+}
+
+func (r *memoryStoreRepository) Get(ctx context.Context, id int) (store, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s, ok := r.stores[id]
+	if !ok {
+		return store{}, errStoreNotFound
+	}
+	return s.clone(), nil
+}
+
+func (r *memoryStoreRepository) List(ctx context.Context, pageSize int, cursor pageCursor) ([]store, pageCursor, error) {
+	page, next := pageResults(r.snapshot(nil), pageSize, cursor)
+	return page, next, nil
+}
+
+func (r *memoryStoreRepository) ListByArea(ctx context.Context, areaID, pageSize int, cursor pageCursor) ([]store, pageCursor, error) {
+	stores := r.snapshot(func(s store) bool { return s.AreaID == areaID })
+	page, next := pageResults(stores, pageSize, cursor)
+	return page, next, nil
+}
+
+func (r *memoryStoreRepository) Search(ctx context.Context, criteria searchCriteria) ([]searchResult, error) {
+	return scoreStores(r.snapshot(nil), criteria), nil
+}
+
+func (r *memoryStoreRepository) Within(ctx context.Context, box boundingBox) ([]store, error) {
+	return r.snapshot(func(s store) bool {
+		return s.hasCoordinates() && box.contains(*s.Latitude, *s.Longitude)
+	}), nil
+}
+
+func (r *memoryStoreRepository) NextID(ctx context.Context) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The counter can never move past maxID, so it is never handed out
+	if r.lastID+1 >= maxID {
+		return 0, errIDsExhausted
+	}
+	r.lastID++
+	return r.lastID, nil
+}
+
+func (r *memoryStoreRepository) Create(ctx context.Context, s store) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.stores[s.ID]; ok {
+		return errStoreExists
+	}
+	s.Version = nextVersion(0)
+	r.stores[s.ID] = s.clone()
+	r.lastID = max(r.lastID, s.ID)
+	return nil
+}
+
+func (r *memoryStoreRepository) BatchCreate(ctx context.Context, stores []store) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range stores {
+		s.Version = nextVersion(r.stores[s.ID].Version)
+		r.stores[s.ID] = s.clone()
+		r.lastID = max(r.lastID, s.ID)
+	}
+	return nil
+}
+
+func (r *memoryStoreRepository) Update(ctx context.Context, s store, ifVersion int64) (store, store, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.stores[s.ID]
+	if !ok {
+		return store{}, store{}, errStoreNotFound
+	}
+	if ifVersion != anyVersion && current.Version != ifVersion {
+		return store{}, store{}, errVersionConflict
+	}
+	s.Version = nextVersion(current.Version)
+	r.stores[s.ID] = s.clone()
+	return s, current.clone(), nil
+}
+
+func (r *memoryStoreRepository) UpdateColumns(ctx context.Context, s store, columns []string, ifVersion int64) (store, store, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.stores[s.ID]
+	if !ok {
+		return store{}, store{}, errStoreNotFound
+	}
+	if ifVersion != anyVersion && current.Version != ifVersion {
+		return store{}, store{}, errVersionConflict
+	}
+	updated := current.withColumns(s.clone(), columns)
+	updated.Version = nextVersion(current.Version)
+	r.stores[s.ID] = updated
+	return updated.clone(), current.clone(), nil
+}
+
+func (r *memoryStoreRepository) Delete(ctx context.Context, id int, ifVersion int64) (store, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.stores[id]
+	if !ok {
+		return store{}, errStoreNotFound
+	}
+	if ifVersion != anyVersion && current.Version != ifVersion {
+		return store{}, errVersionConflict
+	}
+	delete(r.stores, id)
+	return current, nil
+}
+
+// memoryAreaRepository keeps areas in a map. It is safe for concurrent use.
+type memoryAreaRepository struct {
+	mu    sync.RWMutex
+	areas map[int]area
+}
+
+func newMemoryAreaRepository() *memoryAreaRepository {
+	return &memoryAreaRepository{areas: make(map[int]area)}
+}
+
+func (r *memoryAreaRepository) List(ctx context.Context) ([]area, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	areas := make([]area, 0, len(r.areas))
+	for _, a := range r.areas {
+		areas = append(areas, a)
+	}
+	sort.Slice(areas, func(i, j int) bool { return areas[i].ID < areas[j].ID })
+	return areas, nil
+}
+
+func (r *memoryAreaRepository) Get(ctx context.Context, id int) (area, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	a, ok := r.areas[id]
+	if !ok {
+		return area{}, errAreaNotFound
+	}
+	return a, nil
+}
+
+func (r *memoryAreaRepository) Create(ctx context.Context, a area) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.areas[a.ID]; ok {
+		return errAreaExists
+	}
+	a.Boundary = append([]byte(nil), a.Boundary...)
+	r.areas[a.ID] = a
+	return nil
+}
+
+func (r *memoryAreaRepository) Save(ctx context.Context, a area) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a.Boundary = append([]byte(nil), a.Boundary...)
+	r.areas[a.ID] = a
+	return nil
+}
+
+func (r *memoryAreaRepository) Delete(ctx context.Context, id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.areas, id)
+	return nil
+}
+
+type memorySeedRepository struct {
+	mu      sync.RWMutex
+	records map[string]seedRecord
+}
+
+func newMemorySeedRepository() *memorySeedRepository {
+	return &memorySeedRepository{records: make(map[string]seedRecord)}
+}
+
+func (r *memorySeedRepository) Get(ctx context.Context, key string) (seedRecord, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rec, ok := r.records[key]
+	if !ok {
+		return seedRecord{}, errSeedNotFound
+	}
+	return rec, nil
+}
+
+func (r *memorySeedRepository) Claim(ctx context.Context, key string, id int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if held, ok := r.records[key]; ok {
+		return held.StoreID, nil
+	}
+	r.records[key] = seedRecord{Key: key, StoreID: id}
+	return id, nil
+}
+
+func (r *memorySeedRepository) Save(ctx context.Context, rec seedRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// As in Cassandra, saving never remaps a claimed key
+	if held, ok := r.records[rec.Key]; ok {
+		rec.StoreID = held.StoreID
+	}
+	r.records[rec.Key] = rec
+	return nil
+}
+
+// memoryIdempotencyRepository keeps idempotency records in a map, dropping
+// them once they expire. It is safe for concurrent use.
+type memoryIdempotencyRepository struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	records map[string]memoryIdempotencyEntry
+}
+
+type memoryIdempotencyEntry struct {
+	rec     idempotencyRecord
+	expires time.Time
+}
+
+func newMemoryIdempotencyRepository(ttl time.Duration) *memoryIdempotencyRepository {
+	return &memoryIdempotencyRepository{ttl: ttl, records: make(map[string]memoryIdempotencyEntry)}
+}
+
+func (r *memoryIdempotencyRepository) Claim(ctx context.Context, rec idempotencyRecord) (idempotencyRecord, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for key, e := range r.records {
+		if now.After(e.expires) {
+			delete(r.records, key)
+		}
+	}
+	if e, ok := r.records[rec.Key]; ok {
+		return e.rec, false, nil
+	}
+	r.records[rec.Key] = memoryIdempotencyEntry{rec: rec, expires: now.Add(idempotencyClaimTTL)}
+	return rec, true, nil
+}
+
+// held reports whether the key is still claimed by rec's claim. The caller
+// must hold r.mu.
+func (r *memoryIdempotencyRepository) held(rec idempotencyRecord) bool {
+	e, ok := r.records[rec.Key]
+	return ok && e.rec.Claim == rec.Claim && time.Now().Before(e.expires)
+}
+
+func (r *memoryIdempotencyRepository) Renew(ctx context.Context, rec idempotencyRecord) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.held(rec) {
+		return false, nil
+	}
+	e := r.records[rec.Key]
+	e.expires = time.Now().Add(idempotencyClaimTTL)
+	r.records[rec.Key] = e
+	return true, nil
+}
+
+func (r *memoryIdempotencyRepository) Complete(ctx context.Context, rec idempotencyRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.held(rec) {
+		return errClaimLost
+	}
+	r.records[rec.Key] = memoryIdempotencyEntry{rec: rec, expires: time.Now().Add(r.ttl)}
+	return nil
+}
+
+func (r *memoryIdempotencyRepository) Release(ctx context.Context, rec idempotencyRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.records[rec.Key]; ok && e.rec.Claim == rec.Claim {
+		delete(r.records, rec.Key)
+	}
+	return nil
+}
+
+// memoryLegacyIDRepository keeps the UUID mappings in maps. It is safe for
+// concurrent use.
+type memoryLegacyIDRepository struct {
+	mu    sync.RWMutex
+	ids   map[string]int
+	uuids map[int]string
+}
+
+func newMemoryLegacyIDRepository() *memoryLegacyIDRepository {
+	return &memoryLegacyIDRepository{ids: make(map[string]int), uuids: make(map[int]string)}
+}
+
+func (r *memoryLegacyIDRepository) Get(ctx context.Context, uuid string) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.ids[uuid]
+	if !ok {
+		return 0, errUUIDNotFound
+	}
+	return id, nil
+}
+
+func (r *memoryLegacyIDRepository) UUIDs(ctx context.Context, ids []int) (map[int]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	uuids := make(map[int]string)
+	for _, id := range ids {
+		if uuid, ok := r.uuids[id]; ok {
+			uuids[id] = uuid
+		}
+	}
+	return uuids, nil
+}
+
+func (r *memoryLegacyIDRepository) Claim(ctx context.Context, uuid string, id int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if held, ok := r.ids[uuid]; ok {
+		return held, nil
+	}
+	r.ids[uuid] = id
+	r.uuids[id] = uuid
+	return id, nil
+}
+
+func (r *memoryLegacyIDRepository) Delete(ctx context.Context, uuid string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id, ok := r.ids[uuid]; ok {
+		delete(r.uuids, id)
+		delete(r.ids, uuid)
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useMemoryRepositories points every repository at a fresh in-memory backend
+// for the duration of a test, with the suggestion index kept as the server
+// keeps it
+func useMemoryRepositories(t *testing.T) {
+	t.Helper()
+	stores, areas, seeds, keys, uuids, index := storeRepo, areaRepo, seedRepo, idempotencyRepo, legacyIDRepo, suggestions
+	t.Cleanup(func() {
+		storeRepo, areaRepo, seedRepo, idempotencyRepo, legacyIDRepo, suggestions = stores, areas, seeds, keys, uuids, index
+	})
+
+	cfg := defaultConfig()
+	cfg.Backend = "memory"
+	if _, err := setupRepositories(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestRouter serves the API as runServe does, without logging
+func newTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(ErrorMiddleware())
+	registerRoutes(r)
+	return r
+}
+
+// serve sends one request to r. headers are name, value pairs.
+func serve(r *gin.Engine, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// mustCreateStores writes stores through the repository
+func mustCreateStores(t *testing.T, stores ...store) {
+	t.Helper()
+	for _, s := range stores {
+		if err := storeRepo.Create(context.Background(), s); err != nil {
+			t.Fatalf("creating store %d: %v", s.ID, err)
+		}
+	}
+}
+
+// testArea is a square area around [0, 0] to [10, 10]
+func testArea(id int) area {
+	return area{ID: id, Name: "Area " + string(rune('A'+id-1)), Boundary: []byte(`{"type":"Polygon","coordinates":[[[0,0],[10,0],[10,10],[0,10],[0,0]]]}`)}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMemoryStoreRepository(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryStoreRepository()
+
+	for _, s := range []store{
+		{ID: 3, AreaID: 1, Name: "Three"},
+		{ID: 1, AreaID: 1, Name: "One", Latitude: ptr(1.0), Longitude: ptr(1.0)},
+		{ID: 2, AreaID: 2, Name: "Two", Latitude: ptr(5.0), Longitude: ptr(5.0)},
+	} {
+		if err := repo.Create(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		got  func() ([]store, error)
+		want []int
+	}{
+		{"list is ordered by id", func() ([]store, error) {
+			s, _, err := repo.List(ctx, 10, pageCursor{})
+			return s, err
+		}, []int{1, 2, 3}},
+		{"list by area", func() ([]store, error) {
+			s, _, err := repo.ListByArea(ctx, 1, 10, pageCursor{})
+			return s, err
+		}, []int{1, 3}},
+		{"within skips stores without coordinates", func() ([]store, error) {
+			return repo.Within(ctx, boundingBox{MinLat: 0, MinLon: 0, MaxLat: 2, MaxLon: 2})
+		}, []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.got()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := storeIDs(got); !equalInts(ids, tt.want) {
+				t.Errorf("got %v, want %v", ids, tt.want)
+			}
+		})
+	}
+
+	t.Run("create rejects a taken id", func(t *testing.T) {
+		if err := repo.Create(ctx, store{ID: 1, Name: "Again"}); !errors.Is(err, errStoreExists) {
+			t.Errorf("got %v, want errStoreExists", err)
+		}
+	})
+
+	t.Run("get returns copies", func(t *testing.T) {
+		s, _ := repo.Get(ctx, 1)
+		*s.Latitude = 50
+		again, _ := repo.Get(ctx, 1)
+		if *again.Latitude != 1 {
+			t.Errorf("stored latitude changed to %v", *again.Latitude)
+		}
+	})
+}
+
+func TestMemoryStoreRepositoryVersions(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryStoreRepository()
+	if err := repo.Create(ctx, store{ID: 1, Name: "One"}); err != nil {
+		t.Fatal(err)
+	}
+	created, _ := repo.Get(ctx, 1)
+
+	tests := []struct {
+		name      string
+		id        int
+		ifVersion int64
+		want      error
+	}{
+		{"stale version", 1, created.Version - 1, errVersionConflict},
+		{"missing store", 9, anyVersion, errStoreNotFound},
+		{"current version", 1, created.Version, nil},
+		{"any version", 1, anyVersion, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, _ := repo.Get(ctx, tt.id)
+			updated, replaced, err := repo.Update(ctx, store{ID: tt.id, Name: "Renamed"}, tt.ifVersion)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err == nil && updated.Version <= created.Version {
+				t.Errorf("version %d did not advance past %d", updated.Version, created.Version)
+			}
+			if err == nil && replaced.Version != before.Version {
+				t.Errorf("replaced version %d, want the %d it overwrote", replaced.Version, before.Version)
+			}
+		})
+	}
+
+	if _, err := repo.Delete(ctx, 1, created.Version); !errors.Is(err, errVersionConflict) {
+		t.Errorf("delete at a stale version: got %v, want errVersionConflict", err)
+	}
+	if deleted, err := repo.Delete(ctx, 1, anyVersion); err != nil || deleted.Name != "Renamed" {
+		t.Errorf("delete: got %+v, %v, want the renamed store", deleted, err)
+	}
+	if _, err := repo.Get(ctx, 1); !errors.Is(err, errStoreNotFound) {
+		t.Errorf("get after delete: got %v, want errStoreNotFound", err)
+	}
+}
+
+func TestMemoryStoreRepositoryNextID(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryStoreRepository()
+	// Allocation continues after the IDs clients chose, whichever way they
+	// were written, as the Cassandra counter does
+	if err := repo.Create(ctx, store{ID: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.BatchCreate(ctx, []store{{ID: 7}, {ID: 5}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []int
+	for range 3 {
+		id, err := repo.NextID(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, id)
+	}
+	if want := []int{8, 9, 10}; !equalInts(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Writing a lower ID does not move the counter back
+	if err := repo.Create(ctx, store{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := repo.NextID(ctx); id != 11 {
+		t.Errorf("got %d after writing store 1, want 11", id)
+	}
+
+	// A client taking the last ID a CQL int holds ends allocation
+	if err := repo.Create(ctx, store{ID: maxID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.NextID(ctx); err != errIDsExhausted {
+		t.Errorf("got %v after writing store %d, want errIDsExhausted", err, maxID)
+	}
+}
+
+func TestMemoryStoreRepositoryUpdateColumns(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryStoreRepository()
+	if err := repo.Create(ctx, store{ID: 1, AreaID: 1, Name: "A", Location: "Main St"}); err != nil {
+		t.Fatal(err)
+	}
+	// Another writer changes the location after the patch read the store
+	if _, _, err := repo.Update(ctx, store{ID: 1, AreaID: 1, Name: "A", Location: "High St"}, anyVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	s, replaced, err := repo.UpdateColumns(ctx, store{ID: 1, AreaID: 1, Name: "Renamed", Location: "Main St"}, []string{"name"}, anyVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "Renamed" || s.Location != "High St" {
+		t.Errorf("got %+v, want only the name written", s)
+	}
+	if replaced.Name != "A" || replaced.Location != "High St" {
+		t.Errorf("replaced %+v, want the other writer's row", replaced)
+	}
+	if _, _, err := repo.UpdateColumns(ctx, store{ID: 1, Name: "X"}, []string{"name"}, s.Version+1); !errors.Is(err, errVersionConflict) {
+		t.Errorf("got %v, want errVersionConflict", err)
+	}
+}
+
+func TestMemoryAreaRepository(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryAreaRepository()
+
+	if err := repo.Create(ctx, testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Create(ctx, testArea(1)); !errors.Is(err, errAreaExists) {
+		t.Errorf("second create: got %v, want errAreaExists", err)
+	}
+	if err := repo.Save(ctx, area{ID: 1, Name: "Renamed", Boundary: testArea(1).Boundary}); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := repo.Get(ctx, 1); a.Name != "Renamed" {
+		t.Errorf("save did not replace the area, name is %q", a.Name)
+	}
+	if err := repo.Delete(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Get(ctx, 1); !errors.Is(err, errAreaNotFound) {
+		t.Errorf("get after delete: got %v, want errAreaNotFound", err)
+	}
+}
+
+func TestSuggestingStoreRepository(t *testing.T) {
+	useMemoryRepositories(t)
+	ctx := context.Background()
+
+	mustCreateStores(t, store{ID: 1, Name: "Harbour Books"})
+	s, _ := storeRepo.Get(ctx, 1)
+	s.Name = "Hilltop Books"
+	if _, _, err := storeRepo.Update(ctx, s, anyVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prefix string
+		want   int
+	}{
+		{"harb", 0},
+		{"hill", 1},
+	}
+	for _, tt := range tests {
+		if got := suggestions.suggest(tt.prefix, 10); len(got) != tt.want {
+			t.Errorf("suggest(%q) = %v, want %d suggestions", tt.prefix, got, tt.want)
+		}
+	}
+
+	if _, err := storeRepo.Delete(ctx, 1, anyVersion); err != nil {
+		t.Fatal(err)
+	}
+	if got := suggestions.suggest("hill", 10); len(got) != 0 {
+		t.Errorf("suggestions after delete = %v, want none", got)
+	}
+}
+
+// interleavedUpdates is a store repository letting another write land after
+// a caller's update was issued but before it is applied
+type interleavedUpdates struct {
+	StoreRepository
+	before func()
+}
+
+func (r *interleavedUpdates) Update(ctx context.Context, s store, ifVersion int64) (store, store, error) {
+	if before := r.before; before != nil {
+		r.before = nil
+		before()
+	}
+	return r.StoreRepository.Update(ctx, s, ifVersion)
+}
+
+func TestSuggestingStoreRepositoryRacingUpdates(t *testing.T) {
+	ctx := context.Background()
+	inner := &interleavedUpdates{StoreRepository: newMemoryStoreRepository()}
+	repo := &suggestingStoreRepository{StoreRepository: inner, index: newSuggestionIndex()}
+	if err := repo.Create(ctx, store{ID: 1, Name: "Harbour Books"}); err != nil {
+		t.Fatal(err)
+	}
+	inner.before = func() {
+		if _, _, err := repo.Update(ctx, store{ID: 1, Name: "Quayside Books"}, anyVersion); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, _, err := repo.Update(ctx, store{ID: 1, Name: "Hilltop Books"}, anyVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	// The intermediate name was replaced by the second update, not the first
+	for prefix, want := range map[string]int{"harb": 0, "quay": 0, "hill": 1} {
+		if got := repo.index.suggest(prefix, 10); len(got) != want {
+			t.Errorf("suggest(%q) = %v, want %d suggestions", prefix, got, want)
+		}
+	}
+}
@@ -0,0 +1,838 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// migrationFiles holds the numbered schema scripts, NNNN_description.up.cql
+// and NNNN_description.down.cql, compiled into the binary
+//
+//go:embed migrations/*.cql
+var migrationFiles embed.FS
+
+const (
+	// backfillPageSize is how many stores rows the backfill copies per page
+	backfillPageSize = 500
+	// migrationLockTTL releases the lock of an instance that died mid-migration
+	migrationLockTTL = 10 * time.Minute
+	// migrationLockRenewal is how often a running migration extends its lock
+	migrationLockRenewal = migrationLockTTL / 5
+	// migrationLockWait is how long to wait for another instance's migration
+	migrationLockWait = 2 * time.Minute
+)
+
+// Migration versions other code checks for
+const (
+	migrationInitialSchema  = 1
+	migrationBackfillByArea = 3
+	migrationAreaReads      = 4
+	migrationIDCounter      = 7
+	migrationSearchReads    = 12
+)
+
+// dataMigrations are Go steps run after the CQL of their version, for changes
+// CQL cannot express. Like the scripts they must be safe to run again.
+var dataMigrations = map[int]func(ctx context.Context, session *gocql.Session) error{
+	migrationInitialSchema:  addStoreCoordinates,
+	migrationBackfillByArea: backfillStoresByArea,
+	migrationAreaReads:      reconcileStoresByArea,
+	migrationIDCounter:      initStoreIDCounter,
+	migrationSearchReads:    rebuildSearchIndex,
+}
+
+// explicitMigrations are cutovers that only "migrate up" applies, once no
+// instance of the previous release is writing. Startup leaves them pending and
+// applies the migrations after them, which must not depend on them.
+var explicitMigrations = map[int]bool{
+	migrationAreaReads:   true,
+	migrationSearchReads: true,
+}
+
+// latestMigration is the target of a "migrate up" without a version
+const latestMigration = math.MaxInt
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.cql$`)
+
+// migration is one numbered step of the schema history
+type migration struct {
+	version     int
+	description string
+	up          string
+	down        string
+	checksum    string
+}
+
+// appliedMigration is a row of schema_migrations
+type appliedMigration struct {
+	description string
+	checksum    string
+	appliedAt   time.Time
+}
+
+// loadMigrations reads the embedded scripts ordered by version
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		body, err := fs.ReadFile(migrationFiles, path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, description: match[2]}
+			byVersion[version] = m
+		} else if m.description != match[2] {
+			return nil, fmt.Errorf("migration %d has files with different names", version)
+		}
+		if match[3] == "up" {
+			m.up = string(body)
+			sum := sha256.Sum256(body)
+			m.checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.checksum == "" {
+			return nil, fmt.Errorf("migration %d has no up script", m.version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// cqlStatements splits a script into statements, dropping -- comment lines
+func cqlStatements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+
+	var statements []string
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			statements = append(statements, stmt)
+		}
+	}
+	return statements
+}
+
+// migrator applies the embedded migrations to a keyspace, holding the lock
+// row in schema_migration_lock while it changes anything
+type migrator struct {
+	session    *gocql.Session
+	migrations []migration
+	owner      string
+}
+
+func newMigrator(session *gocql.Session) (*migrator, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	return &migrator{session: session, migrations: migrations, owner: fmt.Sprintf("%s:%d", host, os.Getpid())}, nil
+}
+
+// prepare creates the bookkeeping tables
+func (m *migrator) prepare(ctx context.Context) error {
+	err := m.session.Query(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version int PRIMARY KEY,
+		description text,
+		checksum text,
+		applied_at timestamp
+	)`).WithContext(ctx).Exec()
+	if err != nil {
+		return fmt.Errorf("creating schema_migrations table: %w", err)
+	}
+	// Rows recorded before checksums were tracked lack the column
+	if err := ensureColumn(m.session, "schema_migrations", "checksum", "text"); err != nil {
+		return fmt.Errorf("adding checksum column: %w", err)
+	}
+
+	err = m.session.Query(`CREATE TABLE IF NOT EXISTS schema_migration_lock (
+		name text PRIMARY KEY,
+		owner text,
+		acquired_at timestamp
+	)`).WithContext(ctx).Exec()
+	if err != nil {
+		return fmt.Errorf("creating schema_migration_lock table: %w", err)
+	}
+	return nil
+}
+
+var errMigrationLockLost = errors.New("migration lock was lost to another instance")
+
+// lock takes the migration lock with a lightweight transaction, waiting while
+// another instance holds it. The lock is renewed until the returned function
+// releases it; the returned context is canceled if it is lost.
+func (m *migrator) lock(ctx context.Context) (context.Context, func(), error) {
+	deadline := time.Now().Add(migrationLockWait)
+	for {
+		existing := make(map[string]interface{})
+		applied, err := m.session.Query(`INSERT INTO schema_migration_lock (name, owner, acquired_at)
+			VALUES ('schema', ?, ?) IF NOT EXISTS USING TTL ?`,
+			m.owner, time.Now(), int(migrationLockTTL.Seconds())).WithContext(ctx).MapScanCAS(existing)
+		if err != nil {
+			return nil, nil, fmt.Errorf("acquiring migration lock: %w", err)
+		}
+		if applied {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return nil, nil, fmt.Errorf("migration lock is held by %v", existing["owner"])
+		}
+		log.Printf("Waiting for migration lock held by %v", existing["owner"])
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+
+	lockCtx, lost := context.WithCancelCause(ctx)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		m.renewLock(lockCtx, lost)
+	}()
+
+	return lockCtx, func() {
+		lost(nil)
+		<-renewed
+		_, err := m.session.Query("DELETE FROM schema_migration_lock WHERE name = 'schema' IF owner = ?",
+			m.owner).MapScanCAS(make(map[string]interface{}))
+		if err != nil {
+			log.Printf("Error releasing migration lock: %v", err)
+		}
+	}, nil
+}
+
+// renewLock extends the TTL of the lock until ctx is done, so a long data
+// migration cannot outlive it. When the lock was taken over, or could not be
+// renewed before it expired, ctx is canceled to stop the migration before
+// another instance runs alongside it.
+func (m *migrator) renewLock(ctx context.Context, lost context.CancelCauseFunc) {
+	ticker := time.NewTicker(migrationLockRenewal)
+	defer ticker.Stop()
+
+	renewedAt := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		applied, err := m.session.Query(`UPDATE schema_migration_lock USING TTL ?
+			SET owner = ?, acquired_at = ? WHERE name = 'schema' IF owner = ?`,
+			int(migrationLockTTL.Seconds()), m.owner, time.Now(), m.owner).
+			WithContext(ctx).MapScanCAS(make(map[string]interface{}))
+		switch {
+		case err == nil && applied:
+			renewedAt = time.Now()
+		case err == nil:
+			lost(errMigrationLockLost)
+			return
+		case ctx.Err() != nil:
+			return
+		default:
+			log.Printf("Error renewing migration lock: %v", err)
+			if time.Since(renewedAt) >= migrationLockTTL-migrationLockRenewal {
+				lost(errMigrationLockLost)
+				return
+			}
+		}
+	}
+}
+
+// applied returns the rows of schema_migrations keyed by version
+func (m *migrator) applied(ctx context.Context) (map[int]appliedMigration, error) {
+	applied := make(map[int]appliedMigration)
+	iter := m.session.Query("SELECT version, description, checksum, applied_at FROM schema_migrations").
+		WithContext(ctx).Iter()
+
+	var version int
+	var row appliedMigration
+	for iter.Scan(&version, &row.description, &row.checksum, &row.appliedAt) {
+		applied[version] = row
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("reading schema_migrations: %w", err)
+	}
+	return applied, nil
+}
+
+// verify refuses to continue when an applied migration's script has been
+// edited or is missing from the binary. Rows recorded before checksums were
+// tracked adopt the checksum of the current script.
+func (m *migrator) verify(ctx context.Context, applied map[int]appliedMigration) error {
+	known := make(map[int]migration, len(m.migrations))
+	for _, mig := range m.migrations {
+		known[mig.version] = mig
+	}
+
+	for version, row := range applied {
+		mig, ok := known[version]
+		if !ok {
+			return fmt.Errorf("applied migration %d is not in this binary", version)
+		}
+		if row.checksum == "" {
+			err := m.session.Query("UPDATE schema_migrations SET checksum = ? WHERE version = ?",
+				mig.checksum, version).WithContext(ctx).Exec()
+			if err != nil {
+				return fmt.Errorf("recording checksum of migration %d: %w", version, err)
+			}
+			continue
+		}
+		if row.checksum != mig.checksum {
+			return fmt.Errorf("migration %d (%s) was edited after it was applied", version, mig.description)
+		}
+	}
+	return nil
+}
+
+// begin prepares the bookkeeping tables, takes the lock and verifies
+// checksums. Changes must be made with the returned context, which is
+// canceled if the lock is lost.
+func (m *migrator) begin(ctx context.Context) (context.Context, map[int]appliedMigration, func(), error) {
+	if err := m.prepare(ctx); err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	applied, err := m.applied(ctx)
+	if err == nil {
+		err = m.verify(ctx, applied)
+	}
+	if err != nil {
+		unlock()
+		return nil, nil, nil, err
+	}
+	return ctx, applied, unlock, nil
+}
+
+// lockError reports a lost lock rather than the canceled query it caused
+func lockError(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, errMigrationLockLost) {
+		return cause
+	}
+	return err
+}
+
+// exec runs every statement of a script
+func (m *migrator) exec(ctx context.Context, script string) error {
+	for _, stmt := range cqlStatements(script) {
+		if err := m.session.Query(stmt).WithContext(ctx).Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pending returns the migrations up to target that are not applied yet, in
+// version order. Unless explicit is set the explicit cutovers are left out.
+func (m *migrator) pending(applied map[int]appliedMigration, target int, explicit bool) []migration {
+	var pending []migration
+	for _, mig := range m.migrations {
+		if mig.version > target {
+			break
+		}
+		if _, ok := applied[mig.version]; ok || (explicitMigrations[mig.version] && !explicit) {
+			continue
+		}
+		pending = append(pending, mig)
+	}
+	return pending
+}
+
+// up applies the pending migrations up to target in version order. Explicit
+// cutovers are only applied when explicit is set.
+func (m *migrator) up(ctx context.Context, target int, explicit bool) error {
+	ctx, applied, unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, mig := range m.pending(applied, target, explicit) {
+		log.Printf("Applying migration %d: %s", mig.version, mig.description)
+		if err := m.exec(ctx, mig.up); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", mig.version, mig.description, lockError(ctx, err))
+		}
+		if step, ok := dataMigrations[mig.version]; ok {
+			if err := step(ctx, m.session); err != nil {
+				return fmt.Errorf("migration %d (%s): %w", mig.version, mig.description, lockError(ctx, err))
+			}
+		}
+
+		err := m.session.Query(`INSERT INTO schema_migrations (version, description, checksum, applied_at)
+			VALUES (?, ?, ?, ?)`,
+			mig.version, mig.description, mig.checksum, time.Now()).WithContext(ctx).Exec()
+		if err != nil {
+			return fmt.Errorf("recording migration %d: %w", mig.version, err)
+		}
+		applied[mig.version] = appliedMigration{}
+	}
+
+	for _, mig := range m.pending(applied, latestMigration, true) {
+		log.Printf("Migration %d (%s) is pending; run \"migrate up\" once no older release is running, then restart",
+			mig.version, mig.description)
+	}
+	return nil
+}
+
+// down reverts the latest steps applied migrations, newest first
+func (m *migrator) down(ctx context.Context, steps int) error {
+	ctx, applied, unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.version]; !ok {
+			continue
+		}
+		if mig.down == "" {
+			return fmt.Errorf("migration %d (%s) has no down script", mig.version, mig.description)
+		}
+
+		log.Printf("Reverting migration %d: %s", mig.version, mig.description)
+		if err := m.exec(ctx, mig.down); err != nil {
+			return fmt.Errorf("reverting migration %d (%s): %w", mig.version, mig.description, lockError(ctx, err))
+		}
+		err := m.session.Query("DELETE FROM schema_migrations WHERE version = ?", mig.version).
+			WithContext(ctx).Exec()
+		if err != nil {
+			return fmt.Errorf("recording revert of migration %d: %w", mig.version, err)
+		}
+		steps--
+	}
+	return nil
+}
+
+// status prints every known migration with whether it is applied and whether
+// its script still matches the recorded checksum
+func (m *migrator) status(ctx context.Context) error {
+	if err := m.prepare(ctx); err != nil {
+		return err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tDESCRIPTION\tSTATUS\tAPPLIED AT")
+	for _, mig := range m.migrations {
+		row, ok := applied[mig.version]
+		state, at := "pending", ""
+		if ok {
+			state, at = "applied", row.appliedAt.Format(time.RFC3339)
+			if row.checksum != "" && row.checksum != mig.checksum {
+				state = "modified"
+			}
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\t%s\n", mig.version, mig.description, state, at)
+	}
+	for version, row := range applied {
+		if !m.known(version) {
+			fmt.Fprintf(w, "%04d\t%s\tunknown\t%s\n", version, row.description, row.appliedAt.Format(time.RFC3339))
+		}
+	}
+	return w.Flush()
+}
+
+// known reports whether the binary contains a migration with the given version
+func (m *migrator) known(version int) bool {
+	for _, mig := range m.migrations {
+		if mig.version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateSchema applies every pending migration except the explicit
+// cutovers. It is safe to run on every startup.
+func migrateSchema(ctx context.Context, session *gocql.Session) error {
+	m, err := newMigrator(session)
+	if err != nil {
+		return err
+	}
+	return m.up(ctx, latestMigration, false)
+}
+
+// outdated reports why the applied migrations do not match this binary:
+// migrations it would apply on startup are pending, or the applied ones were
+// edited or come from a newer release. Explicit cutovers may stay pending.
+func (m *migrator) outdated(applied map[int]appliedMigration) error {
+	for _, mig := range m.migrations {
+		if row, ok := applied[mig.version]; ok && row.checksum != "" && row.checksum != mig.checksum {
+			return fmt.Errorf("migration %d (%s) was edited after it was applied", mig.version, mig.description)
+		}
+	}
+	for version := range applied {
+		if !m.known(version) {
+			return fmt.Errorf("applied migration %d is not in this binary", version)
+		}
+	}
+	if pending := m.pending(applied, latestMigration, false); len(pending) > 0 {
+		return fmt.Errorf("migration %d (%s) is pending; run \"migrate up\" first", pending[0].version, pending[0].description)
+	}
+	return nil
+}
+
+// checkSchema reads schema_migrations without changing anything and reports
+// a schema that does not match this binary
+func checkSchema(ctx context.Context, session *gocql.Session) error {
+	m, err := newMigrator(session)
+	if err != nil {
+		return err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return fmt.Errorf("%w; run \"migrate up\" first", err)
+	}
+	return m.outdated(applied)
+}
+
+// migrationApplied reports whether a version has been recorded, treating read
+// errors as not applied
+func migrationApplied(ctx context.Context, session *gocql.Session, version int) bool {
+	var v int
+	err := session.Query("SELECT version FROM schema_migrations WHERE version = ?", version).
+		WithContext(ctx).Scan(&v)
+	if err != nil && err != gocql.ErrNotFound {
+		log.Printf("Error checking migration %d: %v", version, err)
+	}
+	return err == nil
+}
+
+// runMigrateCommand implements "migrate up [version]", "migrate down [steps]"
+// and "migrate status"
+func runMigrateCommand(cfg cassandraConfig, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up [version]|down [steps]|status")
+	}
+
+	connectCassandra(cfg)
+	defer session.Close()
+
+	m, err := newMigrator(session)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		target := latestMigration
+		if len(args) > 1 {
+			target, err = strconv.Atoi(args[1])
+			if err != nil || !m.known(target) {
+				return fmt.Errorf("unknown migration version %q", args[1])
+			}
+		}
+		return m.up(ctx, target, true)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps <= 0 {
+				return fmt.Errorf("invalid step count %q", args[1])
+			}
+		}
+		return m.down(ctx, steps)
+	case "status":
+		return m.status(ctx)
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
+
+// addStoreCoordinates adds the coordinate columns to a stores table created
+// before stores had coordinates, which CREATE TABLE IF NOT EXISTS leaves as it is
+func addStoreCoordinates(ctx context.Context, session *gocql.Session) error {
+	for _, column := range []string{"latitude", "longitude"} {
+		if err := ensureColumn(session, "stores", column, "double"); err != nil {
+			return fmt.Errorf("adding stores.%s: %w", column, err)
+		}
+	}
+	return nil
+}
+
+// backfillStoresByArea copies stores into stores_by_area one page at a time.
+// Each copy keeps the source row's write time, so a newer dual-written row or
+// a delete made while the backfill runs is never overwritten by older data.
+func backfillStoresByArea(ctx context.Context, session *gocql.Session) error {
+	var state []byte
+	copied := 0
+	for {
+		iter := session.Query("SELECT " + storeColumns + ", writetime(name) FROM stores").
+			WithContext(ctx).PageSize(backfillPageSize).PageState(state).Iter()
+		state = iter.PageState()
+
+		batch := session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+		var s store
+		var written *int64
+		for iter.Scan(append(s.scanTargets(), &written)...) {
+			query := `INSERT INTO stores_by_area (area_id, id, name, location, latitude, longitude)
+				VALUES (?, ?, ?, ?, ?, ?)`
+			args := []interface{}{s.AreaID, s.ID, s.Name, s.Location, s.Latitude, s.Longitude}
+			if written != nil {
+				query += " USING TIMESTAMP ?"
+				args = append(args, *written)
+			}
+			batch.Query(query, args...)
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+
+		if batch.Size() > 0 {
+			if err := session.ExecuteBatch(batch); err != nil {
+				return err
+			}
+			copied += batch.Size()
+		}
+		if len(state) == 0 {
+			break
+		}
+	}
+
+	log.Printf("Copied %d stores into stores_by_area", copied)
+	return nil
+}
+
+// reconcileStoresByArea brings stores_by_area up to date before area listings
+// move to it. Instances of the previous release kept writing only the stores
+// table after the backfill, so their writes are copied again and the rows of
+// stores they deleted or moved to another area are dropped. Each delete
+// carries the write time of the row it drops, so it never removes a newer one.
+func reconcileStoresByArea(ctx context.Context, session *gocql.Session) error {
+	if err := backfillStoresByArea(ctx, session); err != nil {
+		return err
+	}
+
+	var state []byte
+	dropped := 0
+	for {
+		iter := session.Query("SELECT area_id, id, writetime(name) FROM stores_by_area").
+			WithContext(ctx).PageSize(backfillPageSize).PageState(state).Iter()
+		state = iter.PageState()
+
+		type areaRow struct {
+			areaID, id int
+			written    int64
+		}
+		var rows []areaRow
+		var row areaRow
+		var written *int64
+		for iter.Scan(&row.areaID, &row.id, &written) {
+			if written != nil {
+				row.written = *written
+				rows = append(rows, row)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			var current int
+			err := session.Query("SELECT area_id FROM stores WHERE id = ?", row.id).WithContext(ctx).Scan(&current)
+			if err == nil && current == row.areaID {
+				continue
+			}
+			if err != nil && err != gocql.ErrNotFound {
+				return err
+			}
+			err = session.Query("DELETE FROM stores_by_area USING TIMESTAMP ? WHERE area_id = ? AND id = ?",
+				row.written, row.areaID, row.id).WithContext(ctx).Exec()
+			if err != nil {
+				return err
+			}
+			dropped++
+		}
+		if len(state) == 0 {
+			break
+		}
+	}
+
+	log.Printf("Dropped %d stale stores_by_area rows", dropped)
+	return nil
+}
+
+// rebuildSearchIndex brings store_search_index up to date before searches
+// move to it. Instances of the previous release wrote stores without indexing
+// them, so every store is indexed again and the entries of stores they
+// deleted or renamed are dropped. Index rows carry the write time of the
+// column they index, and deletes the time the store was read, so neither
+// undoes a newer write. The index has no other state, so an interrupted
+// rebuild is simply run again.
+func rebuildSearchIndex(ctx context.Context, session *gocql.Session) error {
+	var state []byte
+	indexed := 0
+	for {
+		iter := session.Query("SELECT " + storeColumns + ", writetime(name), writetime(location) FROM stores").
+			WithContext(ctx).PageSize(backfillPageSize).PageState(state).Iter()
+		state = iter.PageState()
+
+		var s store
+		var nameWritten, locationWritten *int64
+		for iter.Scan(append(s.scanTargets(), &nameWritten, &locationWritten)...) {
+			// One batch per store keeps batches small however long the page
+			batch := session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+			for field, written := range map[string]*int64{fieldName: nameWritten, fieldLocation: locationWritten} {
+				for term := range indexTerms(fieldValue(s, field)) {
+					query := "INSERT INTO store_search_index (term, field, store_id) VALUES (?, ?, ?)"
+					args := []interface{}{term, field, s.ID}
+					if written != nil {
+						query += " USING TIMESTAMP ?"
+						args = append(args, *written)
+					}
+					batch.Query(query, args...)
+				}
+			}
+			if batch.Size() > 0 {
+				if err := session.ExecuteBatch(batch); err != nil {
+					iter.Close()
+					return err
+				}
+			}
+			indexed++
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+		if len(state) == 0 {
+			break
+		}
+	}
+
+	state = nil
+	dropped := 0
+	for {
+		iter := session.Query("SELECT term, field, store_id FROM store_search_index").
+			WithContext(ctx).PageSize(backfillPageSize).PageState(state).Iter()
+		state = iter.PageState()
+
+		type indexRow struct {
+			term, field string
+			id          int
+		}
+		var rows []indexRow
+		var row indexRow
+		for iter.Scan(&row.term, &row.field, &row.id) {
+			rows = append(rows, row)
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+
+		// A store has an entry per term, so each is read once per page
+		type storeRead struct {
+			s    *store
+			read int64
+		}
+		reads := make(map[int]storeRead)
+		for _, row := range rows {
+			current, ok := reads[row.id]
+			if !ok {
+				current.read = time.Now().UnixMicro()
+				var s store
+				err := session.Query("SELECT "+storeColumns+" FROM stores WHERE id = ?", row.id).
+					WithContext(ctx).Scan(s.scanTargets()...)
+				if err != nil && err != gocql.ErrNotFound {
+					return err
+				}
+				if err == nil {
+					current.s = &s
+				}
+				reads[row.id] = current
+			}
+			if current.s != nil && indexTerms(fieldValue(*current.s, row.field))[row.term] {
+				continue
+			}
+			err := session.Query("DELETE FROM store_search_index USING TIMESTAMP ? WHERE term = ? AND field = ? AND store_id = ?",
+				current.read, row.term, row.field, row.id).WithContext(ctx).Exec()
+			if err != nil {
+				return err
+			}
+			dropped++
+		}
+		if len(state) == 0 {
+			break
+		}
+	}
+
+	log.Printf("Indexed %d stores for search and dropped %d stale entries", indexed, dropped)
+	return nil
+}
+
+// initStoreIDCounter starts the store ID counter after the highest ID in use.
+// A counter that already exists is left alone, as it may be ahead of the
+// stores table.
+func initStoreIDCounter(ctx context.Context, session *gocql.Session) error {
+	highest := 0
+	iter := session.Query("SELECT id FROM stores").WithContext(ctx).PageSize(backfillPageSize).Iter()
+	var id int
+	for iter.Scan(&id) {
+		highest = max(highest, id)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	applied, err := session.Query("INSERT INTO id_counters (name, next_id) VALUES (?, ?) IF NOT EXISTS",
+		storeIDCounter, highest+1).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	if applied {
+		log.Printf("Store IDs will be allocated from %d", highest+1)
+	}
+	return nil
+}
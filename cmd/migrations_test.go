@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAreaPartitionedMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byVersion := make(map[int]migration)
+	for _, m := range migrations {
+		byVersion[m.version] = m
+	}
+
+	// The table is created, then filled, and only then read from
+	create, ok := byVersion[migrationBackfillByArea-1]
+	if !ok || !strings.Contains(create.up, "CREATE TABLE IF NOT EXISTS stores_by_area") {
+		t.Fatalf("migration %d does not create stores_by_area", migrationBackfillByArea-1)
+	}
+	if !strings.Contains(create.up, "PRIMARY KEY ((area_id), id)") {
+		t.Error("stores_by_area is not partitioned by area")
+	}
+	if dataMigrations[migrationBackfillByArea] == nil {
+		t.Errorf("migration %d has no backfill step", migrationBackfillByArea)
+	}
+	if migrationAreaReads <= migrationBackfillByArea {
+		t.Errorf("area reads switch at %d, before the backfill at %d", migrationAreaReads, migrationBackfillByArea)
+	}
+	if _, ok := byVersion[migrationAreaReads]; !ok {
+		t.Errorf("migration %d is missing", migrationAreaReads)
+	}
+	// Old instances write only stores until they are gone, so the switch waits
+	// for an operator and catches up on what they wrote
+	if !explicitMigrations[migrationAreaReads] {
+		t.Errorf("migration %d is applied on startup", migrationAreaReads)
+	}
+	if dataMigrations[migrationAreaReads] == nil {
+		t.Errorf("migration %d does not reconcile stores_by_area", migrationAreaReads)
+	}
+}
+
+func TestSearchIndexMigration(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, m := range migrations {
+		found = found || m.version == migrationSearchReads
+	}
+	if !found {
+		t.Fatalf("migration %d is missing", migrationSearchReads)
+	}
+	// Old instances write stores without indexing them, so the rebuild waits
+	// for an operator like the area cutover
+	if !explicitMigrations[migrationSearchReads] {
+		t.Errorf("migration %d is applied on startup", migrationSearchReads)
+	}
+	if dataMigrations[migrationSearchReads] == nil {
+		t.Errorf("migration %d does not rebuild the search index", migrationSearchReads)
+	}
+}
+
+func TestListByAreaPages(t *testing.T) {
+	useMemoryRepositories(t)
+	mustCreateStores(t,
+		store{ID: 5, AreaID: 1}, store{ID: 1, AreaID: 2}, store{ID: 3, AreaID: 1},
+		store{ID: 2, AreaID: 1}, store{ID: 4, AreaID: 2},
+	)
+
+	var ids []int
+	cursor := pageCursor{}
+	for {
+		page, next, err := storeRepo.ListByArea(context.Background(), 1, 2, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, storeIDs(page)...)
+		if next.encode() == "" {
+			break
+		}
+		cursor = next
+	}
+	if want := []int{2, 3, 5}; !equalInts(ids, want) {
+		t.Errorf("area 1 paged through %v, want %v in id order", ids, want)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %d is at position %d; versions must be consecutive", m.version, i)
+		}
+		if strings.TrimSpace(m.up) == "" || strings.TrimSpace(m.down) == "" {
+			t.Errorf("migration %d needs both an up and a down script", m.version)
+		}
+		if !migrationFileName.MatchString(fmt.Sprintf("%04d_%s.up.cql", m.version, m.description)) {
+			t.Errorf("migration %d has description %q", m.version, m.description)
+		}
+	}
+	for version := range dataMigrations {
+		if version < 1 || version > len(migrations) {
+			t.Errorf("data migration %d has no scripts", version)
+		}
+	}
+}
+
+// TestReleasedMigrationsUnchanged fails when a released script is edited.
+// Instances that applied it refuse to start on a checksum mismatch, so
+// changes go in a new migration instead.
+func TestReleasedMigrationsUnchanged(t *testing.T) {
+	released := map[int]string{
+		1: "abb63c0786cf5701c1d140310a574fdba2882141fe7af1341f8d1f30a4aa3615",
+		2: "df9cb517d17a4a3259b5016894918619780ec26c8497bd812a54302b6e0a0416",
+		3: "5360c746a6eec249f00d106fc045a3bbae9cc9200df67428575c4051a8e91f7b",
+		4: "9396133bc3d516521438a3149fd789827266d91784ac4abb1c85cd0319f70bae",
+		5: "57670e97208ffe9b554f95101fc5fa59d295635ea979b7ab7b698db8c46a150f",
+		6: "60ebc611097bf8f909ce21edc5ca2ba8470c7fd206198f1e4e76566ae6329eed",
+		7: "14a722c77fd570162cc943e42daef175616036c0612daa030cf58d0e8b6ad308",
+		8: "07ca313ff6ff756be552024b43e0ee5b2277c9eefe5b1eae7320c3705cdc616d",
+		9: "9f0a28b607b20ddec81b45d0c2a5c327430ea5feb22f45971b13a8eea15a3c57",
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		if want, ok := released[m.version]; ok && m.checksum != want {
+			t.Errorf("migration %04d_%s was edited after release", m.version, m.description)
+		}
+	}
+}
+
+func TestCQLStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{"empty", "", nil},
+		{"comments only", "-- nothing to do\n  -- at all\n", nil},
+		{"one statement without a semicolon", "DROP TABLE t", []string{"DROP TABLE t"}},
+		{"several statements", "-- two tables\nCREATE TABLE a (id int PRIMARY KEY);\n\nCREATE TABLE b (\n\tid int PRIMARY KEY\n);\n",
+			[]string{"CREATE TABLE a (id int PRIMARY KEY)", "CREATE TABLE b (\n\tid int PRIMARY KEY\n)"}},
+		{"comment between statements", "TRUNCATE a;\n-- then\nTRUNCATE b;", []string{"TRUNCATE a", "TRUNCATE b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cqlStatements(tt.script)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigratorKnown(t *testing.T) {
+	m := &migrator{migrations: []migration{{version: 1}, {version: 2}}}
+	for version, want := range map[int]bool{1: true, 2: true, 3: false, 0: false} {
+		if got := m.known(version); got != want {
+			t.Errorf("known(%d) = %v, want %v", version, got, want)
+		}
+	}
+}
+
+func TestMigratorPending(t *testing.T) {
+	m := &migrator{migrations: []migration{{version: 1}, {version: 2}, {version: migrationAreaReads}, {version: migrationAreaReads + 1}}}
+	applied := map[int]appliedMigration{1: {}}
+
+	tests := []struct {
+		name     string
+		target   int
+		explicit bool
+		want     []int
+	}{
+		{"startup leaves the cutover pending", latestMigration, false, []int{2, migrationAreaReads + 1}},
+		{"migrate up applies everything", latestMigration, true, []int{2, migrationAreaReads, migrationAreaReads + 1}},
+		{"migrate up to a version", migrationAreaReads, true, []int{2, migrationAreaReads}},
+		{"target already applied", 1, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for _, mig := range m.pending(applied, tt.target, tt.explicit) {
+				got = append(got, mig.version)
+			}
+			if !equalInts(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigratorOutdated(t *testing.T) {
+	m := &migrator{migrations: []migration{
+		{version: 1, description: "a", checksum: "1"},
+		{version: migrationAreaReads, description: "cutover", checksum: "4"},
+	}}
+
+	tests := []struct {
+		name    string
+		applied map[int]appliedMigration
+		want    string
+	}{
+		{"up to date", map[int]appliedMigration{1: {checksum: "1"}, migrationAreaReads: {checksum: "4"}}, ""},
+		{"only the cutover pending", map[int]appliedMigration{1: {checksum: "1"}}, ""},
+		{"pending migration", map[int]appliedMigration{}, "migration 1 (a) is pending"},
+		{"edited migration", map[int]appliedMigration{1: {checksum: "x"}}, "was edited"},
+		{"newer release", map[int]appliedMigration{1: {checksum: "1"}, 99: {}}, "not in this binary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := m.outdated(tt.applied)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunMigrateCommandUsage(t *testing.T) {
+	if err := runMigrateCommand(cassandraConfig{}, nil); err == nil || !strings.Contains(err.Error(), "usage") {
+		t.Errorf("got %v, want the usage", err)
+	}
+}
+
+func TestLockError(t *testing.T) {
+	queryErr := errors.New("query canceled")
+
+	lost, cancel := context.WithCancelCause(context.Background())
+	cancel(errMigrationLockLost)
+	stopped, stop := context.WithCancel(context.Background())
+	stop()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want error
+	}{
+		{"lock held", context.Background(), queryErr},
+		{"lock lost", lost, errMigrationLockLost},
+		{"canceled for another reason", stopped, queryErr},
+	}
+	for _, tt := range tests {
+		if got := lockError(tt.ctx, queryErr); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if migrationLockRenewal >= migrationLockTTL/2 {
+		t.Errorf("the lock is renewed every %v, too rarely for its %v TTL", migrationLockRenewal, migrationLockTTL)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// pageCursor is the decoded form of the opaque next_cursor token. State is the
+// Cassandra paging state for listings read straight from a table; Offset is
+// used for ranked results that are ordered in memory.
+type pageCursor struct {
+	State  []byte `json:"s,omitempty"`
+	Offset int    `json:"o,omitempty"`
+}
+
+// cursorKey signs the cursors handed to clients. It is random unless
+// configured, so instances serving the same clients must be given one to
+// accept each other's cursors.
+var cursorKey = randomCursorKey()
+
+func randomCursorKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// cursorScope identifies the query a cursor pages through: the listing, its
+// route parameters and every query parameter other than the paging ones
+func cursorScope(c *gin.Context, listing string) string {
+	query := c.Request.URL.Query()
+	query.Del("cursor")
+	query.Del("page_size")
+
+	var b strings.Builder
+	b.WriteString(listing)
+	for _, p := range c.Params {
+		b.WriteString("/" + p.Key + "=" + p.Value)
+	}
+	b.WriteString("?" + query.Encode())
+	return b.String()
+}
+
+// encode returns the opaque form of the cursor, or "" when there is no next page
+func (p pageCursor) encode() string {
+	if len(p.State) == 0 && p.Offset == 0 {
+		return ""
+	}
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// sign returns the token handed to clients: the encoded cursor and a MAC
+// binding it to the scope of its query, or "" when there is no next page
+func (p pageCursor) sign(scope string) string {
+	encoded := p.encode()
+	if encoded == "" {
+		return ""
+	}
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(cursorMAC(scope, encoded))
+}
+
+func cursorMAC(scope, encoded string) []byte {
+	mac := hmac.New(sha256.New, cursorKey)
+	mac.Write([]byte(scope))
+	mac.Write([]byte{0})
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// decodeCursor parses a token produced by pageCursor.sign for the same scope.
+// A token that was altered, or issued for another query, is rejected rather
+// than handed to the backend.
+func decodeCursor(token, scope string) (pageCursor, error) {
+	var p pageCursor
+	if token == "" {
+		return p, nil
+	}
+	encoded, signature, _ := strings.Cut(token, ".")
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, cursorMAC(scope, encoded)) {
+		return p, errors.New("invalid cursor")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return p, errors.New("invalid cursor")
+	}
+	if err := json.Unmarshal(raw, &p); err != nil || p.Offset < 0 {
+		return p, errors.New("invalid cursor")
+	}
+	return p, nil
+}
+
+// parsePageParams reads page_size and cursor from the query string. The
+// cursor must have been issued for the same scope.
+func parsePageParams(c *gin.Context, scope string) (int, pageCursor, error) {
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultPageSize)))
+	if err != nil || pageSize <= 0 {
+		return 0, pageCursor{}, errors.New("invalid page_size")
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	cursor, err := decodeCursor(c.Query("cursor"), scope)
+	if err != nil {
+		return 0, pageCursor{}, err
+	}
+	return pageSize, cursor, nil
+}
+
+// pageResults slices the page starting at the cursor offset out of an in-memory result list
+func pageResults[T any](results []T, pageSize int, cursor pageCursor) ([]T, pageCursor) {
+	start := min(cursor.Offset, len(results))
+	end := min(start+pageSize, len(results))
+
+	var next pageCursor
+	if end < len(results) {
+		next.Offset = end
+	}
+	return results[start:end], next
+}
+
+// storePage is the response envelope of paginated store listings
+type storePage[T any] struct {
+	Stores     []T    `json:"stores"`
+	PageSize   int    `json:"page_size"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// renderStorePage writes one page of a store listing inside the pagination
+// envelope or, when negotiated, as a GeoJSON FeatureCollection carrying
+// next_cursor as a foreign member. The cursor is signed for scope.
+func renderStorePage[T featurer](c *gin.Context, items []T, pageSize int, next pageCursor, scope string) {
+	if items == nil {
+		items = []T{}
+	}
+
+	if !wantsGeoJSON(c) {
+		c.IndentedJSON(http.StatusOK, storePage[T]{Stores: items, PageSize: pageSize, NextCursor: next.sign(scope)})
+		return
+	}
+
+	collection := newFeatureCollection(items)
+	collection.NextCursor = next.sign(scope)
+
+	c.Header("Content-Type", geoJSONContentType)
+	c.IndentedJSON(http.StatusOK, collection)
+}
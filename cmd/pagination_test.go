@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPageCursor(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor pageCursor
+		token  bool
+	}{
+		{"no next page", pageCursor{}, false},
+		{"paging state", pageCursor{State: []byte{0, 1, 2, 0xff}}, true},
+		{"offset", pageCursor{Offset: 50}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := tt.cursor.sign("stores")
+			if (token != "") != tt.token {
+				t.Fatalf("token %q", token)
+			}
+			if url.QueryEscape(token) != token {
+				t.Errorf("token %q is not URL safe", token)
+			}
+			got, err := decodeCursor(token, "stores")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.State, tt.cursor.State) || got.Offset != tt.cursor.Offset {
+				t.Errorf("decoded %+v, want %+v", got, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorRejects(t *testing.T) {
+	signed := func(encoded string) string {
+		return encoded + "." + base64.RawURLEncoding.EncodeToString(cursorMAC("stores", encoded))
+	}
+	valid := pageCursor{Offset: 50}.sign("stores")
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"unsigned", pageCursor{Offset: 50}.encode()},
+		{"other scope", pageCursor{Offset: 50}.sign("area/areaid=1?")},
+		{"altered", strings.Replace(valid, valid[:2], "xx", 1)},
+		{"bad signature", valid + "x"},
+		{"not base64", signed("!!")},
+		{"not JSON", signed("bm90IGpzb24")},
+		{"negative offset", signed("eyJvIjotMX0")}, // {"o":-1}
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCursor(tt.token, "stores"); err == nil {
+				t.Errorf("decodeCursor(%q) accepted", tt.token)
+			}
+		})
+	}
+}
+
+func TestPageResults(t *testing.T) {
+	items := []int{1, 2, 3, 4, 5}
+	tests := []struct {
+		name     string
+		pageSize int
+		offset   int
+		want     []int
+		next     int
+	}{
+		{"first page", 2, 0, []int{1, 2}, 2},
+		{"middle page", 2, 2, []int{3, 4}, 4},
+		{"last page", 2, 4, []int{5}, 0},
+		{"exactly the rest", 5, 0, []int{1, 2, 3, 4, 5}, 0},
+		{"past the end", 2, 9, []int{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, next := pageResults(items, tt.pageSize, pageCursor{Offset: tt.offset})
+			if !equalInts(page, tt.want) || next.Offset != tt.next {
+				t.Errorf("got %v, next %d, want %v, next %d", page, next.Offset, tt.want, tt.next)
+			}
+		})
+	}
+}
+
+func TestListStoresPages(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	for id := 1; id <= 5; id++ {
+		mustCreateStores(t, store{ID: id, AreaID: 1, Name: "Store " + strconv.Itoa(id)})
+	}
+	r := newTestRouter()
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"listing", "/v1/stores?page_size=2"},
+		{"area listing", "/v1/stores/area/1?page_size=2"},
+		{"ranked search", "/v1/stores/search?name=store&page_size=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ids []int
+			path := tt.path
+			for pages := 0; ; pages++ {
+				if pages > 5 {
+					t.Fatal("cursor never ran out")
+				}
+				w := serve(r, http.MethodGet, path, "")
+				if w.Code != http.StatusOK {
+					t.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+				var page storePage[store]
+				if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+					t.Fatal(err)
+				}
+				if len(page.Stores) > 2 || page.PageSize != 2 {
+					t.Fatalf("page of %d stores with page_size %d", len(page.Stores), page.PageSize)
+				}
+				ids = append(ids, storeIDs(page.Stores)...)
+				if page.NextCursor == "" {
+					break
+				}
+				path = tt.path + "&cursor=" + page.NextCursor
+			}
+			if want := []int{1, 2, 3, 4, 5}; !equalInts(ids, want) {
+				t.Errorf("paged through %v, want %v", ids, want)
+			}
+		})
+	}
+}
+
+func TestPageParams(t *testing.T) {
+	useMemoryRepositories(t)
+	r := newTestRouter()
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"page_size=0", http.StatusBadRequest},
+		{"page_size=x", http.StatusBadRequest},
+		{"cursor=!!", http.StatusBadRequest},
+		{"page_size=100000", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := serve(r, http.MethodGet, "/v1/stores?"+tt.query, ""); w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.query, w.Code, tt.status)
+		}
+	}
+}
+
+func TestCursorBoundToQuery(t *testing.T) {
+	useMemoryRepositories(t)
+	for _, a := range []area{testArea(1), testArea(2)} {
+		if err := areaRepo.Create(context.Background(), a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := 1; id <= 3; id++ {
+		mustCreateStores(t, store{ID: id, AreaID: 1, Name: "Store " + strconv.Itoa(id)})
+	}
+	r := newTestRouter()
+
+	w := serve(r, http.MethodGet, "/v1/stores/area/1?page_size=1", "")
+	var page storePage[store]
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || page.NextCursor == "" {
+		t.Fatalf("no cursor in %s", w.Body)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"same listing", "/v1/stores/area/1?page_size=2", http.StatusOK},
+		{"other area", "/v1/stores/area/2?page_size=1", http.StatusBadRequest},
+		{"other listing", "/v1/stores?page_size=1", http.StatusBadRequest},
+		{"other search", "/v1/stores/search?area=1&page_size=1", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(r, http.MethodGet, tt.path+"&cursor="+page.NextCursor, ""); w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// patchError is a patch that is well formed but cannot be applied to the
+// current store, such as a failed test or a path that does not exist
+type patchError string
+
+func (e patchError) Error() string { return string(e) }
+
+// applyMergePatch applies an RFC 7386 merge patch: objects are merged member
+// by member, null removes a member and anything else replaces the target
+func applyMergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+		} else {
+			d[k] = applyMergePatch(d[k], v)
+		}
+	}
+	return d
+}
+
+// patchOperation is one operation of an RFC 6902 JSON patch. Value is nil
+// when the member is missing and "null" when it is null.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies the operations in order, stopping at the first that fails
+func applyJSONPatch(doc interface{}, ops []patchOperation) (interface{}, error) {
+	for i, op := range ops {
+		var err error
+		doc, err = op.apply(doc)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func (op patchOperation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, errors.New("value is required")
+		}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, err
+		}
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = pointerGet(doc, from); err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if op.Path != op.From && strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, errors.New("cannot move a value into itself")
+			}
+			if doc, err = pointerRemove(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			value = deepCopy(value)
+		}
+	case "remove":
+	default:
+		return nil, fmt.Errorf("unknown op %q", op.Op)
+	}
+
+	switch op.Op {
+	case "add", "move", "copy":
+		return pointerAdd(doc, path, value)
+	case "replace":
+		if _, err := pointerGet(doc, path); err != nil {
+			return nil, err
+		}
+		if doc, err = pointerRemove(doc, path); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "remove":
+		return pointerRemove(doc, path)
+	default: // test
+		current, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, patchError("test failed")
+		}
+		return doc, nil
+	}
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("invalid path %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array reference token; "-", the end of the array, is
+// only accepted when adding
+func arrayIndex(token string, length int, adding bool) (int, error) {
+	if adding && token == "-" {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > length || (!adding && i == length) {
+		return 0, patchError("array index " + token + " is out of range")
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[token]
+			if !ok {
+				return nil, patchError("member " + strconv.Quote(token) + " does not exist")
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, patchError("cannot reference " + strconv.Quote(token) + " in a scalar")
+		}
+	}
+	return doc, nil
+}
+
+// pointerUpdate replaces the container holding the last token of path with
+// the result of leaf, rebuilding the containers above it
+func pointerUpdate(doc interface{}, path []string, leaf func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return leaf(doc, path[0])
+	}
+	child, err := pointerGet(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = pointerUpdate(child, path[1:], leaf)
+	if err != nil {
+		return nil, err
+	}
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		d[path[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(path[0], len(d), false)
+		d[i] = child
+	}
+	return doc, nil
+}
+
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch d := container.(type) {
+		case map[string]interface{}:
+			d[token] = value
+			return d, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(d), true)
+			if err != nil {
+				return nil, err
+			}
+			return append(d[:i], append([]interface{}{value}, d[i:]...)...), nil
+		default:
+			return nil, patchError("cannot add " + strconv.Quote(token) + " to a scalar")
+		}
+	})
+}
+
+func pointerRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, patchError("cannot remove the whole document")
+	}
+	return pointerUpdate(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch d := container.(type) {
+		case map[string]interface{}:
+			if _, ok := d[token]; !ok {
+				return nil, patchError("member " + strconv.Quote(token) + " does not exist")
+			}
+			delete(d, token)
+			return d, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(d[:i], d[i+1:]...), nil
+		default:
+			return nil, patchError("cannot remove " + strconv.Quote(token) + " from a scalar")
+		}
+	})
+}
+
+// deepCopy copies a decoded JSON value so copies do not alias the source
+func deepCopy(v interface{}) interface{} {
+	switch d := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(d))
+		for k, e := range d {
+			m[k] = deepCopy(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(d))
+		for i, e := range d {
+			s[i] = deepCopy(e)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+// patchStoreInput applies a merge or JSON patch to the input form of a store
+func patchStoreInput(current store, contentType string, body []byte) (storeInput, error) {
+	data, err := json.Marshal(current)
+	if err != nil {
+		return storeInput{}, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return storeInput{}, err
+	}
+
+	switch contentType {
+	case mergePatchType:
+		var patch interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			return storeInput{}, inputError("invalid merge patch: " + err.Error())
+		}
+		doc = applyMergePatch(doc, patch)
+	case jsonPatchType:
+		var ops []patchOperation
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return storeInput{}, inputError("invalid JSON patch: " + err.Error())
+		}
+		if doc, err = applyJSONPatch(doc, ops); err != nil {
+			var conflict patchError
+			if errors.As(err, &conflict) {
+				return storeInput{}, err
+			}
+			return storeInput{}, inputError("invalid JSON patch: " + err.Error())
+		}
+	}
+
+	// The patched document must still be a store
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return storeInput{}, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var in storeInput
+	if err := dec.Decode(&in); err != nil {
+		return storeInput{}, inputError("patched store is invalid: " + err.Error())
+	}
+	if in.ID != current.ID {
+		return storeInput{}, inputError("id cannot be changed")
+	}
+
+	// Moved stores without an explicit areaId are assigned the area containing them
+	moved := !sameFloat(in.Latitude, current.Latitude) || !sameFloat(in.Longitude, current.Longitude)
+	if moved && in.AreaID != nil && *in.AreaID == current.AreaID && in.Latitude != nil && in.Longitude != nil {
+		in.AreaID = nil
+	}
+	return in, nil
+}
+
+// patchStore applies a merge patch or JSON patch to the current store. The
+// patched store is validated as a whole, but only the columns the patch
+// changed are written, guarded by the version the patch was applied to.
+// Unless If-Match pins a version, a patch that loses a race with another
+// writer is reapplied to the store that writer left. A patch changing nothing
+// writes nothing.
+func patchStore(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Error(badRequest("invalid id"))
+		return
+	}
+
+	contentType := c.ContentType()
+	if contentType != mergePatchType && contentType != jsonPatchType {
+		c.Header("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		c.Error(unsupportedMediaType("PATCH accepts " + mergePatchType + " or " + jsonPatchType))
+		return
+	}
+	body, err := c.GetRawData()
+	if err != nil {
+		c.Error(badRequest(err.Error()))
+		return
+	}
+
+	ifVersion, ok := ifMatchVersion(c)
+	if !ok {
+		c.Error(preconditionFailed("If-Match does not match the store"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	for attempt := 1; ; attempt++ {
+		current, err := storeRepo.Get(ctx, id)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if ifVersion != anyVersion && current.Version != ifVersion {
+			c.Error(errVersionConflict)
+			return
+		}
+
+		in, err := patchStoreInput(current, contentType, body)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		s, err := storeUpdateFromInput(ctx, in, current)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		columns := changedColumns(current, s)
+		if len(columns) == 0 {
+			c.Header("ETag", storeETag(current.Version))
+			c.IndentedJSON(http.StatusOK, current)
+			return
+		}
+
+		// Write only over the version the patch was applied to
+		s, _, err = storeRepo.UpdateColumns(ctx, s, columns, current.Version)
+		if errors.Is(err, errVersionConflict) && ifVersion == anyVersion && attempt < maxUpdateAttempts {
+			continue
+		}
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.Header("ETag", storeETag(s.Version))
+		c.IndentedJSON(http.StatusOK, s)
+		return
+	}
+}
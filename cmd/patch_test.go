@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decodeJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("decoding %s: %v", s, err)
+	}
+	return v
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	// The examples of RFC 7386, appendix A
+	tests := []struct {
+		doc, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		got := applyMergePatch(decodeJSON(t, tt.doc), decodeJSON(t, tt.patch))
+		if want := decodeJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("merging %s into %s: got %v, want %v", tt.patch, tt.doc, got, want)
+		}
+	}
+}
+
+func TestParsePointer(t *testing.T) {
+	tests := []struct {
+		pointer string
+		want    []string
+		ok      bool
+	}{
+		{"", nil, true},
+		{"/", []string{""}, true},
+		{"/name", []string{"name"}, true},
+		{"/a/0/b", []string{"a", "0", "b"}, true},
+		{"/a~1b/m~0n", []string{"a/b", "m~n"}, true},
+		{"/~01", []string{"~1"}, true},
+		{"name", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := parsePointer(tt.pointer)
+		if (err == nil) != tt.ok {
+			t.Errorf("parsePointer(%q): error %v, want ok %v", tt.pointer, err, tt.ok)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePointer(%q) = %q, want %q", tt.pointer, got, tt.want)
+		}
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	const (
+		ok       = ""
+		conflict = "conflict"
+		invalid  = "invalid"
+	)
+	tests := []struct {
+		name  string
+		doc   string
+		ops   string
+		want  string
+		fails string
+	}{
+		{"add member", `{"a":1}`, `[{"op":"add","path":"/b","value":2}]`, `{"a":1,"b":2}`, ok},
+		{"add replaces a member", `{"a":1}`, `[{"op":"add","path":"/a","value":null}]`, `{"a":null}`, ok},
+		{"add to an array", `{"a":[1,3]}`, `[{"op":"add","path":"/a/1","value":2}]`, `{"a":[1,2,3]}`, ok},
+		{"append", `{"a":[1]}`, `[{"op":"add","path":"/a/-","value":2}]`, `{"a":[1,2]}`, ok},
+		{"replace the document", `{"a":1}`, `[{"op":"add","path":"","value":[1]}]`, `[1]`, ok},
+		{"remove", `{"a":1,"b":2}`, `[{"op":"remove","path":"/a"}]`, `{"b":2}`, ok},
+		{"remove from an array", `[1,2,3]`, `[{"op":"remove","path":"/1"}]`, `[1,3]`, ok},
+		{"replace", `{"a":{"b":1}}`, `[{"op":"replace","path":"/a/b","value":"x"}]`, `{"a":{"b":"x"}}`, ok},
+		{"move", `{"a":{"b":1},"c":{}}`, `[{"op":"move","from":"/a/b","path":"/c/d"}]`, `{"a":{},"c":{"d":1}}`, ok},
+		{"copy does not alias", `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`, ok},
+		{"test passes", `{"a":[1,"x"]}`, `[{"op":"test","path":"/a","value":[1,"x"]}]`, `{"a":[1,"x"]}`, ok},
+		{"escaped path", `{"a/b":1}`, `[{"op":"replace","path":"/a~1b","value":2}]`, `{"a/b":2}`, ok},
+
+		{"test fails", `{"a":1}`, `[{"op":"test","path":"/a","value":2}]`, "", conflict},
+		{"stops at a later failure", `{"a":1}`, `[{"op":"add","path":"/b","value":2},{"op":"test","path":"/b","value":3}]`, "", conflict},
+		{"replace a missing member", `{}`, `[{"op":"replace","path":"/a","value":1}]`, "", conflict},
+		{"remove a missing member", `{}`, `[{"op":"remove","path":"/a"}]`, "", conflict},
+		{"remove the document", `{}`, `[{"op":"remove","path":""}]`, "", conflict},
+		{"add under a missing parent", `{}`, `[{"op":"add","path":"/a/b","value":1}]`, "", conflict},
+		{"index out of range", `[1]`, `[{"op":"add","path":"/2","value":1}]`, "", conflict},
+		{"reference into a scalar", `{"a":1}`, `[{"op":"add","path":"/a/b","value":1}]`, "", conflict},
+
+		{"unknown op", `{}`, `[{"op":"append","path":"/a"}]`, "", invalid},
+		{"missing value", `{}`, `[{"op":"add","path":"/a"}]`, "", invalid},
+		{"relative path", `{}`, `[{"op":"add","path":"a","value":1}]`, "", invalid},
+		{"index with a leading zero", `[1,2]`, `[{"op":"remove","path":"/01"}]`, "", invalid},
+		{"dash outside add", `[1]`, `[{"op":"remove","path":"/-"}]`, "", invalid},
+		{"move into itself", `{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/b/c"}]`, "", invalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ops []patchOperation
+			if err := json.Unmarshal([]byte(tt.ops), &ops); err != nil {
+				t.Fatal(err)
+			}
+			got, err := applyJSONPatch(decodeJSON(t, tt.doc), ops)
+			if tt.fails == ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := decodeJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+					t.Errorf("got %v, want %v", got, want)
+				}
+				return
+			}
+			var pe patchError
+			switch {
+			case err == nil:
+				t.Errorf("applied as %v", got)
+			case errors.As(err, &pe) != (tt.fails == conflict):
+				t.Errorf("error %v is not a %s error", err, tt.fails)
+			}
+		})
+	}
+}
+
+func TestPatchStore(t *testing.T) {
+	useMemoryRepositories(t)
+	ctx := context.Background()
+	if err := areaRepo.Create(ctx, testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	farArea := area{ID: 2, Name: "Area B", Boundary: []byte(`{"type":"Polygon","coordinates":[[[20,20],[30,20],[30,30],[20,30],[20,20]]]}`)}
+	if err := areaRepo.Create(ctx, farArea); err != nil {
+		t.Fatal(err)
+	}
+	mustCreateStores(t, store{ID: 1, AreaID: 1, Name: "A", Location: "Main St", Latitude: ptr(5.0), Longitude: ptr(5.0)})
+	r := newTestRouter()
+	merge := []string{"Content-Type", mergePatchType}
+	jsonPatch := []string{"Content-Type", jsonPatchType}
+
+	// Each case runs against the store the previous one left
+	tests := []struct {
+		name    string
+		body    string
+		headers []string
+		status  int
+		code    string
+		check   func(t *testing.T, s store)
+	}{
+		{"merge renames", `{"name":"Renamed"}`, merge, http.StatusOK, "", func(t *testing.T, s store) {
+			if s.Name != "Renamed" || s.Location != "Main St" || s.AreaID != 1 {
+				t.Errorf("got %+v", s)
+			}
+		}},
+		{"merge null clears", `{"location":null}`, merge, http.StatusOK, "", func(t *testing.T, s store) {
+			if s.Location != "" || s.Name != "Renamed" {
+				t.Errorf("got %+v", s)
+			}
+		}},
+		{"moving reassigns the area", `{"latitude":25,"longitude":25}`, merge, http.StatusOK, "", func(t *testing.T, s store) {
+			if s.AreaID != 2 {
+				t.Errorf("moved store is in area %d, want 2", s.AreaID)
+			}
+		}},
+		{"json patch", `[{"op":"test","path":"/name","value":"Renamed"},{"op":"replace","path":"/name","value":"Patched"}]`, jsonPatch, http.StatusOK, "", func(t *testing.T, s store) {
+			if s.Name != "Patched" {
+				t.Errorf("got %+v", s)
+			}
+		}},
+		{"failed test", `[{"op":"test","path":"/name","value":"Renamed"}]`, jsonPatch, http.StatusConflict, errCodeConflict, nil},
+		{"malformed json patch", `[{"op":"jump","path":"/name"}]`, jsonPatch, http.StatusBadRequest, errCodeBadRequest, nil},
+		{"malformed merge patch", `{`, merge, http.StatusBadRequest, errCodeBadRequest, nil},
+		{"id change", `{"id":2}`, merge, http.StatusBadRequest, errCodeBadRequest, nil},
+		{"unknown member", `{"colour":"red"}`, merge, http.StatusBadRequest, errCodeBadRequest, nil},
+		{"invalid result", `{"name":""}`, merge, http.StatusBadRequest, errCodeValidation, nil},
+		{"plain json", `{"name":"X"}`, nil, http.StatusUnsupportedMediaType, errCodeUnsupportedMedia, nil},
+		{"stale If-Match", `{"name":"X"}`, append([]string{"If-Match", storeETag(1)}, merge...), http.StatusPreconditionFailed, errCodePrecondition, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodPatch, "/v1/stores/1", tt.body, tt.headers...)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.code != "" {
+				var p problem
+				if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || p.Code != tt.code {
+					t.Errorf("got %s, want a %s problem", w.Body, tt.code)
+				}
+				if tt.status == http.StatusUnsupportedMediaType && !strings.Contains(w.Header().Get("Accept-Patch"), mergePatchType) {
+					t.Errorf("Accept-Patch %q", w.Header().Get("Accept-Patch"))
+				}
+				return
+			}
+			if w.Header().Get("ETag") == "" {
+				t.Error("no ETag")
+			}
+			s, err := storeRepo.Get(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, s)
+		})
+	}
+
+	if w := serve(r, http.MethodPatch, "/v1/stores/9", `{"name":"X"}`, merge...); w.Code != http.StatusNotFound {
+		t.Errorf("patching a missing store: status %d", w.Code)
+	}
+}
+
+// recordingColumns is a store repository remembering the columns of each
+// UpdateColumns call
+type recordingColumns struct {
+	StoreRepository
+	calls [][]string
+}
+
+func (r *recordingColumns) Update(ctx context.Context, s store, ifVersion int64) (store, store, error) {
+	r.calls = append(r.calls, writableStoreColumns)
+	return r.StoreRepository.Update(ctx, s, ifVersion)
+}
+
+func (r *recordingColumns) UpdateColumns(ctx context.Context, s store, columns []string, ifVersion int64) (store, store, error) {
+	r.calls = append(r.calls, columns)
+	return r.StoreRepository.UpdateColumns(ctx, s, columns, ifVersion)
+}
+
+func TestPatchStoreWritesChangedColumns(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	mustCreateStores(t, store{ID: 1, AreaID: 1, Name: "A", Location: "Main St", Latitude: ptr(5.0), Longitude: ptr(5.0)})
+	r := newTestRouter()
+
+	tests := []struct {
+		name    string
+		body    string
+		columns []string
+	}{
+		{"rename", `{"name":"Renamed"}`, []string{"name"}},
+		{"clear the location", `{"location":null}`, []string{"location"}},
+		{"move within the area", `{"latitude":6,"longitude":6}`, []string{"latitude", "longitude"}},
+		{"change nothing", `{"name":"Renamed"}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &recordingColumns{StoreRepository: storeRepo}
+			storeRepo = repo
+			defer func() { storeRepo = repo.StoreRepository }()
+
+			w := serve(r, http.MethodPatch, "/v1/stores/1", tt.body, "Content-Type", mergePatchType)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if tt.columns == nil {
+				if len(repo.calls) != 0 {
+					t.Errorf("wrote %v for a patch changing nothing", repo.calls)
+				}
+				return
+			}
+			if len(repo.calls) != 1 || strings.Join(repo.calls[0], ",") != strings.Join(tt.columns, ",") {
+				t.Errorf("wrote %v, want %v", repo.calls, tt.columns)
+			}
+		})
+	}
+}
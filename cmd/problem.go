@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+const problemContentType = "application/problem+json"
+
+// Stable codes of API errors, sent as the code of every problem
+const (
+	errCodeBadRequest       = "bad_request"
+	errCodeValidation       = "validation_failed"
+	errCodeNotFound         = "not_found"
+	errCodeConflict         = "conflict"
+	errCodePrecondition     = "precondition_failed"
+	errCodeForbidden        = "forbidden"
+	errCodeUnsupportedMedia = "unsupported_media_type"
+	errCodeIdempotencyReuse = "idempotency_key_reused"
+	errCodeTooLarge         = "too_large"
+	errCodeUnavailable      = "unavailable"
+	errCodeTimeout          = "timeout"
+	errCodeOverloaded       = "overloaded"
+	errCodeInternal         = "internal"
+)
+
+// apiError is an error with the status, code and detail the client sees.
+// Result is what the request achieved before failing, if anything. The cause
+// is logged but never sent.
+type apiError struct {
+	Status int
+	Code   string
+	Detail string
+	Errors []fieldError
+	Result interface{}
+	Cause  error
+}
+
+func (e *apiError) Error() string {
+	if e.Cause != nil {
+		return e.Detail + ": " + e.Cause.Error()
+	}
+	return e.Detail
+}
+
+func (e *apiError) Unwrap() error { return e.Cause }
+
+func badRequest(detail string) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Code: errCodeBadRequest, Detail: detail}
+}
+
+func notFound(detail string) *apiError {
+	return &apiError{Status: http.StatusNotFound, Code: errCodeNotFound, Detail: detail}
+}
+
+func conflict(detail string) *apiError {
+	return &apiError{Status: http.StatusConflict, Code: errCodeConflict, Detail: detail}
+}
+
+func preconditionFailed(detail string) *apiError {
+	return &apiError{Status: http.StatusPreconditionFailed, Code: errCodePrecondition, Detail: detail}
+}
+
+func unsupportedMediaType(detail string) *apiError {
+	return &apiError{Status: http.StatusUnsupportedMediaType, Code: errCodeUnsupportedMedia, Detail: detail}
+}
+
+func invalidFields(detail string, errs []fieldError) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Code: errCodeValidation, Detail: detail, Errors: errs}
+}
+
+// backendError hides a storage failure behind a generic detail
+func backendError(status int, code, detail string, cause error) *apiError {
+	return &apiError{Status: status, Code: code, Detail: detail, Cause: cause}
+}
+
+// toAPIError maps an error from a handler, the repositories or the Cassandra
+// driver to what the client is told
+func toAPIError(err error) *apiError {
+	var apiErr *apiError
+	var invalid validationError
+	var bad inputError
+	var patchFailed patchError
+	var reqErr gocql.RequestError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.As(err, &invalid):
+		return invalidFields("store is invalid", invalid)
+	case errors.As(err, &bad):
+		return badRequest(bad.Error())
+	case errors.As(err, &patchFailed):
+		return conflict(err.Error())
+	case errors.Is(err, errAreaTooLarge):
+		return badRequest(err.Error())
+	case errors.Is(err, errStoreNotFound), errors.Is(err, errAreaNotFound):
+		return notFound(err.Error())
+	case errors.Is(err, errStoreExists), errors.Is(err, errAreaExists), errors.Is(err, errAreaInUse):
+		return conflict(err.Error())
+	case errors.Is(err, errIDContention):
+		return backendError(http.StatusServiceUnavailable, errCodeOverloaded, "too many stores are being created at once; retry shortly", err)
+	case errors.Is(err, errVersionConflict):
+		return preconditionFailed("store was modified; fetch it again for its current ETag")
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, gocql.ErrTimeoutNoResponse):
+		return backendError(http.StatusGatewayTimeout, errCodeTimeout, "the database did not answer in time", err)
+	case errors.Is(err, gocql.ErrNoConnections), errors.Is(err, gocql.ErrConnectionClosed),
+		errors.Is(err, gocql.ErrSessionClosed), errors.Is(err, gocql.ErrUnavailable):
+		return backendError(http.StatusServiceUnavailable, errCodeUnavailable, "the database is unavailable", err)
+	case errors.As(err, &reqErr):
+		switch reqErr.Code() {
+		case gocql.ErrCodeUnavailable, gocql.ErrCodeBootstrapping:
+			return backendError(http.StatusServiceUnavailable, errCodeUnavailable, "the database is unavailable", err)
+		case gocql.ErrCodeOverloaded:
+			return backendError(http.StatusServiceUnavailable, errCodeOverloaded, "the database is overloaded; retry shortly", err)
+		case gocql.ErrCodeReadTimeout, gocql.ErrCodeWriteTimeout, gocql.ErrCodeCASWriteUnknown:
+			return backendError(http.StatusGatewayTimeout, errCodeTimeout, "the database did not answer in time", err)
+		}
+	}
+	return backendError(http.StatusInternalServerError, errCodeInternal, "the request could not be completed", err)
+}
+
+// failureDetail describes a failed item of a batch as toAPIError would
+// describe it alone, logging the cause the client is not told
+func failureDetail(err error) string {
+	e := toAPIError(err)
+	if e.Status >= http.StatusInternalServerError {
+		log.Printf("batch item failed: %v", err)
+	}
+	return e.Detail
+}
+
+// problem is an RFC 7807 problem details body, extended with the error code
+// and the invalid fields
+type problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Code     string       `json:"code"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []fieldError `json:"errors,omitempty"`
+	Result   interface{}  `json:"result,omitempty"`
+}
+
+// writeProblem responds with the problem for an error. Its type is
+// about:blank, so the title is the status text.
+func writeProblem(c *gin.Context, e *apiError) {
+	if e.Code == errCodeOverloaded {
+		c.Header("Retry-After", "1")
+	}
+	c.Header("Content-Type", problemContentType)
+	c.IndentedJSON(e.Status, problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(e.Status),
+		Status:   e.Status,
+		Code:     e.Code,
+		Detail:   e.Detail,
+		Instance: c.Request.URL.Path,
+		Errors:   e.Errors,
+		Result:   e.Result,
+	})
+}
+
+// ErrorMiddleware turns the last error a handler attached with c.Error into
+// a problem response, logging the cause of server-side failures
+func ErrorMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		last := c.Errors.Last()
+		if last == nil || c.Writer.Written() {
+			return
+		}
+		e := toAPIError(last.Err)
+		if e.Status >= http.StatusInternalServerError {
+			log.Printf("%s %s: %v", c.Request.Method, c.Request.URL.Path, last.Err)
+		}
+		writeProblem(c, e)
+	}
+}
+
+// decodeError describes a request body that could not be read or decoded,
+// naming the field when a value had the wrong JSON type
+func decodeError(err error) *apiError {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &apiError{
+			Status: http.StatusRequestEntityTooLarge,
+			Code:   errCodeTooLarge,
+			Detail: fmt.Sprintf("request body must be at most %d bytes", tooLarge.Limit),
+		}
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		field := fieldPath(typeErr.Field)
+		return invalidFields("request body is invalid", []fieldError{{
+			Field:   field,
+			Code:    codeInvalidType,
+			Message: fmt.Sprintf("%s must be a JSON %s", field, jsonTypeName(typeErr.Type)),
+		}})
+	}
+	return badRequest(err.Error())
+}
+
+// fieldPath writes the array indexes of a decoder field path in brackets, so
+// "0.areaId" names the field as batch validation does, "[0].areaId"
+func fieldPath(field string) string {
+	var b strings.Builder
+	for i, part := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			b.WriteString("[" + part + "]")
+			continue
+		}
+		if i > 0 {
+			b.WriteString(".")
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+// jsonTypeName names the JSON type a Go type decodes from
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// requestError is a Cassandra error response with a protocol error code
+type requestError struct{ code int }
+
+func (e requestError) Code() int       { return e.code }
+func (e requestError) Message() string { return "cassandra said no" }
+func (e requestError) Error() string   { return e.Message() }
+
+func TestToAPIError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"api error", unsupportedMediaType("no"), http.StatusUnsupportedMediaType, errCodeUnsupportedMedia},
+		{"validation", validationError{{Field: "name", Code: codeRequired}}, http.StatusBadRequest, errCodeValidation},
+		{"input", inputError("id cannot be changed"), http.StatusBadRequest, errCodeBadRequest},
+		{"patch", fmt.Errorf("operation 0: %w", patchError("test failed")), http.StatusConflict, errCodeConflict},
+		{"area too large", errAreaTooLarge, http.StatusBadRequest, errCodeBadRequest},
+		{"missing store", fmt.Errorf("get: %w", errStoreNotFound), http.StatusNotFound, errCodeNotFound},
+		{"missing area", errAreaNotFound, http.StatusNotFound, errCodeNotFound},
+		{"existing store", errStoreExists, http.StatusConflict, errCodeConflict},
+		{"existing area", errAreaExists, http.StatusConflict, errCodeConflict},
+		{"area in use", errAreaInUse, http.StatusConflict, errCodeConflict},
+		{"id contention", errIDContention, http.StatusServiceUnavailable, errCodeOverloaded},
+		{"version conflict", errVersionConflict, http.StatusPreconditionFailed, errCodePrecondition},
+		{"deadline", context.DeadlineExceeded, http.StatusGatewayTimeout, errCodeTimeout},
+		{"driver timeout", gocql.ErrTimeoutNoResponse, http.StatusGatewayTimeout, errCodeTimeout},
+		{"no connections", gocql.ErrNoConnections, http.StatusServiceUnavailable, errCodeUnavailable},
+		{"closed session", fmt.Errorf("query: %w", gocql.ErrSessionClosed), http.StatusServiceUnavailable, errCodeUnavailable},
+		{"unavailable replicas", requestError{gocql.ErrCodeUnavailable}, http.StatusServiceUnavailable, errCodeUnavailable},
+		{"bootstrapping", requestError{gocql.ErrCodeBootstrapping}, http.StatusServiceUnavailable, errCodeUnavailable},
+		{"overloaded", requestError{gocql.ErrCodeOverloaded}, http.StatusServiceUnavailable, errCodeOverloaded},
+		{"read timeout", requestError{gocql.ErrCodeReadTimeout}, http.StatusGatewayTimeout, errCodeTimeout},
+		{"write timeout", requestError{gocql.ErrCodeWriteTimeout}, http.StatusGatewayTimeout, errCodeTimeout},
+		{"other request error", requestError{gocql.ErrCodeSyntax}, http.StatusInternalServerError, errCodeInternal},
+		{"anything else", errors.New("disk on fire"), http.StatusInternalServerError, errCodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := toAPIError(tt.err)
+			if e.Status != tt.status || e.Code != tt.code {
+				t.Errorf("got %d %s, want %d %s", e.Status, e.Code, tt.status, tt.code)
+			}
+			if e.Status >= http.StatusInternalServerError && strings.Contains(e.Detail, tt.err.Error()) {
+				t.Errorf("detail %q reveals the cause", e.Detail)
+			}
+		})
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	var in storeInput
+	typeErr := json.Unmarshal([]byte(`{"latitude":"north"}`), &in)
+	var list []storeInput
+	elemErr := json.Unmarshal([]byte(`[{"areaId":[1]}]`), &list)
+	topErr := json.Unmarshal([]byte(`"store"`), &in)
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+		fields []string
+	}{
+		{"too large", &http.MaxBytesError{Limit: 10}, http.StatusRequestEntityTooLarge, errCodeTooLarge, nil},
+		{"wrong type", typeErr, http.StatusBadRequest, errCodeValidation, []string{"latitude must be a JSON number"}},
+		{"wrong type in an array", elemErr, http.StatusBadRequest, errCodeValidation, []string{"[0].areaId must be a JSON number"}},
+		{"wrong type of the whole body", topErr, http.StatusBadRequest, errCodeBadRequest, nil},
+		{"syntax", json.Unmarshal([]byte(`{`), &in), http.StatusBadRequest, errCodeBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := decodeError(tt.err)
+			if e.Status != tt.status || e.Code != tt.code {
+				t.Errorf("got %d %s, want %d %s", e.Status, e.Code, tt.status, tt.code)
+			}
+			var messages []string
+			for _, f := range e.Errors {
+				messages = append(messages, f.Message)
+			}
+			if strings.Join(messages, ",") != strings.Join(tt.fields, ",") {
+				t.Errorf("field errors %q, want %q", messages, tt.fields)
+			}
+		})
+	}
+}
+
+func TestFieldPath(t *testing.T) {
+	tests := []struct{ field, want string }{
+		{"name", "name"},
+		{"0.areaId", "[0].areaId"},
+		{"features.1.properties.name", "features[1].properties.name"},
+		{"12", "[12]"},
+	}
+	for _, tt := range tests {
+		if got := fieldPath(tt.field); got != tt.want {
+			t.Errorf("fieldPath(%q) = %q, want %q", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestJSONTypeName(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{0, "number"},
+		{ptr(1.5), "number"},
+		{"", "string"},
+		{true, "boolean"},
+		{[]int{}, "array"},
+		{store{}, "object"},
+		{map[string]int{}, "object"},
+	}
+	for _, tt := range tests {
+		if got := jsonTypeName(reflect.TypeOf(tt.v)); got != tt.want {
+			t.Errorf("jsonTypeName(%T) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestErrorMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(ErrorMiddleware())
+	r.GET("/fail/:kind", func(c *gin.Context) {
+		switch c.Param("kind") {
+		case "internal":
+			c.Error(errors.New("password=hunter2"))
+		case "overloaded":
+			c.Error(requestError{gocql.ErrCodeOverloaded})
+		case "written":
+			c.Error(errors.New("logged only"))
+			c.String(http.StatusAccepted, "done")
+		case "last":
+			c.Error(badRequest("first"))
+			c.Error(errStoreNotFound)
+		}
+	})
+
+	tests := []struct {
+		kind       string
+		status     int
+		code       string
+		retryAfter string
+	}{
+		{"internal", http.StatusInternalServerError, errCodeInternal, ""},
+		{"overloaded", http.StatusServiceUnavailable, errCodeOverloaded, "1"},
+		{"written", http.StatusAccepted, "", ""},
+		{"last", http.StatusNotFound, errCodeNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			w := serve(r, http.MethodGet, "/fail/"+tt.kind, "")
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After %q, want %q", got, tt.retryAfter)
+			}
+			if tt.code == "" {
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, problemContentType) {
+				t.Errorf("Content-Type %q", ct)
+			}
+			var p problem
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			want := problem{Type: "about:blank", Title: http.StatusText(tt.status), Status: tt.status, Code: tt.code, Instance: "/fail/" + tt.kind}
+			p.Detail = ""
+			if !reflect.DeepEqual(p, want) {
+				t.Errorf("got %+v, want %+v", p, want)
+			}
+			if strings.Contains(w.Body.String(), "hunter2") {
+				t.Error("the problem reveals the cause")
+			}
+		})
+	}
+}
+
+func TestPostStoresTooLarge(t *testing.T) {
+	useMemoryRepositories(t)
+	body := `[{"name":"` + strings.Repeat("x", maxStoresBodySize) + `"}]`
+	w := serve(newTestRouter(), http.MethodPost, "/v1/stores", body)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want 413", w.Code)
+	}
+	var p problem
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || p.Code != errCodeTooLarge {
+		t.Errorf("got %s, want a %s problem", w.Body, errCodeTooLarge)
+	}
+}
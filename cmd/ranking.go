@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Default weighting between text relevance and proximity when a search has an
+// origin. Requests can override both with distance_weight and distance_scale_m.
+var (
+	searchDistanceWeight      = 0.5
+	searchDistanceScaleMeters = 2000.0
+)
+
+// rankingOptions describes how proximity to an origin is blended into search scores
+type rankingOptions struct {
+	Lat, Lon float64
+	// Weight is the share of the score given to proximity, from 0 to 1
+	Weight float64
+	// ScaleMeters is the distance at which proximity drops to one half
+	ScaleMeters float64
+}
+
+// parseRankingOptions reads the optional search origin and weighting from the
+// query string. It returns nil when no origin was given.
+func parseRankingOptions(c *gin.Context) (*rankingOptions, error) {
+	if c.Query("lat") == "" && c.Query("lon") == "" {
+		return nil, nil
+	}
+
+	lat, lon, err := parseLatLon(c, "lat", "lon")
+	if err != nil {
+		return nil, err
+	}
+	opts := &rankingOptions{Lat: lat, Lon: lon, Weight: searchDistanceWeight, ScaleMeters: searchDistanceScaleMeters}
+
+	if v := c.Query("distance_weight"); v != "" {
+		opts.Weight, err = strconv.ParseFloat(v, 64)
+		if err != nil || opts.Weight < 0 || opts.Weight > 1 {
+			return nil, errors.New("distance_weight must be between 0 and 1")
+		}
+	}
+	if v := c.Query("distance_scale_m"); v != "" {
+		opts.ScaleMeters, err = strconv.ParseFloat(v, 64)
+		if err != nil || opts.ScaleMeters <= 0 {
+			return nil, errors.New("distance_scale_m must be positive")
+		}
+	}
+	return opts, nil
+}
+
+// proximity maps a distance to a score between 0 and 1 that halves at scale
+func proximity(distanceMeters, scaleMeters float64) float64 {
+	return 1 / (1 + distanceMeters/scaleMeters)
+}
+
+// rankByDistance rescores results as a weighted blend of their relevance,
+// normalised against the best match, and their proximity to the origin.
+// Stores without coordinates get no proximity credit.
+func rankByDistance(results []searchResult, opts rankingOptions) {
+	best := 0.0
+	for _, r := range results {
+		if r.Relevance > best {
+			best = r.Relevance
+		}
+	}
+
+	for i := range results {
+		r := &results[i]
+
+		textScore := 0.0
+		if best > 0 {
+			textScore = r.Relevance / best
+		}
+
+		nearScore := 0.0
+		if r.hasCoordinates() {
+			d := haversineMeters(opts.Lat, opts.Lon, *r.Latitude, *r.Longitude)
+			r.DistanceMeters = &d
+			nearScore = proximity(d, opts.ScaleMeters)
+		}
+
+		r.Score = (1-opts.Weight)*textScore + opts.Weight*nearScore
+	}
+
+	sortByScore(results)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRankingOptions(t *testing.T) {
+	tests := []struct {
+		query string
+		want  *rankingOptions
+		ok    bool
+	}{
+		{"", nil, true},
+		{"name=x", nil, true},
+		{"lat=30&lon=31", &rankingOptions{Lat: 30, Lon: 31, Weight: searchDistanceWeight, ScaleMeters: searchDistanceScaleMeters}, true},
+		{"lat=30&lon=31&distance_weight=1&distance_scale_m=500", &rankingOptions{Lat: 30, Lon: 31, Weight: 1, ScaleMeters: 500}, true},
+		{"lat=30", nil, false},
+		{"lat=30&lon=31&distance_weight=1.5", nil, false},
+		{"lat=30&lon=31&distance_scale_m=0", nil, false},
+		{"lat=30&lon=200", nil, false},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/v1/stores/search?"+tt.query, nil)
+
+		got, err := parseRankingOptions(c)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: got error %v, want ok %v", tt.query, err, tt.ok)
+			continue
+		}
+		if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestProximity(t *testing.T) {
+	tests := []struct {
+		distance, scale, want float64
+	}{
+		{0, 2000, 1},
+		{2000, 2000, 0.5},
+		{6000, 2000, 0.25},
+	}
+	for _, tt := range tests {
+		if got := proximity(tt.distance, tt.scale); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("proximity(%v, %v) = %v, want %v", tt.distance, tt.scale, got, tt.want)
+		}
+	}
+}
+
+func TestRankByDistance(t *testing.T) {
+	// Store 1 matches best but is far away, store 2 matches less well next
+	// to the origin and store 3 has no coordinates
+	results := func() []searchResult {
+		return []searchResult{
+			{store: store{ID: 1, Name: "A", Latitude: ptr(1.0), Longitude: ptr(0.0)}, Relevance: 6},
+			{store: store{ID: 2, Name: "B", Latitude: ptr(0.0), Longitude: ptr(0.0)}, Relevance: 4},
+			{store: store{ID: 3, Name: "C"}, Relevance: 6},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		weight float64
+		want   []int
+	}{
+		{"relevance only", 0, []int{1, 3, 2}},
+		{"balanced", 0.5, []int{2, 1, 3}},
+		{"proximity only", 1, []int{2, 1, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := results()
+			rankByDistance(got, rankingOptions{Lat: 0, Lon: 0, Weight: tt.weight, ScaleMeters: 2000})
+			var ids []int
+			for _, r := range got {
+				ids = append(ids, r.ID)
+			}
+			if !equalInts(ids, tt.want) {
+				t.Errorf("got %v, want %v", ids, tt.want)
+			}
+			for _, r := range got {
+				if r.hasCoordinates() != (r.DistanceMeters != nil) {
+					t.Errorf("store %d distance is %v", r.ID, r.DistanceMeters)
+				}
+			}
+		})
+	}
+}
+
+func TestRankedSearch(t *testing.T) {
+	useMemoryRepositories(t)
+	mustCreateStores(t,
+		store{ID: 1, Name: "Books", Latitude: ptr(1.0), Longitude: ptr(0.0)},
+		store{ID: 2, Name: "Books Corner", Latitude: ptr(0.001), Longitude: ptr(0.0)},
+	)
+	r := newTestRouter()
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   []int
+	}{
+		{"without an origin", "name=books", http.StatusOK, []int{1, 2}},
+		{"near the second store", "name=books&lat=0&lon=0", http.StatusOK, []int{2, 1}},
+		{"near the first store", "name=books&lat=1&lon=0", http.StatusOK, []int{1, 2}},
+		{"incomplete origin", "name=books&lat=0", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, "/v1/stores/search?"+tt.query, "")
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var page storePage[searchResult]
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			var ids []int
+			for _, s := range page.Stores {
+				ids = append(ids, s.ID)
+			}
+			if !equalInts(ids, tt.want) {
+				t.Errorf("got %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestOriginOnlySearch(t *testing.T) {
+	useMemoryRepositories(t)
+	mustCreateStores(t,
+		store{ID: 1, AreaID: 1, Name: "Far", Latitude: ptr(0.0), Longitude: ptr(0.01)},
+		store{ID: 2, AreaID: 1, Name: "Near", Latitude: ptr(0.0), Longitude: ptr(0.001)},
+		store{ID: 3, AreaID: 2, Name: "Other area", Latitude: ptr(0.0), Longitude: ptr(0.002)},
+		store{ID: 4, AreaID: 1, Name: "Nowhere"},
+	)
+	repo := &indexedRepository{StoreRepository: storeRepo}
+	storeRepo = repo
+	r := newTestRouter()
+
+	tests := []struct {
+		name  string
+		query string
+		want  []int
+		scans int
+	}{
+		// Only looking past the last store outgrows the index
+		{"nearest first in pages", "lat=0&lon=0&page_size=2", []int{2, 3, 1}, 1},
+		{"fewer stores than a page", "lat=0&lon=0", []int{2, 3, 1}, 1},
+		// which for one area lists just the area
+		{"one area", "lat=0&lon=0&areaid=1", []int{2, 1}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo.lists, repo.searches = 0, 0
+			var ids []int
+			path := "/v1/stores/search?" + tt.query
+			for pages := 0; ; pages++ {
+				if pages > 3 {
+					t.Fatal("cursor never ran out")
+				}
+				w := serve(r, http.MethodGet, path, "")
+				if w.Code != http.StatusOK {
+					t.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+				var page storePage[searchResult]
+				if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+					t.Fatal(err)
+				}
+				for _, s := range page.Stores {
+					ids = append(ids, s.ID)
+					if s.DistanceMeters == nil {
+						t.Errorf("store %d has no distance", s.ID)
+					}
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				path = "/v1/stores/search?" + tt.query + "&cursor=" + page.NextCursor
+			}
+			if !equalInts(ids, tt.want) {
+				t.Errorf("got %v, want %v", ids, tt.want)
+			}
+			if repo.searches != 0 {
+				t.Errorf("scored stores %d times, want the geohash index used", repo.searches)
+			}
+			if repo.lists != tt.scans {
+				t.Errorf("listed stores %d times, want %d", repo.lists, tt.scans)
+			}
+		})
+	}
+}
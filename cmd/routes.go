@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiVersionPrefix is the path prefix of the current API. The store routes
+// of the old main.go and run.go servers are still served without it.
+const apiVersionPrefix = "/v1"
+
+// storeHandlers are the handlers of the store routes that differ between the
+// versioned and legacy APIs
+type storeHandlers struct {
+	list, get, post, update, remove, byArea, search gin.HandlerFunc
+}
+
+// registerRoutes mounts the API under /v1 and the deprecated unversioned
+// compatibility routes at the root. The root routes answer as the old servers
+// did where one of them had the route, as described in legacy.go, and as /v1
+// otherwise.
+func registerRoutes(r *gin.Engine) {
+	registerAPIRoutes(r.Group(apiVersionPrefix), storeHandlers{
+		list:   getStores,
+		get:    getStoreByID,
+		post:   postStores,
+		update: updateStore,
+		remove: deleteStore,
+		byArea: getStoresByAreaID,
+		search: searchStores,
+	})
+	registerAPIRoutes(r.Group("/", deprecatedRoute()), storeHandlers{
+		list:   legacyListStores,
+		get:    legacyGetStore,
+		post:   legacyPostStores,
+		update: legacyUpdateStore,
+		remove: legacyDeleteStore,
+		byArea: legacyStoresByArea,
+		search: legacySearchStores,
+	})
+}
+
+// registerAPIRoutes mounts every store and area route on g
+func registerAPIRoutes(g *gin.RouterGroup, h storeHandlers) {
+	g.GET("/stores", h.list)
+	g.POST("/stores", limitBody(maxStoresBodySize), idempotent, h.post)
+	g.POST("/stores/import", limitBody(maxImportBodySize), idempotent, postStoreImport)
+	g.GET("/stores/export", exportStores)
+	g.GET("/stores/:id", h.get)
+	g.PUT("/stores/:id", h.update)
+	g.PATCH("/stores/:id", patchStore)
+	g.DELETE("/stores/:id", h.remove)
+	g.GET("/stores/area/:areaid", h.byArea)
+	g.GET("/stores/search", h.search)
+	g.GET("/stores/suggest", suggestStores)
+	g.GET("/stores/nearby", getNearbyStores)
+	g.GET("/stores/within", getStoresWithinRadius)
+	g.GET("/stores/bbox", getStoresInBoundingBox)
+
+	g.GET("/areas", getAreas)
+	g.GET("/areas/:id", getAreaByID)
+	g.POST("/areas", postArea)
+	g.PUT("/areas/:id", updateArea)
+	g.DELETE("/areas/:id", deleteArea)
+}
+
+// limitBody caps the size of request bodies. Reading past the limit fails,
+// which is reported as 413.
+func limitBody(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+// deprecatedRoute marks responses of the unversioned routes as deprecated and
+// links to the /v1 route replacing them
+func deprecatedRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Header("Link", "<"+apiVersionPrefix+c.Request.URL.Path+">; rel=\"successor-version\"")
+		c.Next()
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRoutesDeprecation(t *testing.T) {
+	useMemoryRepositories(t)
+	mustCreateStores(t, store{ID: 1, AreaID: 1, Name: "A"})
+	r := newTestRouter()
+
+	tests := []struct {
+		name       string
+		path       string
+		deprecated bool
+		successor  string
+	}{
+		{"versioned listing", "/v1/stores", false, ""},
+		{"versioned store", "/v1/stores/1", false, ""},
+		{"legacy listing", "/stores", true, "/v1/stores"},
+		{"legacy store", "/stores/1", true, "/v1/stores/1"},
+		{"legacy route of neither old server", "/areas", true, "/v1/areas"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, tt.path, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Deprecation") == "true"; got != tt.deprecated {
+				t.Errorf("deprecated %v, want %v", got, tt.deprecated)
+			}
+			if tt.successor != "" && !strings.Contains(w.Header().Get("Link"), "<"+tt.successor+">") {
+				t.Errorf("Link %q does not name %s", w.Header().Get("Link"), tt.successor)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gocql/gocql"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Search fields indexed in store_search_index
+const (
+	fieldName     = "name"
+	fieldLocation = "location"
+)
+
+// Relevance weights for how a query token matched a field token
+const (
+	exactMatchScore     = 3
+	prefixMatchScore    = 2
+	substringMatchScore = 1
+)
+
+// minSubstringRunes is the shortest query token matched inside a word rather
+// than only at its start. The index finds substrings through trigrams, so
+// shorter tokens match by prefix alone in every backend.
+const minSubstringRunes = 3
+
+// fieldWeights favours name matches over location matches
+var fieldWeights = map[string]float64{
+	fieldName:     2,
+	fieldLocation: 1,
+}
+
+// fetchChunkSize bounds the number of IDs per IN query
+const fetchChunkSize = 100
+
+// searchResult is a store annotated with its ranking. Score equals Relevance
+// unless the search has an origin, in which case it blends in proximity.
+// Similarity is only set by fuzzy searches and DistanceMeters only when
+// ranking against an origin.
+type searchResult struct {
+	store
+	Score          float64  `json:"score"`
+	Relevance      float64  `json:"relevance"`
+	Similarity     *float64 `json:"similarity,omitempty"`
+	DistanceMeters *float64 `json:"distanceMeters,omitempty"`
+}
+
+// toFeature adds the ranking fields to the store feature
+func (r searchResult) toFeature() feature {
+	f := r.store.toFeature()
+	f.Properties["score"] = r.Score
+	f.Properties["relevance"] = r.Relevance
+	if r.Similarity != nil {
+		f.Properties["similarity"] = *r.Similarity
+	}
+	if r.DistanceMeters != nil {
+		f.Properties["distanceMeters"] = *r.DistanceMeters
+	}
+	return f
+}
+
+// foldAccents strips combining marks after canonical decomposition, so "Café"
+// becomes "Cafe". A chain keeps state between calls, so each use needs its own.
+func foldAccents() transform.Transformer {
+	return transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+}
+
+// normalizeText lowercases text and removes accents
+func normalizeText(text string) string {
+	folded, _, err := transform.String(foldAccents(), text)
+	if err != nil {
+		folded = text
+	}
+	return strings.ToLower(folded)
+}
+
+// tokenize splits normalized text into letter and digit runs
+func tokenize(text string) []string {
+	return strings.FieldsFunc(normalizeText(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// trigrams returns the distinct three-rune substrings of s
+func trigrams(s string) []string {
+	rs := []rune(s)
+	seen := make(map[string]bool)
+	var grams []string
+	for i := 0; i+3 <= len(rs); i++ {
+		gram := string(rs[i : i+3])
+		if !seen[gram] {
+			seen[gram] = true
+			grams = append(grams, gram)
+		}
+	}
+	return grams
+}
+
+// indexTerms returns the index terms for a field value: every prefix of every
+// token ("p:") and every trigram of every token padded with boundary markers ("g:")
+func indexTerms(text string) map[string]bool {
+	terms := make(map[string]bool)
+	for _, token := range tokenize(text) {
+		rs := []rune(token)
+		for i := 1; i <= len(rs); i++ {
+			terms["p:"+string(rs[:i])] = true
+		}
+		for _, gram := range trigrams("^" + token + "$") {
+			terms["g:"+gram] = true
+		}
+	}
+	return terms
+}
+
+// tokenCandidates returns the stores whose field may match the query token by
+// prefix or, for tokens of minSubstringRunes or more, by substring. lookup
+// returns the stores indexed under a term.
+func tokenCandidates(token string, lookup func(term string) (map[int]bool, error)) (map[int]bool, error) {
+	candidates, err := lookup("p:" + token)
+	if err != nil {
+		return nil, err
+	}
+	if utf8.RuneCountInString(token) < minSubstringRunes {
+		return candidates, nil
+	}
+
+	var substring map[int]bool
+	for _, gram := range trigrams(token) {
+		ids, err := lookup("g:" + gram)
+		if err != nil {
+			return nil, err
+		}
+		substring = intersect(substring, ids)
+		if len(substring) == 0 {
+			break
+		}
+	}
+	for id := range substring {
+		candidates[id] = true
+	}
+	return candidates, nil
+}
+
+// searchCandidates intersects the index candidates of every query token, since
+// every token must match. It returns nil when no token narrowed the search,
+// which happens when every token is a fuzzy one too short for the index.
+// lookup returns the stores indexed under a term of a field.
+func searchCandidates(queries map[string][]string, fuzzy int, lookup func(term, field string) (map[int]bool, error)) (map[int]bool, error) {
+	var candidates map[int]bool
+	for field, tokens := range queries {
+		fieldLookup := func(term string) (map[int]bool, error) {
+			return lookup(term, field)
+		}
+		for _, token := range tokens {
+			var ids map[int]bool
+			var err error
+			if fuzzy > 0 {
+				ids, err = fuzzyCandidates(token, fuzzy, fieldLookup)
+			} else {
+				ids, err = tokenCandidates(token, fieldLookup)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if ids == nil {
+				continue
+			}
+			candidates = intersect(candidates, ids)
+			if len(candidates) == 0 {
+				return candidates, nil
+			}
+		}
+	}
+	return candidates, nil
+}
+
+// addSearchIndexQueries appends the statements keeping store_search_index in
+// step with a store write. previous is the row being overwritten, if any.
+func addSearchIndexQueries(batch *gocql.Batch, previous *store, s store) {
+	fields := map[string][2]string{
+		fieldName:     {"", s.Name},
+		fieldLocation: {"", s.Location},
+	}
+	if previous != nil {
+		fields[fieldName] = [2]string{previous.Name, s.Name}
+		fields[fieldLocation] = [2]string{previous.Location, s.Location}
+	}
+
+	for field, values := range fields {
+		oldTerms := indexTerms(values[0])
+		newTerms := indexTerms(values[1])
+
+		for term := range oldTerms {
+			if !newTerms[term] {
+				batch.Query("DELETE FROM store_search_index WHERE term = ? AND field = ? AND store_id = ?",
+					term, field, s.ID)
+			}
+		}
+		for term := range newTerms {
+			if !oldTerms[term] {
+				batch.Query("INSERT INTO store_search_index (term, field, store_id) VALUES (?, ?, ?)",
+					term, field, s.ID)
+			}
+		}
+	}
+}
+
+// intersect keeps the IDs present in both sets; a nil set means "no constraint yet"
+func intersect(a, b map[int]bool) map[int]bool {
+	if a == nil {
+		return b
+	}
+	for id := range a {
+		if !b[id] {
+			delete(a, id)
+		}
+	}
+	return a
+}
+
+// matchScore scores how well a query token matches the tokens of a field value
+func matchScore(queryToken string, fieldTokens []string) float64 {
+	best := 0.0
+	for _, token := range fieldTokens {
+		switch {
+		case token == queryToken:
+			return exactMatchScore
+		case strings.HasPrefix(token, queryToken):
+			best = prefixMatchScore
+		case best < substringMatchScore && utf8.RuneCountInString(queryToken) >= minSubstringRunes &&
+			strings.Contains(token, queryToken):
+			best = substringMatchScore
+		}
+	}
+	return best
+}
+
+// fieldScore scores a field value against every query token. All tokens must
+// match for the field to match.
+func fieldScore(queryTokens []string, value, field string) (float64, bool) {
+	fieldTokens := tokenize(value)
+	total := 0.0
+	for _, token := range queryTokens {
+		score := matchScore(token, fieldTokens)
+		if score == 0 {
+			return 0, false
+		}
+		total += score * fieldWeights[field]
+	}
+	return total, true
+}
+
+// searchQueries returns the query tokens per field for the text criteria that are set
+func searchQueries(criteria searchCriteria) map[string][]string {
+	queries := make(map[string][]string)
+	if tokens := tokenize(criteria.Name); len(tokens) > 0 {
+		queries[fieldName] = tokens
+	}
+	if tokens := tokenize(criteria.Location); len(tokens) > 0 {
+		queries[fieldLocation] = tokens
+	}
+	return queries
+}
+
+// fieldValue returns the text of a searchable store field
+func fieldValue(s store, field string) string {
+	if field == fieldLocation {
+		return s.Location
+	}
+	return s.Name
+}
+
+// scoreStore scores a store against the query tokens of each field. Every
+// field must match; fuzzy searches score by mean similarity instead of relevance.
+func scoreStore(s store, queries map[string][]string, fuzzy int) (searchResult, bool) {
+	if len(queries) == 0 {
+		return searchResult{store: s}, true
+	}
+
+	total := 0.0
+	for field, tokens := range queries {
+		var score float64
+		var ok bool
+		if fuzzy > 0 {
+			score, ok = fuzzyFieldSimilarity(tokens, fieldValue(s, field), fuzzy)
+		} else {
+			score, ok = fieldScore(tokens, fieldValue(s, field), field)
+		}
+		if !ok {
+			return searchResult{}, false
+		}
+		total += score
+	}
+
+	if fuzzy > 0 {
+		sim := total / float64(len(queries))
+		return searchResult{store: s, Score: sim, Relevance: sim, Similarity: &sim}, true
+	}
+	return searchResult{store: s, Score: total, Relevance: total}, true
+}
+
+// scoreStores keeps the stores in the criteria's area that match its text,
+// best match first
+func scoreStores(stores []store, criteria searchCriteria) []searchResult {
+	queries := searchQueries(criteria)
+
+	var results []searchResult
+	for _, s := range stores {
+		if criteria.AreaID >= 0 && s.AreaID != criteria.AreaID {
+			continue
+		}
+		if r, ok := scoreStore(s, queries, criteria.Fuzzy); ok {
+			results = append(results, r)
+		}
+	}
+
+	sortByScore(results)
+	return results
+}
+
+// sortByScore orders results by descending score, then by name and ID
+func sortByScore(results []searchResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if results[i].Name != results[j].Name {
+			return results[i].Name < results[j].Name
+		}
+		return results[i].ID < results[j].ID
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Café Central", []string{"cafe", "central"}},
+		{"  ", nil},
+		{"7-Eleven, Main St.", []string{"7", "eleven", "main", "st"}},
+		{"ŞEHİR Ünlü", []string{"sehir", "unlu"}},
+		{"مكتبة القاهرة", []string{"مكتبة", "القاهرة"}},
+	}
+	for _, tt := range tests {
+		if got := tokenize(tt.text); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestIndexTerms(t *testing.T) {
+	terms := indexTerms("Ab Cd")
+	var got []string
+	for term := range terms {
+		got = append(got, term)
+	}
+	sort.Strings(got)
+	want := []string{"g:^ab", "g:^cd", "g:ab$", "g:cd$", "p:a", "p:ab", "p:c", "p:cd"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMatchScore(t *testing.T) {
+	tests := []struct {
+		query  string
+		tokens []string
+		want   float64
+	}{
+		{"cafe", []string{"cafe", "central"}, exactMatchScore},
+		{"cen", []string{"cafe", "central"}, prefixMatchScore},
+		{"ntr", []string{"cafe", "central"}, substringMatchScore},
+		{"bar", []string{"cafe", "central"}, 0},
+		{"ca", []string{"pica", "cafe"}, prefixMatchScore},
+		{"ca", []string{"pica"}, 0},
+	}
+	for _, tt := range tests {
+		if got := matchScore(tt.query, tt.tokens); got != tt.want {
+			t.Errorf("matchScore(%q, %q) = %v, want %v", tt.query, tt.tokens, got, tt.want)
+		}
+	}
+}
+
+func TestScoreStores(t *testing.T) {
+	stores := []store{
+		{ID: 1, AreaID: 1, Name: "Central Books", Location: "Harbour Road"},
+		{ID: 2, AreaID: 1, Name: "Books Central", Location: "Main Street"},
+		{ID: 3, AreaID: 2, Name: "Centrale Café", Location: "Main Street"},
+		{ID: 4, AreaID: 1, Name: "Bakery", Location: "Central Square"},
+	}
+
+	tests := []struct {
+		name     string
+		criteria searchCriteria
+		want     []int
+	}{
+		{"name matches rank above prefixes", searchCriteria{AreaID: -1, Name: "central"}, []int{2, 1, 3}},
+		{"every token must match", searchCriteria{AreaID: -1, Name: "central books"}, []int{2, 1}},
+		{"area filter", searchCriteria{AreaID: 2, Name: "central"}, []int{3}},
+		{"location", searchCriteria{AreaID: -1, Location: "main"}, []int{2, 3}},
+		{"name and location", searchCriteria{AreaID: -1, Name: "books", Location: "main"}, []int{2}},
+		{"accents are folded", searchCriteria{AreaID: -1, Name: "cafe"}, []int{3}},
+		{"no match", searchCriteria{AreaID: -1, Name: "pharmacy"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ids []int
+			for _, r := range scoreStores(stores, tt.criteria) {
+				ids = append(ids, r.ID)
+			}
+			if !equalInts(ids, tt.want) {
+				t.Errorf("got %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+// indexedSearch searches stores the way the Cassandra repository does, picking
+// candidates from the terms indexTerms would write before scoring them
+func indexedSearch(t *testing.T, stores []store, criteria searchCriteria) []searchResult {
+	index := make(map[string]map[string][]int)
+	for _, s := range stores {
+		for _, field := range []string{fieldName, fieldLocation} {
+			if index[field] == nil {
+				index[field] = make(map[string][]int)
+			}
+			for term := range indexTerms(fieldValue(s, field)) {
+				index[field][term] = append(index[field][term], s.ID)
+			}
+		}
+	}
+
+	candidates, err := searchCandidates(searchQueries(criteria), criteria.Fuzzy, func(term, field string) (map[int]bool, error) {
+		ids := make(map[int]bool)
+		for _, id := range index[field][term] {
+			ids[id] = true
+		}
+		return ids, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The index could not narrow the search, so every store is scored
+	if candidates == nil {
+		return scoreStores(stores, criteria)
+	}
+
+	var matched []store
+	for _, s := range stores {
+		if candidates[s.ID] {
+			matched = append(matched, s)
+		}
+	}
+	return scoreStores(matched, criteria)
+}
+
+func TestSearchBackendsAgree(t *testing.T) {
+	useMemoryRepositories(t)
+	stores := []store{
+		{ID: 1, AreaID: 1, Name: "Pica Deli", Location: "Harbour Road"},
+		{ID: 2, AreaID: 1, Name: "Cafe Central", Location: "Main Street"},
+		{ID: 3, AreaID: 1, Name: "Ukai", Location: "Kai Street"},
+		{ID: 4, AreaID: 1, Name: "7 Eleven", Location: "Station Road"},
+		{ID: 5, AreaID: 1, Name: "Pharmacy", Location: "Cd Lane"},
+	}
+	mustCreateStores(t, stores...)
+
+	tests := []struct {
+		name  string
+		query string
+		fuzzy int
+		want  []int
+	}{
+		{"short token matches prefixes only", "ca", 0, []int{2}},
+		{"single rune", "k", 0, nil},
+		{"short token inside a word", "ai", 0, nil},
+		{"short token with a longer one", "ca ntr", 0, []int{2}},
+		{"substring of three runes", "kai", 0, []int{3}},
+		{"digit", "7", 0, []int{4}},
+		{"fuzzy transposition", "pharmcay", 1, []int{5}},
+		{"fuzzy token too short for the index", "ab", 2, []int{4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			criteria := searchCriteria{AreaID: -1, Name: tt.query, Fuzzy: tt.fuzzy}
+			memory, err := storeRepo.Search(context.Background(), criteria)
+			if err != nil {
+				t.Fatal(err)
+			}
+			indexed := indexedSearch(t, stores, criteria)
+
+			var memoryIDs, indexedIDs []int
+			for _, r := range memory {
+				memoryIDs = append(memoryIDs, r.ID)
+			}
+			for _, r := range indexed {
+				indexedIDs = append(indexedIDs, r.ID)
+			}
+			if !equalInts(memoryIDs, tt.want) || !equalInts(indexedIDs, tt.want) {
+				t.Errorf("memory found %v and the index %v, want %v", memoryIDs, indexedIDs, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchStores(t *testing.T) {
+	useMemoryRepositories(t)
+	mustCreateStores(t,
+		store{ID: 1, AreaID: 1, Name: "Central Books", Location: "Harbour Road"},
+		store{ID: 2, AreaID: 2, Name: "Corner Café", Location: "Central Square"},
+		store{ID: 3, AreaID: 1, Name: "Bakery", Location: "Main Street"},
+	)
+	r := newTestRouter()
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   []int
+	}{
+		{"by name", "name=central", http.StatusOK, []int{1}},
+		{"by location", "location=central", http.StatusOK, []int{2}},
+		{"by area without text", "areaid=1", http.StatusOK, []int{1, 3}},
+		{"accents and case", "name=CAFE", http.StatusOK, []int{2}},
+		{"no match is an empty page", "name=pharmacy", http.StatusOK, []int{}},
+		{"invalid area", "areaid=x", http.StatusBadRequest, nil},
+		{"fuzzy out of range", "name=a&fuzzy=9", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, "/v1/stores/search?"+tt.query, "")
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var page storePage[searchResult]
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			if page.Stores == nil {
+				t.Fatal("stores is null, want an array")
+			}
+			ids := []int{}
+			for _, s := range page.Stores {
+				ids = append(ids, s.ID)
+			}
+			if !equalInts(ids, tt.want) {
+				t.Errorf("got %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
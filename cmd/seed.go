@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fixtureFiles holds the fixtures of each environment, named <env>.yaml,
+// <env>.yml or <env>.json
+//
+//go:embed fixtures
+var fixtureFiles embed.FS
+
+// fixture is the content of a fixture file. A store's key is its natural
+// key: seeding the same fixture again updates the stores it wrote. Areas are
+// created when missing and otherwise left alone.
+type fixture struct {
+	Areas  []fixtureArea  `json:"areas" yaml:"areas"`
+	Stores []fixtureStore `json:"stores" yaml:"stores"`
+}
+
+// fixtureStore is a store of a fixture. Its ID is allocated the first time
+// it is seeded and remembered under its key, so fixtures can be seeded next
+// to stores that were not.
+type fixtureStore struct {
+	Key        string `json:"key" yaml:"key"`
+	storeInput `yaml:",inline"`
+}
+
+// fixtureArea is an area of a fixture. Its boundary is decoded generically
+// so YAML fixtures can write the GeoJSON inline.
+type fixtureArea struct {
+	ID       int         `json:"id" yaml:"id"`
+	Name     string      `json:"name" yaml:"name"`
+	Boundary interface{} `json:"boundary" yaml:"boundary"`
+}
+
+// seedRecord is the store a fixture key maps to and what the seed command
+// last wrote to it. A key claimed by a run that stopped before writing the
+// store has no checksum.
+type seedRecord struct {
+	Key      string
+	StoreID  int
+	Fixture  string
+	Checksum string
+	SeededAt time.Time
+}
+
+// Outcomes of seeding one store
+const (
+	seedCreated   = "created"
+	seedUpdated   = "updated"
+	seedUnchanged = "unchanged"
+	seedSkipped   = "skipped"
+)
+
+// seedSkip explains why a store was left alone
+type seedSkip struct {
+	Key    string `json:"key"`
+	ID     int    `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// seedSummary reports what a seed run did, or would do in a dry run
+type seedSummary struct {
+	Fixture      string     `json:"fixture"`
+	DryRun       bool       `json:"dry_run"`
+	AreasCreated int        `json:"areas_created"`
+	Created      int        `json:"created"`
+	Updated      int        `json:"updated"`
+	Unchanged    int        `json:"unchanged"`
+	Skipped      int        `json:"skipped"`
+	Skips        []seedSkip `json:"skips,omitempty"`
+}
+
+// loadFixture reads the fixture file at path or, without one, the embedded
+// fixture of the environment
+func loadFixture(env, path string) (string, fixture, error) {
+	var data []byte
+	var err error
+	if path != "" {
+		data, err = os.ReadFile(path)
+	} else {
+		path, err = embeddedFixture(env)
+		if err == nil {
+			data, err = fixtureFiles.ReadFile(path)
+		}
+	}
+	if err != nil {
+		return "", fixture{}, err
+	}
+
+	var f fixture
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&f)
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	default:
+		return "", fixture{}, fmt.Errorf("fixture %s: unsupported format, use .yaml, .yml or .json", path)
+	}
+	if err != nil {
+		return "", fixture{}, fmt.Errorf("fixture %s: %w", path, err)
+	}
+	return filepath.Base(path), f, nil
+}
+
+// embeddedFixture returns the path of the environment's embedded fixture
+func embeddedFixture(env string) (string, error) {
+	for _, ext := range []string{".yaml", ".yml", ".json"} {
+		path := "fixtures/" + env + ext
+		if _, err := fs.Stat(fixtureFiles, path); err == nil {
+			return path, nil
+		}
+	}
+	entries, _ := fs.ReadDir(fixtureFiles, "fixtures")
+	envs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		envs = append(envs, strings.TrimSuffix(e.Name(), filepath.Ext(e.Name())))
+	}
+	return "", fmt.Errorf("no fixture for environment %q (have %s)", env, strings.Join(envs, ", "))
+}
+
+// storeChecksum fingerprints the stored fields of a store
+func storeChecksum(s store) string {
+	data, _ := json.Marshal(s)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// seedStores upserts the fixture's stores by key. A store is only overwritten
+// while it still matches what was last seeded, so edits made since are kept
+// unless force is set. Stores the seed command never wrote count as edited.
+func seedStores(ctx context.Context, name string, f fixture, dryRun, force bool) (seedSummary, error) {
+	summary := seedSummary{Fixture: name, DryRun: dryRun}
+
+	validator := newStoreValidator()
+	for i, fa := range f.Areas {
+		a, created, err := seedArea(ctx, fa, dryRun)
+		if err != nil {
+			return summary, fmt.Errorf("fixture %s, area %d: %w", name, i, err)
+		}
+		if created {
+			summary.AreasCreated++
+			// A dry run has not created the area its stores refer to
+			if dryRun {
+				validator.addPending(a)
+			}
+		}
+		validator.areas[fa.ID] = true
+	}
+
+	stores := make([]store, 0, len(f.Stores))
+	seen := make(map[string]bool, len(f.Stores))
+	for i, fs := range f.Stores {
+		if err := checkFixtureStore(fs); err != nil {
+			return summary, fmt.Errorf("fixture %s, store %d: %w", name, i, err)
+		}
+		s, err := validator.storeFromInput(ctx, fs.storeInput)
+		if err != nil {
+			return summary, fmt.Errorf("fixture %s, store %d: %w", name, i, err)
+		}
+		if seen[fs.Key] {
+			return summary, fmt.Errorf("fixture %s: store key %q appears twice", name, fs.Key)
+		}
+		seen[fs.Key] = true
+		stores = append(stores, s)
+	}
+
+	now := time.Now().UTC()
+	for i, s := range stores {
+		key := f.Stores[i].Key
+		outcome, reason, id, err := seedStore(ctx, name, key, s, now, dryRun, force)
+		if err != nil {
+			return summary, fmt.Errorf("seeding store %q: %w", key, err)
+		}
+		switch outcome {
+		case seedCreated:
+			summary.Created++
+		case seedUpdated:
+			summary.Updated++
+		case seedUnchanged:
+			summary.Unchanged++
+		case seedSkipped:
+			summary.Skipped++
+			summary.Skips = append(summary.Skips, seedSkip{Key: key, ID: id, Reason: reason})
+		}
+	}
+	return summary, nil
+}
+
+// checkFixtureStore rejects a fixture store without a key or with an id, as
+// store IDs are allocated by the server
+func checkFixtureStore(fs fixtureStore) error {
+	if fs.ID != 0 {
+		return errors.New("id is allocated when the store is first seeded; name the store by its key")
+	}
+	if fs.Key == "" {
+		return validationError{{Field: "key", Code: codeRequired, Message: "key is required"}}
+	}
+	return nil
+}
+
+// seedArea creates a fixture area unless an area with its ID exists,
+// returning the area and whether it was created
+func seedArea(ctx context.Context, fa fixtureArea, dryRun bool) (area, bool, error) {
+	boundary, err := json.Marshal(fa.Boundary)
+	if err != nil {
+		return area{}, false, err
+	}
+	a := area{ID: fa.ID, Name: fa.Name, Boundary: boundary}
+	if a.Name == "" {
+		return area{}, false, errors.New("name is required")
+	}
+	if _, err := parseBoundary(a.Boundary); err != nil {
+		return area{}, false, err
+	}
+
+	_, err = areaRepo.Get(ctx, a.ID)
+	if err == nil || !errors.Is(err, errAreaNotFound) {
+		return a, false, err
+	}
+	if dryRun {
+		return a, true, nil
+	}
+	err = areaRepo.Create(ctx, a)
+	if errors.Is(err, errAreaExists) {
+		return a, false, nil
+	}
+	return a, err == nil, err
+}
+
+// seedStore writes the store of a fixture key and its seed record,
+// returning the outcome, for skipped stores the reason, and the store's ID.
+// The first run to seed a key allocates the ID and claims the key for it;
+// a run that stopped before writing the store is finished by the next one.
+func seedStore(ctx context.Context, name, key string, s store, now time.Time, dryRun, force bool) (string, string, int, error) {
+	last, err := seedRepo.Get(ctx, key)
+	if errors.Is(err, errSeedNotFound) {
+		if dryRun {
+			return seedCreated, "", 0, nil
+		}
+		id, err := storeRepo.NextID(ctx)
+		if err != nil {
+			return "", "", 0, err
+		}
+		// A concurrent run may have claimed the key first
+		if id, err = seedRepo.Claim(ctx, key, id); err != nil {
+			return "", "", 0, err
+		}
+		last = seedRecord{Key: key, StoreID: id}
+	} else if err != nil {
+		return "", "", 0, err
+	}
+	seeded := last.Checksum != ""
+
+	s.ID = last.StoreID
+	checksum := storeChecksum(s)
+	rec := seedRecord{Key: key, StoreID: s.ID, Fixture: name, Checksum: checksum, SeededAt: now}
+
+	current, err := storeRepo.Get(ctx, s.ID)
+	if errors.Is(err, errStoreNotFound) {
+		if !dryRun {
+			err := storeRepo.Create(ctx, s)
+			if errors.Is(err, errStoreExists) {
+				return seedSkipped, "store was created while seeding", s.ID, nil
+			}
+			if err != nil {
+				return "", "", 0, err
+			}
+			if err := seedRepo.Save(ctx, rec); err != nil {
+				return "", "", 0, err
+			}
+		}
+		return seedCreated, "", s.ID, nil
+	}
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	currentChecksum := storeChecksum(current)
+	if currentChecksum == checksum {
+		// Adopt matching stores so later fixture changes can update them
+		if !dryRun && last.Checksum != checksum {
+			if err := seedRepo.Save(ctx, rec); err != nil {
+				return "", "", 0, err
+			}
+		}
+		return seedUnchanged, "", s.ID, nil
+	}
+
+	if !force {
+		if !seeded {
+			return seedSkipped, "store was not created by the seed command", s.ID, nil
+		}
+		if last.Checksum != currentChecksum {
+			return seedSkipped, "store was edited after it was seeded from " + last.Fixture, s.ID, nil
+		}
+	}
+
+	if !dryRun {
+		_, _, err := storeRepo.Update(ctx, s, current.Version)
+		if errors.Is(err, errVersionConflict) {
+			return seedSkipped, "store was edited while seeding", s.ID, nil
+		}
+		if err != nil {
+			return "", "", 0, err
+		}
+		if err := seedRepo.Save(ctx, rec); err != nil {
+			return "", "", 0, err
+		}
+	}
+	return seedUpdated, "", s.ID, nil
+}
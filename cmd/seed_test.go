@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// seedFixture is a fixture of one area and two stores inside it
+const seedFixture = `
+areas:
+  - id: 1
+    name: Area A
+    boundary: {type: Polygon, coordinates: [[[0, 0], [10, 0], [10, 10], [0, 10], [0, 0]]]}
+stores:
+  - {key: first, areaId: 1, name: First}
+  - {key: second, name: Second, latitude: 5, longitude: 5}
+`
+
+func TestEmbeddedFixtures(t *testing.T) {
+	for _, env := range []string{"development", "staging"} {
+		t.Run(env, func(t *testing.T) {
+			useMemoryRepositories(t)
+			name, f, err := loadFixture(env, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			summary, err := seedStores(context.Background(), name, f, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if summary.AreasCreated != len(f.Areas) || summary.Created != len(f.Stores) {
+				t.Errorf("got %+v for %d areas and %d stores", summary, len(f.Areas), len(f.Stores))
+			}
+		})
+	}
+}
+
+func TestLoadFixtureErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		path string
+		want string
+	}{
+		{"unknown environment", "production", "", `no fixture for environment "production"`},
+		{"missing file", "", "/nonexistent/seed.yaml", "no such file"},
+		{"unsupported format", "", writeConfigFile(t, "seed.csv", "id\n1\n"), "unsupported format"},
+		{"unknown yaml field", "", writeConfigFile(t, "seed.yaml", "shops: []\n"), "shops"},
+		{"unknown json field", "", writeConfigFile(t, "seed.json", `{"stores": [{"key": "a", "colour": "red"}]}`), "colour"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := loadFixture(tt.env, tt.path)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeedStores(t *testing.T) {
+	useMemoryRepositories(t)
+	ctx := context.Background()
+	name, f, err := loadFixture("", writeConfigFile(t, "seed.yaml", seedFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fixture stores are given IDs of their own next to existing stores
+	existing := store{ID: 1, Name: "Existing"}
+	mustCreateStores(t, existing)
+	seededID := func(t *testing.T, key string) int {
+		t.Helper()
+		rec, err := seedRepo.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.StoreID
+	}
+
+	tests := []struct {
+		name   string
+		before func(t *testing.T)
+		dryRun bool
+		force  bool
+		want   seedSummary
+		skips  []string
+	}{
+		{"dry run", nil, true, false, seedSummary{DryRun: true, AreasCreated: 1, Created: 2}, nil},
+		{"first run", nil, false, false, seedSummary{AreasCreated: 1, Created: 2}, nil},
+		{"second run", nil, false, false, seedSummary{Unchanged: 2}, nil},
+		{"edited store is kept", func(t *testing.T) {
+			s, _ := storeRepo.Get(ctx, seededID(t, "first"))
+			s.Name = "Edited"
+			if _, _, err := storeRepo.Update(ctx, s, s.Version); err != nil {
+				t.Fatal(err)
+			}
+		}, false, false, seedSummary{Unchanged: 1, Skipped: 1}, []string{"first"}},
+		{"force overwrites edits", nil, false, true, seedSummary{Updated: 1, Unchanged: 1}, nil},
+		{"store the seed never wrote", func(t *testing.T) {
+			id, err := storeRepo.NextID(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A run that claimed the key but stopped before writing the
+			// store, after which a client took the ID
+			if _, err := seedRepo.Claim(ctx, "third", id); err != nil {
+				t.Fatal(err)
+			}
+			mustCreateStores(t, store{ID: id, AreaID: 1, Name: "Hand made"})
+			f.Stores = append(f.Stores, fixtureStore{Key: "third", storeInput: storeInput{AreaID: ptr(1), Name: "Third"}})
+		}, false, false, seedSummary{Unchanged: 2, Skipped: 1}, []string{"third"}},
+		{"key claimed by a stopped run", func(t *testing.T) {
+			id, err := storeRepo.NextID(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := seedRepo.Claim(ctx, "fourth", id); err != nil {
+				t.Fatal(err)
+			}
+			f.Stores = append(f.Stores[:2], fixtureStore{Key: "fourth", storeInput: storeInput{AreaID: ptr(1), Name: "Fourth"}})
+		}, false, false, seedSummary{Created: 1, Unchanged: 2}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.before != nil {
+				tt.before(t)
+			}
+			got, err := seedStores(ctx, name, f, tt.dryRun, tt.force)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.DryRun != tt.want.DryRun || got.AreasCreated != tt.want.AreasCreated || got.Created != tt.want.Created ||
+				got.Updated != tt.want.Updated || got.Unchanged != tt.want.Unchanged || got.Skipped != tt.want.Skipped {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			var skipped []string
+			for _, skip := range got.Skips {
+				skipped = append(skipped, skip.Key)
+			}
+			if strings.Join(skipped, ",") != strings.Join(tt.skips, ",") {
+				t.Errorf("skipped %v, want %v", skipped, tt.skips)
+			}
+			if tt.dryRun {
+				if _, err := seedRepo.Get(ctx, "first"); err == nil {
+					t.Error("the dry run claimed a key")
+				}
+			}
+		})
+	}
+
+	if s, err := storeRepo.Get(ctx, existing.ID); err != nil || s.Name != existing.Name {
+		t.Errorf("got %+v, %v, want the existing store left alone", s, err)
+	}
+	if id := seededID(t, "first"); id == existing.ID {
+		t.Errorf("fixture store was seeded over store %d", id)
+	}
+	s, err := storeRepo.Get(ctx, seededID(t, "second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.AreaID != 1 {
+		t.Errorf("store second was placed in area %d, want the area its coordinates fall in", s.AreaID)
+	}
+	if s, err := storeRepo.Get(ctx, seededID(t, "fourth")); err != nil || s.Name != "Fourth" {
+		t.Errorf("got %+v, %v, want the stopped run's store written", s, err)
+	}
+}
+
+func TestSeedStoresErrors(t *testing.T) {
+	area := "areas: [{id: 1, name: A, boundary: {type: Polygon, coordinates: [[[0, 0], [1, 0], [1, 1], [0, 0]]]}}]\n"
+	tests := []struct {
+		name    string
+		fixture string
+		want    string
+	}{
+		{"store without a key", area + "stores: [{areaId: 1, name: A}]\n", "key is required"},
+		{"store with an id", area + "stores: [{key: a, id: 1, areaId: 1, name: A}]\n", "id is allocated"},
+		{"invalid store", area + "stores: [{key: a, areaId: 1}]\n", "store 0"},
+		{"repeated key", area + "stores: [{key: a, areaId: 1, name: A}, {key: a, areaId: 1, name: B}]\n", `store key "a" appears twice`},
+		{"unnamed area", "areas: [{id: 1, boundary: {type: Polygon, coordinates: [[[0, 0], [1, 0], [1, 1], [0, 0]]]}}]\n", "name is required"},
+		{"invalid boundary", "areas: [{id: 1, name: A, boundary: {type: Point, coordinates: [0, 0]}}]\n", "area 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMemoryRepositories(t)
+			name, f, err := loadFixture("", writeConfigFile(t, "seed.yaml", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = seedStores(context.Background(), name, f, false, false)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	errStoreNotFound = errors.New("store not found")
+	errStoreExists   = errors.New("store already exists")
+	errAreaNotFound  = errors.New("area not found")
+	errAreaExists    = errors.New("area already exists")
+	errAreaInUse     = errors.New("area still has stores")
+	errSeedNotFound  = errors.New("seed record not found")
+	errUUIDNotFound  = errors.New("store UUID not found")
+	errIDsExhausted  = errors.New("every store ID has been allocated")
+)
+
+// StoreRepository is the storage the store handlers depend on. Paginated
+// methods take the decoded cursor of the previous page and return the cursor
+// of the next one, which is empty after the last page.
+type StoreRepository interface {
+	// Get returns the store with the given ID or errStoreNotFound
+	Get(ctx context.Context, id int) (store, error)
+	// List returns one page of every store
+	List(ctx context.Context, pageSize int, cursor pageCursor) ([]store, pageCursor, error)
+	// ListByArea returns one page of the stores in an area
+	ListByArea(ctx context.Context, areaID, pageSize int, cursor pageCursor) ([]store, pageCursor, error)
+	// Search returns every store matching the criteria, best match first
+	Search(ctx context.Context, criteria searchCriteria) ([]searchResult, error)
+	// Within returns the stores whose coordinates lie inside the box
+	Within(ctx context.Context, box boundingBox) ([]store, error)
+	// NextID allocates a store ID that no other call returns. IDs are
+	// allocated after the highest one Create or BatchCreate has written.
+	NextID(ctx context.Context) (int, error)
+	// Create writes a new store, or returns errStoreExists if its ID is taken
+	Create(ctx context.Context, s store) error
+	// BatchCreate writes several stores at once, replacing any with the same
+	// IDs whatever their version. It is only for writes meant to overwrite.
+	BatchCreate(ctx context.Context, stores []store) error
+	// Update overwrites the stored fields of an existing store if its version
+	// is ifVersion, or any version for anyVersion, and returns the store with
+	// its new version and the row it replaced. It returns errStoreNotFound or
+	// errVersionConflict.
+	Update(ctx context.Context, s store, ifVersion int64) (store, store, error)
+	// UpdateColumns writes only the named columns of an existing store, with
+	// their values taken from s, under the same version check as Update. It
+	// returns the whole store with its new version and the row it replaced.
+	UpdateColumns(ctx context.Context, s store, columns []string, ifVersion int64) (store, store, error)
+	// Delete removes a store if its version is ifVersion, or any version for
+	// anyVersion, and returns the row it removed. It returns errStoreNotFound
+	// or errVersionConflict.
+	Delete(ctx context.Context, id int, ifVersion int64) (store, error)
+}
+
+// AreaRepository is the storage the area handlers depend on
+type AreaRepository interface {
+	// List returns every area
+	List(ctx context.Context) ([]area, error)
+	// Get returns the area with the given ID or errAreaNotFound
+	Get(ctx context.Context, id int) (area, error)
+	// Create writes a new area, or returns errAreaExists if its ID is taken
+	Create(ctx context.Context, a area) error
+	// Save creates or replaces an area
+	Save(ctx context.Context, a area) error
+	// Delete removes an area
+	Delete(ctx context.Context, id int) error
+}
+
+// SeedRepository maps the keys of fixture stores to the store IDs allocated
+// for them and remembers what the seed command last wrote to each
+type SeedRepository interface {
+	// Get returns the seed record of a fixture key or errSeedNotFound
+	Get(ctx context.Context, key string) (seedRecord, error)
+	// Claim maps a fixture key to a store ID unless it already maps to one,
+	// and returns the store ID it maps to
+	Claim(ctx context.Context, key string, id int) (int, error)
+	// Save records what was written to the store a key maps to
+	Save(ctx context.Context, rec seedRecord) error
+}
+
+// IdempotencyRepository remembers the responses to requests sent with an
+// Idempotency-Key until they expire
+type IdempotencyRepository interface {
+	// Claim records the key of a request about to run. If the key is already
+	// taken it returns the record holding it and false.
+	Claim(ctx context.Context, rec idempotencyRecord) (idempotencyRecord, bool, error)
+	// Renew extends the claim of a running request. It returns false once
+	// the key is no longer held by rec's claim.
+	Renew(ctx context.Context, rec idempotencyRecord) (bool, error)
+	// Complete stores the response to a claimed request, or returns
+	// errClaimLost when the key is no longer held by rec's claim
+	Complete(ctx context.Context, rec idempotencyRecord) error
+	// Release forgets a claimed key so the request can run again
+	Release(ctx context.Context, rec idempotencyRecord) error
+}
+
+// LegacyIDRepository maps the UUIDs clients of the old run.go server name
+// stores by to the store IDs allocated for them
+type LegacyIDRepository interface {
+	// Get returns the store ID a UUID maps to or errUUIDNotFound
+	Get(ctx context.Context, uuid string) (int, error)
+	// UUIDs returns the UUIDs of those of the stores that have one, keyed by
+	// store ID
+	UUIDs(ctx context.Context, ids []int) (map[int]string, error)
+	// Claim maps a UUID to a store ID unless it already maps to one, and
+	// returns the store ID it maps to
+	Claim(ctx context.Context, uuid string, id int) (int, error)
+	// Delete forgets a UUID
+	Delete(ctx context.Context, uuid string) error
+}
+
+var (
+	storeRepo       StoreRepository
+	areaRepo        AreaRepository
+	seedRepo        SeedRepository
+	idempotencyRepo IdempotencyRepository
+	legacyIDRepo    LegacyIDRepository
+)
+
+// openRepositories opens the configured storage backend and returns a
+// function releasing its resources. With migrate set the schema is brought up
+// to date first; otherwise a schema with pending migrations is refused.
+func openRepositories(cfg config, migrate bool) (func(), error) {
+	switch cfg.Backend {
+	case "cassandra":
+		policy, err := newConsistencyPolicy(cfg.Cassandra)
+		if err != nil {
+			return nil, err
+		}
+		if migrate {
+			initCassandra(cfg.Cassandra)
+		} else {
+			connectCassandra(cfg.Cassandra)
+			if err := checkSchema(context.Background(), session); err != nil {
+				session.Close()
+				return nil, err
+			}
+		}
+		storeRepo = newCassandraStoreRepository(session, policy)
+		areaRepo = newCassandraAreaRepository(session, policy)
+		seedRepo = newCassandraSeedRepository(session, policy)
+		idempotencyRepo = newCassandraIdempotencyRepository(session, policy, time.Duration(cfg.Server.IdempotencyTTL))
+		legacyIDRepo = newCassandraLegacyIDRepository(session, policy)
+		return session.Close, nil
+	case "memory":
+		log.Println("Using in-memory storage; data is lost on restart")
+		storeRepo = newMemoryStoreRepository()
+		areaRepo = newMemoryAreaRepository()
+		seedRepo = newMemorySeedRepository()
+		idempotencyRepo = newMemoryIdempotencyRepository(time.Duration(cfg.Server.IdempotencyTTL))
+		legacyIDRepo = newMemoryLegacyIDRepository()
+		return func() {}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+// setupRepositories opens the storage backend for the server, migrating its
+// schema, and loads the suggestion index from it, keeping the index current
+// as stores are written
+func setupRepositories(cfg config) (func(), error) {
+	closeFn, err := openRepositories(cfg, true)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := loadSuggestions(context.Background(), storeRepo)
+	if err != nil {
+		closeFn()
+		return nil, fmt.Errorf("loading store suggestions: %w", err)
+	}
+	suggestions = index
+	storeRepo = &suggestingStoreRepository{StoreRepository: storeRepo, index: index}
+
+	return closeFn, nil
+}
+
+// writableStoreColumns are the stores columns a write may change, in the
+// order changedColumns returns them
+var writableStoreColumns = []string{"area_id", "name", "location", "latitude", "longitude"}
+
+// columnValue returns the value of a writable column of s
+func (s store) columnValue(column string) interface{} {
+	switch column {
+	case "area_id":
+		return s.AreaID
+	case "name":
+		return s.Name
+	case "location":
+		return s.Location
+	case "latitude":
+		return s.Latitude
+	case "longitude":
+		return s.Longitude
+	}
+	panic("not a writable store column: " + column)
+}
+
+// withColumns returns s with the named columns copied from src
+func (s store) withColumns(src store, columns []string) store {
+	for _, column := range columns {
+		switch column {
+		case "area_id":
+			s.AreaID = src.AreaID
+		case "name":
+			s.Name = src.Name
+		case "location":
+			s.Location = src.Location
+		case "latitude":
+			s.Latitude = src.Latitude
+		case "longitude":
+			s.Longitude = src.Longitude
+		default:
+			panic("not a writable store column: " + column)
+		}
+	}
+	return s
+}
+
+// changedColumns returns the writable columns whose values differ between
+// two versions of a store
+func changedColumns(old, s store) []string {
+	var columns []string
+	if old.AreaID != s.AreaID {
+		columns = append(columns, "area_id")
+	}
+	if old.Name != s.Name {
+		columns = append(columns, "name")
+	}
+	if old.Location != s.Location {
+		columns = append(columns, "location")
+	}
+	if !sameFloat(old.Latitude, s.Latitude) {
+		columns = append(columns, "latitude")
+	}
+	if !sameFloat(old.Longitude, s.Longitude) {
+		columns = append(columns, "longitude")
+	}
+	return columns
+}
+
+// allStores reads every page of a repository listing
+func allStores(ctx context.Context, repo StoreRepository) ([]store, error) {
+	var all []store
+	var cursor pageCursor
+	for {
+		page, next, err := repo.List(ctx, maxPageSize, cursor)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if next.encode() == "" {
+			return all, nil
+		}
+		cursor = next
+	}
+}
+
+// allStoresInArea reads every page of a repository's listing of one area
+func allStoresInArea(ctx context.Context, repo StoreRepository, areaID int) ([]store, error) {
+	var all []store
+	var cursor pageCursor
+	for {
+		page, next, err := repo.ListByArea(ctx, areaID, maxPageSize, cursor)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if next.encode() == "" {
+			return all, nil
+		}
+		cursor = next
+	}
+}
+
+// suggestingStoreRepository keeps the suggestion index current as writes go
+// through the wrapped repository. Updates and deletes unindex the row the
+// write actually replaced, which a read made beforehand may not be when
+// writers race.
+type suggestingStoreRepository struct {
+	StoreRepository
+	index *suggestionIndex
+}
+
+// previous returns the stored version of a store, if there is one
+func (r *suggestingStoreRepository) previous(ctx context.Context, id int) (*store, error) {
+	old, err := r.StoreRepository.Get(ctx, id)
+	if errors.Is(err, errStoreNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &old, nil
+}
+
+func (r *suggestingStoreRepository) Create(ctx context.Context, s store) error {
+	if err := r.StoreRepository.Create(ctx, s); err != nil {
+		return err
+	}
+	r.index.addStore(s.Name, s.Location)
+	return nil
+}
+
+func (r *suggestingStoreRepository) BatchCreate(ctx context.Context, stores []store) error {
+	olds := make([]*store, len(stores))
+	for i, s := range stores {
+		old, err := r.previous(ctx, s.ID)
+		if err != nil {
+			return err
+		}
+		olds[i] = old
+	}
+
+	if err := r.StoreRepository.BatchCreate(ctx, stores); err != nil {
+		return err
+	}
+
+	for i, s := range stores {
+		if olds[i] != nil {
+			r.index.removeStore(olds[i].Name, olds[i].Location)
+		}
+		r.index.addStore(s.Name, s.Location)
+	}
+	return nil
+}
+
+func (r *suggestingStoreRepository) Update(ctx context.Context, s store, ifVersion int64) (store, store, error) {
+	updated, old, err := r.StoreRepository.Update(ctx, s, ifVersion)
+	if err != nil {
+		return store{}, store{}, err
+	}
+
+	r.index.removeStore(old.Name, old.Location)
+	r.index.addStore(updated.Name, updated.Location)
+	return updated, old, nil
+}
+
+func (r *suggestingStoreRepository) UpdateColumns(ctx context.Context, s store, columns []string, ifVersion int64) (store, store, error) {
+	updated, old, err := r.StoreRepository.UpdateColumns(ctx, s, columns, ifVersion)
+	if err != nil {
+		return store{}, store{}, err
+	}
+
+	r.index.removeStore(old.Name, old.Location)
+	r.index.addStore(updated.Name, updated.Location)
+	return updated, old, nil
+}
+
+func (r *suggestingStoreRepository) Delete(ctx context.Context, id int, ifVersion int64) (store, error) {
+	old, err := r.StoreRepository.Delete(ctx, id, ifVersion)
+	if err != nil {
+		return store{}, err
+	}
+
+	r.index.removeStore(old.Name, old.Location)
+	return old, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultSuggestLimit = 8
+	maxSuggestLimit     = 50
+)
+
+// suggestion is a completion returned by /stores/suggest
+type suggestion struct {
+	Text  string `json:"text"`
+	Field string `json:"field"`
+	Count int    `json:"count"`
+}
+
+// suggestEntry is a distinct name or location value and how many stores use it
+type suggestEntry struct {
+	text       string
+	field      string
+	normalized string
+	count      int
+}
+
+// trieNode is a node of the completion trie. Entries are attached to the node
+// where one of their word-start suffixes ends.
+type trieNode struct {
+	children map[rune]*trieNode
+	entries  map[*suggestEntry]bool
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{children: make(map[rune]*trieNode)}
+}
+
+// suggestionIndex is an in-memory prefix index over store names and locations.
+// It is safe for concurrent use.
+type suggestionIndex struct {
+	mu      sync.RWMutex
+	root    *trieNode
+	entries map[string]*suggestEntry
+}
+
+func newSuggestionIndex() *suggestionIndex {
+	return &suggestionIndex{root: newTrieNode(), entries: make(map[string]*suggestEntry)}
+}
+
+// suggestions is the process-wide completion index, kept current by
+// suggestingStoreRepository
+var suggestions = newSuggestionIndex()
+
+// suggestKeys returns the trie keys for a normalized value: the whole value and
+// the remainder starting at each later word, so "store alpha" completes from
+// both "sto" and "alp"
+func suggestKeys(normalized string) []string {
+	words := strings.Fields(normalized)
+	keys := make([]string, 0, len(words))
+	for i := range words {
+		keys = append(keys, strings.Join(words[i:], " "))
+	}
+	return keys
+}
+
+// normalizeSuggestion folds case and accents and collapses punctuation to spaces
+func normalizeSuggestion(text string) string {
+	return strings.Join(tokenize(text), " ")
+}
+
+// add records one more store using text for field
+func (idx *suggestionIndex) add(field, text string) {
+	normalized := normalizeSuggestion(text)
+	if normalized == "" {
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	key := field + "\x00" + normalized
+	if entry, ok := idx.entries[key]; ok {
+		entry.count++
+		return
+	}
+
+	entry := &suggestEntry{text: text, field: field, normalized: normalized, count: 1}
+	idx.entries[key] = entry
+	for _, k := range suggestKeys(normalized) {
+		node := idx.root
+		for _, r := range k {
+			child, ok := node.children[r]
+			if !ok {
+				child = newTrieNode()
+				node.children[r] = child
+			}
+			node = child
+		}
+		if node.entries == nil {
+			node.entries = make(map[*suggestEntry]bool)
+		}
+		node.entries[entry] = true
+	}
+}
+
+// remove records one fewer store using text for field, dropping the value once unused
+func (idx *suggestionIndex) remove(field, text string) {
+	normalized := normalizeSuggestion(text)
+	if normalized == "" {
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	key := field + "\x00" + normalized
+	entry, ok := idx.entries[key]
+	if !ok {
+		return
+	}
+	entry.count--
+	if entry.count > 0 {
+		return
+	}
+
+	delete(idx.entries, key)
+	for _, k := range suggestKeys(normalized) {
+		idx.root.prune([]rune(k), entry)
+	}
+}
+
+// prune detaches entry from the node at path and removes nodes left empty.
+// It reports whether the node itself is now empty.
+func (n *trieNode) prune(path []rune, entry *suggestEntry) bool {
+	if len(path) == 0 {
+		delete(n.entries, entry)
+	} else if child, ok := n.children[path[0]]; ok {
+		if child.prune(path[1:], entry) {
+			delete(n.children, path[0])
+		}
+	}
+	return len(n.children) == 0 && len(n.entries) == 0
+}
+
+// addStore records a store's name and location
+func (idx *suggestionIndex) addStore(name, location string) {
+	idx.add(fieldName, name)
+	idx.add(fieldLocation, location)
+}
+
+// removeStore forgets a store's name and location
+func (idx *suggestionIndex) removeStore(name, location string) {
+	idx.remove(fieldName, name)
+	idx.remove(fieldLocation, location)
+}
+
+// suggest returns up to limit completions for prefix. Values that start with
+// the prefix rank ahead of values where a later word does, then by store count.
+func (idx *suggestionIndex) suggest(prefix string, limit int) []suggestion {
+	normalized := normalizeSuggestion(prefix)
+	if normalized == "" {
+		return []suggestion{}
+	}
+	// Keep a trailing space so "store " only completes multi-word values
+	if strings.HasSuffix(prefix, " ") {
+		normalized += " "
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	node := idx.root
+	for _, r := range normalized {
+		child, ok := node.children[r]
+		if !ok {
+			return []suggestion{}
+		}
+		node = child
+	}
+
+	found := make(map[*suggestEntry]bool)
+	node.collect(found)
+
+	entries := make([]*suggestEntry, 0, len(found))
+	for entry := range found {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		aStart := strings.HasPrefix(a.normalized, normalized)
+		bStart := strings.HasPrefix(b.normalized, normalized)
+		if aStart != bStart {
+			return aStart
+		}
+		if a.count != b.count {
+			return a.count > b.count
+		}
+		if a.normalized != b.normalized {
+			return a.normalized < b.normalized
+		}
+		return a.field < b.field
+	})
+
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	results := make([]suggestion, 0, len(entries))
+	for _, entry := range entries {
+		results = append(results, suggestion{Text: entry.text, Field: entry.field, Count: entry.count})
+	}
+	return results
+}
+
+// collect gathers every entry in the subtree rooted at n
+func (n *trieNode) collect(found map[*suggestEntry]bool) {
+	for entry := range n.entries {
+		found[entry] = true
+	}
+	for _, child := range n.children {
+		child.collect(found)
+	}
+}
+
+// loadSuggestions builds a completion index from every store in the repository
+func loadSuggestions(ctx context.Context, repo StoreRepository) (*suggestionIndex, error) {
+	stores, err := allStores(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := newSuggestionIndex()
+	for _, s := range stores {
+		idx.addStore(s.Name, s.Location)
+	}
+	return idx, nil
+}
+
+func suggestStores(c *gin.Context) {
+	q := c.Query("q")
+	if strings.TrimSpace(q) == "" {
+		c.Error(badRequest("q is required"))
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultSuggestLimit)))
+	if err != nil || limit <= 0 {
+		c.Error(badRequest("invalid limit"))
+		return
+	}
+	if limit > maxSuggestLimit {
+		limit = maxSuggestLimit
+	}
+
+	c.IndentedJSON(http.StatusOK, suggestions.suggest(q, limit))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestSuggestionIndex(t *testing.T) {
+	idx := newSuggestionIndex()
+	idx.addStore("Store Alpha", "Harbour Road")
+	idx.addStore("Store Beta", "Harbour Road")
+	idx.addStore("Alpine Café", "Hill Street")
+	idx.addStore("Stop & Shop", "")
+
+	tests := []struct {
+		name   string
+		prefix string
+		limit  int
+		want   []suggestion
+	}{
+		{"whole value prefix ranks first", "alp", 10, []suggestion{
+			{Text: "Alpine Café", Field: fieldName, Count: 1},
+			{Text: "Store Alpha", Field: fieldName, Count: 1},
+		}},
+		{"shared values rank by count", "h", 10, []suggestion{
+			{Text: "Harbour Road", Field: fieldLocation, Count: 2},
+			{Text: "Hill Street", Field: fieldLocation, Count: 1},
+		}},
+		{"trailing space needs another word", "stop ", 10, []suggestion{
+			{Text: "Stop & Shop", Field: fieldName, Count: 1},
+		}},
+		{"accents and case are folded", "ALPINE CAFE", 10, []suggestion{
+			{Text: "Alpine Café", Field: fieldName, Count: 1},
+		}},
+		{"limit", "sto", 2, []suggestion{
+			{Text: "Stop & Shop", Field: fieldName, Count: 1},
+			{Text: "Store Alpha", Field: fieldName, Count: 1},
+		}},
+		{"no match", "zzz", 10, []suggestion{}},
+		{"punctuation only", "&", 10, []suggestion{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := idx.suggest(tt.prefix, tt.limit)
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("got %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestSuggestionIndexRemove(t *testing.T) {
+	idx := newSuggestionIndex()
+	idx.addStore("Store Alpha", "Harbour Road")
+	idx.addStore("Store Alpha", "Hill Street")
+
+	idx.removeStore("Store Alpha", "Harbour Road")
+	if got := idx.suggest("alpha", 10); len(got) != 1 || got[0].Count != 1 {
+		t.Errorf("after one removal got %+v, want Store Alpha used once", got)
+	}
+	if got := idx.suggest("harbour", 10); len(got) != 0 {
+		t.Errorf("removed location still suggested: %+v", got)
+	}
+
+	idx.removeStore("Store Alpha", "Hill Street")
+	idx.removeStore("Never Added", "")
+	if len(idx.root.children) != 0 || len(idx.entries) != 0 {
+		t.Errorf("index not empty after removing every store: %d nodes, %d entries", len(idx.root.children), len(idx.entries))
+	}
+}
+
+func TestSuggestStores(t *testing.T) {
+	useMemoryRepositories(t)
+	mustCreateStores(t,
+		store{ID: 1, Name: "Store Alpha", Location: "Harbour Road"},
+		store{ID: 2, Name: "Store Beta", Location: "Harbour Road"},
+	)
+	r := newTestRouter()
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		count  int
+	}{
+		{"prefix", "q=sto", http.StatusOK, 2},
+		{"later word", "q=bet", http.StatusOK, 1},
+		{"limit", "q=sto&limit=1", http.StatusOK, 1},
+		{"missing q", "q=+", http.StatusBadRequest, 0},
+		{"invalid limit", "q=sto&limit=0", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, "/v1/stores/suggest?"+tt.query, "")
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var got []suggestion
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.count {
+				t.Errorf("got %+v, want %d suggestions", got, tt.count)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxNameLength     = 200
+	maxLocationLength = 500
+	// maxID is the largest store or area ID, as both are CQL int columns
+	maxID = math.MaxInt32
+)
+
+// Machine-readable codes of invalid fields
+const (
+	codeRequired        = "required"
+	codeTooLong         = "too_long"
+	codeOutOfRange      = "out_of_range"
+	codeInvalidType     = "invalid_type"
+	codeDuplicate       = "duplicate"
+	codeNotFound        = "not_found"
+	codeMismatch        = "mismatch"
+	codeInvalidGeometry = "invalid_geometry"
+)
+
+// fieldError is one invalid field of a payload
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// validationError lists every invalid field of a payload
+type validationError []fieldError
+
+func (e validationError) Error() string {
+	messages := make([]string, len(e))
+	for i, f := range e {
+		messages[i] = f.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// prefixed returns the field errors with each field prefixed, such as with
+// the index of the item in a batch
+func (e validationError) prefixed(prefix string) []fieldError {
+	errs := make([]fieldError, len(e))
+	for i, f := range e {
+		f.Field = prefix + f.Field
+		errs[i] = f
+	}
+	return errs
+}
+
+// fields returns the errors of the named fields
+func (e validationError) fields(names ...string) []fieldError {
+	var matched []fieldError
+	for _, f := range e {
+		for _, name := range names {
+			if f.Field == name {
+				matched = append(matched, f)
+			}
+		}
+	}
+	return matched
+}
+
+// fieldErrors returns the field errors of a validation error
+func fieldErrors(err error) []fieldError {
+	var invalid validationError
+	if errors.As(err, &invalid) {
+		return invalid
+	}
+	return nil
+}
+
+// isInvalidInput reports whether err rejects the payload rather than
+// reporting a failure to process it
+func isInvalidInput(err error) bool {
+	var invalid validationError
+	var bad inputError
+	return errors.As(err, &invalid) || errors.As(err, &bad)
+}
+
+// storeValidator checks store payloads. It remembers which areas exist and
+// their parsed boundaries so a batch looks each one up once.
+type storeValidator struct {
+	areas map[int]bool
+	// boundaries are the stored areas, loaded for the first payload placed by
+	// its coordinates
+	boundaries []areaBoundary
+	loaded     bool
+	// pending are areas that are not stored yet but count as existing, as the
+	// fixture areas of a seed dry run do
+	pending []areaBoundary
+}
+
+func newStoreValidator() *storeValidator {
+	return &storeValidator{areas: make(map[int]bool)}
+}
+
+// storeFromInput validates a single payload and resolves its area
+func storeFromInput(ctx context.Context, in storeInput) (store, error) {
+	return newStoreValidator().storeFromInput(ctx, in)
+}
+
+// storeUpdateFromInput validates a payload replacing current. Staying in the
+// current area is always allowed, so stores whose area predates the areas
+// table can still be edited.
+func storeUpdateFromInput(ctx context.Context, in storeInput, current store) (store, error) {
+	v := newStoreValidator()
+	v.areas[current.AreaID] = true
+	return v.storeFromInput(ctx, in)
+}
+
+// storeFromInput validates every field of a payload and resolves its area,
+// from areaId when given and otherwise from the area containing the
+// coordinates. A missing id is left for the server to assign. Invalid
+// payloads return a validationError.
+func (v *storeValidator) storeFromInput(ctx context.Context, in storeInput) (store, error) {
+	var errs validationError
+	add := func(field, code, format string, args ...interface{}) {
+		errs = append(errs, fieldError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if in.ID < 0 || in.ID > maxID {
+		add("id", codeOutOfRange, "id must be a positive integer of at most %d", maxID)
+	}
+
+	if strings.TrimSpace(in.Name) == "" {
+		add("name", codeRequired, "name is required")
+	} else if utf8.RuneCountInString(in.Name) > maxNameLength {
+		add("name", codeTooLong, "name must be at most %d characters", maxNameLength)
+	}
+	if utf8.RuneCountInString(in.Location) > maxLocationLength {
+		add("location", codeTooLong, "location must be at most %d characters", maxLocationLength)
+	}
+
+	switch {
+	case in.Latitude == nil && in.Longitude != nil:
+		add("latitude", codeRequired, "latitude is required with longitude")
+	case in.Latitude != nil && in.Longitude == nil:
+		add("longitude", codeRequired, "longitude is required with latitude")
+	}
+	if in.Latitude != nil && (math.IsNaN(*in.Latitude) || *in.Latitude < -90 || *in.Latitude > 90) {
+		add("latitude", codeOutOfRange, "latitude must be between -90 and 90")
+	}
+	if in.Longitude != nil && (math.IsNaN(*in.Longitude) || *in.Longitude < -180 || *in.Longitude > 180) {
+		add("longitude", codeOutOfRange, "longitude must be between -180 and 180")
+	}
+	hasCoordinates := in.Latitude != nil && in.Longitude != nil && len(errs.fields("latitude", "longitude")) == 0
+
+	var areaID int
+	switch {
+	case in.AreaID != nil && (*in.AreaID < 0 || *in.AreaID > maxID):
+		add("areaId", codeOutOfRange, "areaId must be between 0 and %d", maxID)
+	case in.AreaID != nil:
+		exists, err := v.areaExists(ctx, *in.AreaID)
+		if err != nil {
+			return store{}, err
+		}
+		if !exists {
+			add("areaId", codeNotFound, "area %d does not exist", *in.AreaID)
+		}
+		areaID = *in.AreaID
+	case hasCoordinates:
+		id, found, err := v.areaContaining(ctx, *in.Latitude, *in.Longitude)
+		if err != nil {
+			return store{}, err
+		}
+		if !found {
+			add("areaId", codeNotFound, "no area contains the coordinates")
+		}
+		areaID = id
+	case in.Latitude == nil && in.Longitude == nil:
+		add("areaId", codeRequired, "areaId or coordinates are required")
+	}
+
+	if len(errs) > 0 {
+		return store{}, errs
+	}
+	return store{
+		ID:        in.ID,
+		AreaID:    areaID,
+		Name:      in.Name,
+		Location:  in.Location,
+		Latitude:  in.Latitude,
+		Longitude: in.Longitude,
+	}, nil
+}
+
+// requireID rejects a payload without an id where the id says which store to
+// write, as in imports
+func requireID(in storeInput) error {
+	if in.ID == 0 {
+		return validationError{{Field: "id", Code: codeRequired, Message: "id is required"}}
+	}
+	return nil
+}
+
+// addPending counts a not yet stored area as existing, both by ID and for
+// placing stores by their coordinates
+func (v *storeValidator) addPending(a area) {
+	v.areas[a.ID] = true
+	if polygons, err := parseBoundary(a.Boundary); err == nil {
+		v.pending = append(v.pending, areaBoundary{id: a.ID, polygons: polygons})
+	}
+}
+
+// areaContaining returns the ID of the first stored, then pending, area whose
+// boundary contains the point
+func (v *storeValidator) areaContaining(ctx context.Context, lat, lon float64) (int, bool, error) {
+	if !v.loaded {
+		boundaries, err := loadAreaBoundaries(ctx)
+		if err != nil {
+			return 0, false, err
+		}
+		v.boundaries, v.loaded = boundaries, true
+	}
+	if id, ok := boundaryContaining(v.boundaries, lat, lon); ok {
+		return id, true, nil
+	}
+	id, ok := boundaryContaining(v.pending, lat, lon)
+	return id, ok, nil
+}
+
+func (v *storeValidator) areaExists(ctx context.Context, id int) (bool, error) {
+	if exists, ok := v.areas[id]; ok {
+		return exists, nil
+	}
+	_, err := areaRepo.Get(ctx, id)
+	if err != nil && !errors.Is(err, errAreaNotFound) {
+		return false, err
+	}
+	v.areas[id] = err == nil
+	return err == nil, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// fieldCodes renders field errors as field:code pairs
+func fieldCodes(errs []fieldError) []string {
+	codes := make([]string, len(errs))
+	for i, f := range errs {
+		codes[i] = f.Field + ":" + f.Code
+	}
+	return codes
+}
+
+func TestStoreFromInput(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		in     storeInput
+		want   []string
+		areaID int
+	}{
+		{"area by id", storeInput{Name: "A", AreaID: ptr(1)}, nil, 1},
+		{"area by coordinates", storeInput{Name: "A", Latitude: ptr(5.0), Longitude: ptr(5.0)}, nil, 1},
+		{"areaId wins over coordinates", storeInput{Name: "A", AreaID: ptr(1), Latitude: ptr(50.0), Longitude: ptr(50.0)}, nil, 1},
+		{"longest name", storeInput{Name: strings.Repeat("é", maxNameLength), AreaID: ptr(1)}, nil, 1},
+		{"nothing", storeInput{}, []string{"name:required", "areaId:required"}, 0},
+		{"blank name", storeInput{Name: "  ", AreaID: ptr(1)}, []string{"name:required"}, 0},
+		{"negative id", storeInput{ID: -1, Name: "A", AreaID: ptr(1)}, []string{"id:out_of_range"}, 0},
+		{"id beyond a CQL int", storeInput{ID: maxID + 1, Name: "A", AreaID: ptr(1)}, []string{"id:out_of_range"}, 0},
+		{"long name", storeInput{Name: strings.Repeat("é", maxNameLength+1), AreaID: ptr(1)}, []string{"name:too_long"}, 0},
+		{"long location", storeInput{Name: "A", Location: strings.Repeat("x", maxLocationLength+1), AreaID: ptr(1)}, []string{"location:too_long"}, 0},
+		{"latitude alone", storeInput{Name: "A", AreaID: ptr(1), Latitude: ptr(5.0)}, []string{"longitude:required"}, 0},
+		{"longitude alone", storeInput{Name: "A", AreaID: ptr(1), Longitude: ptr(5.0)}, []string{"latitude:required"}, 0},
+		{"coordinates out of range", storeInput{Name: "A", Latitude: ptr(91.0), Longitude: ptr(-181.0)},
+			[]string{"latitude:out_of_range", "longitude:out_of_range"}, 0},
+		{"NaN latitude", storeInput{Name: "A", AreaID: ptr(1), Latitude: ptr(math.NaN()), Longitude: ptr(0.0)}, []string{"latitude:out_of_range"}, 0},
+		{"negative areaId", storeInput{Name: "A", AreaID: ptr(-1)}, []string{"areaId:out_of_range"}, 0},
+		{"areaId beyond a CQL int", storeInput{Name: "A", AreaID: ptr(maxID + 1)}, []string{"areaId:out_of_range"}, 0},
+		{"unknown area", storeInput{Name: "A", AreaID: ptr(9)}, []string{"areaId:not_found"}, 0},
+		{"coordinates outside every area", storeInput{Name: "A", Latitude: ptr(50.0), Longitude: ptr(50.0)}, []string{"areaId:not_found"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := storeFromInput(context.Background(), tt.in)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if s.AreaID != tt.areaID || s.Name != tt.in.Name {
+					t.Errorf("got %+v", s)
+				}
+				return
+			}
+			var invalid validationError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("got %v, want a validationError", err)
+			}
+			if got := fieldCodes(invalid); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreUpdateFromInput(t *testing.T) {
+	useMemoryRepositories(t)
+
+	// Area 7 predates the areas table and was never created
+	current := store{ID: 1, AreaID: 7, Name: "A"}
+	if _, err := storeUpdateFromInput(context.Background(), storeInput{ID: 1, Name: "B", AreaID: ptr(7)}, current); err != nil {
+		t.Errorf("staying in the current area: %v", err)
+	}
+	_, err := storeUpdateFromInput(context.Background(), storeInput{ID: 1, Name: "B", AreaID: ptr(8)}, current)
+	if got := fieldCodes(fieldErrors(err)); strings.Join(got, ",") != "areaId:not_found" {
+		t.Errorf("moving to a missing area: got %v", err)
+	}
+}
+
+// countingAreas counts how often every area is listed
+type countingAreas struct {
+	AreaRepository
+	lists int
+}
+
+func (r *countingAreas) List(ctx context.Context) ([]area, error) {
+	r.lists++
+	return r.AreaRepository.List(ctx)
+}
+
+func TestStoreValidatorAreaContaining(t *testing.T) {
+	useMemoryRepositories(t)
+	areas := &countingAreas{AreaRepository: areaRepo}
+	areaRepo = areas
+	ctx := context.Background()
+	if err := areaRepo.Create(ctx, testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	v := newStoreValidator()
+	pending := testArea(2)
+	pending.Boundary = json.RawMessage(`{"type":"Polygon","coordinates":[[[20,20],[30,20],[30,30],[20,30],[20,20]]]}`)
+	v.addPending(pending)
+
+	tests := []struct {
+		lat, lon float64
+		want     int
+	}{
+		{5, 5, 1},
+		{25, 25, 2},
+		{1, 9, 1},
+		{-5, -5, 0},
+	}
+	for _, tt := range tests {
+		s, err := v.storeFromInput(ctx, storeInput{Name: "A", Latitude: ptr(tt.lat), Longitude: ptr(tt.lon)})
+		if tt.want == 0 {
+			if got := fieldCodes(fieldErrors(err)); strings.Join(got, ",") != "areaId:not_found" {
+				t.Errorf("(%v, %v): got %v, want areaId:not_found", tt.lat, tt.lon, err)
+			}
+			continue
+		}
+		if err != nil || s.AreaID != tt.want {
+			t.Errorf("(%v, %v): got area %d, %v, want %d", tt.lat, tt.lon, s.AreaID, err, tt.want)
+		}
+	}
+	if areas.lists != 1 {
+		t.Errorf("listed areas %d times for one validator, want 1", areas.lists)
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	err := validationError{
+		{Field: "name", Code: codeRequired, Message: "name is required"},
+		{Field: "latitude", Code: codeOutOfRange, Message: "latitude must be between -90 and 90"},
+	}
+	if got := err.Error(); got != "name is required; latitude must be between -90 and 90" {
+		t.Errorf("Error() = %q", got)
+	}
+	if got := fieldCodes(err.prefixed("[2].")); strings.Join(got, ",") != "[2].name:required,[2].latitude:out_of_range" {
+		t.Errorf("prefixed: %v", got)
+	}
+	if err[0].Field != "name" {
+		t.Error("prefixed changed the error it was called on")
+	}
+	if got := err.fields("latitude", "longitude"); len(got) != 1 || got[0].Field != "latitude" {
+		t.Errorf("fields: %v", got)
+	}
+
+	tests := []struct {
+		err     error
+		invalid bool
+	}{
+		{err, true},
+		{inputError("bad"), true},
+		{errors.New("timeout"), false},
+		{errStoreNotFound, false},
+	}
+	for _, tt := range tests {
+		if got := isInvalidInput(tt.err); got != tt.invalid {
+			t.Errorf("isInvalidInput(%v) = %v", tt.err, got)
+		}
+	}
+	if requireID(storeInput{ID: 3}) != nil || fieldCodes(fieldErrors(requireID(storeInput{})))[0] != "id:required" {
+		t.Error("requireID")
+	}
+}
+
+func TestUpdateStoreValidation(t *testing.T) {
+	useMemoryRepositories(t)
+	if err := areaRepo.Create(context.Background(), testArea(1)); err != nil {
+		t.Fatal(err)
+	}
+	mustCreateStores(t, store{ID: 1, AreaID: 1, Name: "A"})
+	r := newTestRouter()
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   []string
+	}{
+		{"keeps the area", `{"name":"B"}`, http.StatusOK, nil},
+		{"id mismatch", `{"id":2,"name":"B"}`, http.StatusBadRequest, []string{"id:mismatch"}},
+		{"every invalid field", `{"name":"","latitude":100}`, http.StatusBadRequest, []string{"name:required", "longitude:required", "latitude:out_of_range"}},
+		{"wrong type", `{"name":1}`, http.StatusBadRequest, []string{"name:invalid_type"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodPut, "/v1/stores/1", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.want == nil {
+				return
+			}
+			var p problem
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			if got := fieldCodes(p.Errors); p.Code != errCodeValidation || strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %s %v, want %v", p.Code, got, tt.want)
+			}
+		})
+	}
+}